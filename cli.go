@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"kvas2-go/dns-proxy"
+	"kvas2-go/domain-list"
+	"kvas2-go/models"
+)
+
+const ctlUsage = `Usage: kvas2-go ctl [-socket path] <command> [arguments]
+
+Commands:
+  group list
+  group add <id> <name> <interface> [fix-protect]
+  group add-block <id> <name> [nxdomain|null]
+  group add-bypass <id> <name> <wan-interface> [gateway]
+  group rm <id>
+  domain list <groupID>
+  domain add <groupID> <plaintext|wildcard|regex|suffix|cidr|asn|geoip> <domain> [comment]
+  domain import <groupID> <plain|hosts|adblock> <file>
+  domain rm <groupID> <domainID>
+  domain enable <groupID> <domainID>
+  domain disable <groupID> <domainID>
+  client list <groupID>
+  client add <groupID> <ip|subnet|mac>
+  client rm <groupID> <ip|subnet|mac>
+  records dump
+  lists refresh
+  dns stats
+  ipset show <groupID>
+  interfaces
+  health
+`
+
+var (
+	ErrCtlUsage = errors.New("invalid usage")
+)
+
+type ctlClient struct {
+	SocketPath string
+
+	lastID uint64
+}
+
+func (c *ctlClient) Call(command string, args interface{}, result interface{}) error {
+	conn, err := net.DialTimeout("unix", c.SocketPath, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to connect to daemon: %w", err)
+	}
+	defer conn.Close()
+
+	c.lastID++
+	request := controlRequest{
+		Version: ControlProtocolVersion,
+		ID:      c.lastID,
+		Command: command,
+	}
+	if args != nil {
+		request.Args, err = json.Marshal(args)
+		if err != nil {
+			return fmt.Errorf("failed to encode arguments: %w", err)
+		}
+	}
+
+	data, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %w", err)
+	}
+	_, err = conn.Write(append(data, '\n'))
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	response := controlResponse{}
+	err = json.Unmarshal(line, &response)
+	if err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	if response.ID != request.ID {
+		return fmt.Errorf("unexpected response id %d, want %d", response.ID, request.ID)
+	}
+	if !response.OK {
+		if response.Error == nil {
+			return errors.New("request failed")
+		}
+		return response.Error
+	}
+
+	if result != nil && len(response.Data) != 0 {
+		err = json.Unmarshal(response.Data, result)
+		if err != nil {
+			return fmt.Errorf("failed to decode result: %w", err)
+		}
+	}
+	return nil
+}
+
+func parseCtlInts(args []string) ([]int, error) {
+	values := make([]int, len(args))
+	for i, arg := range args {
+		value, err := strconv.Atoi(arg)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s is not a number", ErrCtlUsage, arg)
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+func runCtl(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("ctl", flag.ContinueOnError)
+	socketPath := flags.String("socket", ControlSocketPath, "path to control socket")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), ctlUsage)
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	args = flags.Args()
+
+	client := &ctlClient{SocketPath: *socketPath}
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	command := strings.Join(args[:min(2, len(args))], " ")
+	switch {
+	case command == "group list" && len(args) == 2:
+		groups := make([]*models.Group, 0)
+		err = client.Call("group.list", nil, &groups)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "ID\tNAME\tMODE\tINTERFACE\tFIX PROTECT\tDOMAINS")
+		for _, group := range groups {
+			mode := group.Mode
+			if mode == "" {
+				mode = models.GroupModeRoute
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%t\t%d\n", group.ID, group.Name, mode, strings.Join(group.InterfaceNames(), ","), group.FixProtect, len(group.Domains))
+		}
+		return nil
+	case command == "group add" && (len(args) == 5 || len(args) == 6):
+		ids, err := parseCtlInts(args[2:3])
+		if err != nil {
+			return err
+		}
+		group := &models.Group{
+			ID:         ids[0],
+			Name:       args[3],
+			Interface:  args[4],
+			FixProtect: len(args) == 6 && args[5] == "fix-protect",
+		}
+		return client.Call("group.add", group, nil)
+	case command == "group add-block" && (len(args) == 4 || len(args) == 5):
+		ids, err := parseCtlInts(args[2:3])
+		if err != nil {
+			return err
+		}
+		group := &models.Group{
+			ID:   ids[0],
+			Name: args[3],
+			Mode: models.GroupModeBlock,
+		}
+		if len(args) == 5 {
+			group.BlockResponse = args[4]
+		}
+		return client.Call("group.add", group, nil)
+	case command == "group add-bypass" && (len(args) == 5 || len(args) == 6):
+		ids, err := parseCtlInts(args[2:3])
+		if err != nil {
+			return err
+		}
+		group := &models.Group{
+			ID:        ids[0],
+			Name:      args[3],
+			Mode:      models.GroupModeBypass,
+			Interface: args[4],
+		}
+		if len(args) == 6 {
+			group.Gateway = args[5]
+		}
+		return client.Call("group.add", group, nil)
+	case command == "group rm" && len(args) == 3:
+		ids, err := parseCtlInts(args[2:3])
+		if err != nil {
+			return err
+		}
+		return client.Call("group.remove", controlGroupArgs{GroupID: ids[0]}, nil)
+	case command == "domain list" && len(args) == 3:
+		ids, err := parseCtlInts(args[2:3])
+		if err != nil {
+			return err
+		}
+		groups := make([]*models.Group, 0)
+		err = client.Call("group.list", nil, &groups)
+		if err != nil {
+			return err
+		}
+		for _, group := range groups {
+			if group.ID != ids[0] {
+				continue
+			}
+			fmt.Fprintln(w, "ID\tTYPE\tDOMAIN\tENABLED\tCOMMENT")
+			for _, domain := range group.Domains {
+				fmt.Fprintf(w, "%d\t%s\t%s\t%t\t%s\n", domain.ID, domain.Type, domain.Domain, domain.Enable, domain.Comment)
+			}
+			return nil
+		}
+		return ErrGroupNotFound
+	case command == "domain add" && (len(args) == 5 || len(args) == 6):
+		ids, err := parseCtlInts(args[2:3])
+		if err != nil {
+			return err
+		}
+		domain := &models.Domain{
+			Type:   args[3],
+			Domain: args[4],
+			Enable: true,
+		}
+		if len(args) == 6 {
+			domain.Comment = args[5]
+		}
+		var domainID int
+		err = client.Call("domain.add", controlDomainAddArgs{GroupID: ids[0], Domain: domain}, &domainID)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%d\n", domainID)
+		return nil
+	case command == "domain import" && len(args) == 5:
+		ids, err := parseCtlInts(args[2:3])
+		if err != nil {
+			return err
+		}
+		file, err := os.Open(args[4])
+		if err != nil {
+			return fmt.Errorf("failed to open list: %w", err)
+		}
+		defer file.Close()
+		domains, err := domainList.Parse(file, args[3])
+		if err != nil {
+			return err
+		}
+		var added int
+		err = client.Call("domain.import", controlDomainImportArgs{GroupID: ids[0], Domains: domains}, &added)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%d of %d domains imported\n", added, len(domains))
+		return nil
+	case (command == "domain rm" || command == "domain enable" || command == "domain disable") && len(args) == 4:
+		ids, err := parseCtlInts(args[2:4])
+		if err != nil {
+			return err
+		}
+		controlCommand := map[string]string{
+			"rm":      "domain.remove",
+			"enable":  "domain.enable",
+			"disable": "domain.disable",
+		}[args[1]]
+		return client.Call(controlCommand, controlDomainArgs{GroupID: ids[0], DomainID: ids[1]}, nil)
+	case command == "client list" && len(args) == 3:
+		ids, err := parseCtlInts(args[2:3])
+		if err != nil {
+			return err
+		}
+		clients := make([]string, 0)
+		err = client.Call("client.list", controlGroupArgs{GroupID: ids[0]}, &clients)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "CLIENT")
+		for _, c := range clients {
+			fmt.Fprintln(w, c)
+		}
+		return nil
+	case (command == "client add" || command == "client rm") && len(args) == 4:
+		ids, err := parseCtlInts(args[2:3])
+		if err != nil {
+			return err
+		}
+		controlCommand := map[string]string{
+			"add": "client.add",
+			"rm":  "client.remove",
+		}[args[1]]
+		return client.Call(controlCommand, controlClientArgs{GroupID: ids[0], Client: args[3]}, nil)
+	case command == "records dump" && len(args) == 2:
+		records := recordsSnapshot{}
+		err = client.Call("records.dump", nil, &records)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "NAME\tTYPE\tVALUE\tDEADLINE")
+		for name, aRecords := range records.ARecords {
+			for _, aRecord := range aRecords {
+				fmt.Fprintf(w, "%s\tA\t%s\t%s\n", name, aRecord.Address, aRecord.Deadline.Format(time.RFC3339))
+			}
+		}
+		for name, aRecords := range records.AAAARecords {
+			for _, aRecord := range aRecords {
+				fmt.Fprintf(w, "%s\tAAAA\t%s\t%s\n", name, aRecord.Address, aRecord.Deadline.Format(time.RFC3339))
+			}
+		}
+		for name, cNameRecord := range records.CNameRecords {
+			fmt.Fprintf(w, "%s\tCNAME\t%s\t%s\n", name, cNameRecord.Alias, cNameRecord.Deadline.Format(time.RFC3339))
+		}
+		return nil
+	case command == "lists refresh" && len(args) == 2:
+		return client.Call("lists.refresh", nil, nil)
+	case command == "dns stats" && len(args) == 2:
+		stats := dnsProxy.Stats{}
+		err = client.Call("dns.stats", nil, &stats)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "QUERIES\tRATE LIMITED\tQUEUE FULL")
+		fmt.Fprintf(w, "%d\t%d\t%d\n", stats.Queries, stats.RateLimited, stats.QueueFull)
+		return nil
+	case command == "ipset show" && len(args) == 3:
+		ids, err := parseCtlInts(args[2:3])
+		if err != nil {
+			return err
+		}
+		content := ipsetContent{}
+		err = client.Call("ipset.show", controlGroupArgs{GroupID: ids[0]}, &content)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "ADDRESS\tTIMEOUT")
+		for _, entry := range append(content.IPv4, content.IPv6...) {
+			timeout := "-"
+			if entry.Timeout != nil {
+				timeout = strconv.Itoa(int(*entry.Timeout))
+			}
+			fmt.Fprintf(w, "%s\t%s\n", entry.Address, timeout)
+		}
+		return nil
+	case command == "interfaces" && len(args) == 1:
+		interfaces := make([]interfaceInfo, 0)
+		err = client.Call("interfaces.list", nil, &interfaces)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "INDEX\tNAME\tMTU\tUP")
+		for _, iface := range interfaces {
+			fmt.Fprintf(w, "%d\t%s\t%d\t%t\n", iface.Index, iface.Name, iface.MTU, iface.Up)
+		}
+		return nil
+	case command == "health" && len(args) == 1:
+		health := make([]interfaceHealth, 0)
+		err = client.Call("health.list", nil, &health)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "GROUP\tINTERFACE\tLINK UP\tHEALTHY\tACTIVE")
+		for _, iface := range health {
+			fmt.Fprintf(w, "%d\t%s\t%t\t%t\t%t\n", iface.GroupID, iface.Interface, iface.LinkUp, iface.Healthy, iface.Active)
+		}
+		return nil
+	}
+
+	flags.Usage()
+	return ErrCtlUsage
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"kvas2-go/models"
+	"kvas2-go/netfilter-helper"
+
+	"github.com/rs/zerolog/log"
+	"github.com/vishvananda/netlink"
+)
+
+var (
+	ErrClientConflict = errors.New("client already exists")
+	ErrClientNotFound = errors.New("client not found")
+)
+
+// isScoped reports whether the group applies to DNS queries of its clients
+// only. Route group is scoped by ScopeDNS, block group is scoped when it has
+// clients.
+func (g *Group) isScoped() bool {
+	if g.IsBlock() {
+		return len(g.Clients) != 0
+	}
+	return g.ScopeDNS
+}
+
+// learnDomain remembers domain name queried by a client of the scoped group
+// until the deadline
+func (g *Group) learnDomain(name string, deadline time.Time) {
+	if !g.isScoped() {
+		return
+	}
+	g.learnedMutex.Lock()
+	defer g.learnedMutex.Unlock()
+	if g.learnedDomains == nil {
+		g.learnedDomains = make(map[string]time.Time)
+	}
+	if deadline.After(g.learnedDomains[name]) {
+		g.learnedDomains[name] = deadline
+	}
+}
+
+func (g *Group) isLearnedDomain(name string) bool {
+	g.learnedMutex.Lock()
+	defer g.learnedMutex.Unlock()
+	_, exists := g.learnedDomains[name]
+	return exists
+}
+
+func (g *Group) pruneLearnedDomains(now time.Time) {
+	g.learnedMutex.Lock()
+	defer g.learnedMutex.Unlock()
+	for name, deadline := range g.learnedDomains {
+		if now.After(deadline) {
+			delete(g.learnedDomains, name)
+		}
+	}
+}
+
+// resetLearnedDomains forgets domains queried by previous clients
+func (g *Group) resetLearnedDomains() {
+	g.learnedMutex.Lock()
+	defer g.learnedMutex.Unlock()
+	g.learnedDomains = nil
+}
+
+const (
+	neighborCacheTTL         = 30 * time.Second
+	neighborCacheNegativeTTL = 5 * time.Second
+)
+
+// clientSelector is a parsed client selector of the group
+type clientSelector struct {
+	network *net.IPNet
+	mac     net.HardwareAddr
+}
+
+// parseClients parses client selectors of the group once, so DNS queries
+// don't parse them again. Invalid selectors are rejected by validation.
+func (g *Group) parseClients() {
+	selectors := make([]clientSelector, 0, len(g.Clients))
+	for _, client := range g.Clients {
+		network, mac, err := models.ParseClient(client)
+		if err != nil {
+			continue
+		}
+		selectors = append(selectors, clientSelector{network: network, mac: mac})
+	}
+	g.clientSelectors = selectors
+}
+
+// acceptsClient reports whether DNS query of the client applies to the group.
+// Caller must hold App mutex.
+func (a *App) acceptsClient(group *Group, client netip.Addr) bool {
+	if !group.isScoped() {
+		return true
+	}
+
+	var mac net.HardwareAddr
+	macResolved := false
+	for _, selector := range group.clientSelectors {
+		if selector.network != nil {
+			if selector.network.Contains(client.AsSlice()) {
+				return true
+			}
+			continue
+		}
+		if !macResolved {
+			mac = a.neighbors.MAC(client)
+			macResolved = true
+		}
+		if mac != nil && bytes.Equal(mac, selector.mac) {
+			return true
+		}
+	}
+	return false
+}
+
+type neighborEntry struct {
+	mac     net.HardwareAddr
+	expires time.Time
+}
+
+// neighborCache resolves LAN clients to MAC addresses. Neighbor table is
+// dumped only on cache miss and the dump fills the cache for all clients.
+// Unknown clients are remembered for a shorter time.
+type neighborCache struct {
+	mutex   sync.Mutex
+	entries map[netip.Addr]neighborEntry
+	// list is netlink.NeighList, replaced by tests
+	list func(linkIndex, family int) ([]netlink.Neigh, error)
+}
+
+// MAC returns MAC address of the client, nil when it is unknown
+func (c *neighborCache) MAC(client netip.Addr) net.HardwareAddr {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	if entry, exists := c.entries[client]; exists && now.Before(entry.expires) {
+		return entry.mac
+	}
+
+	c.refresh(client.Is6(), now)
+	entry, exists := c.entries[client]
+	if !exists || !now.Before(entry.expires) {
+		entry = neighborEntry{expires: now.Add(neighborCacheNegativeTTL)}
+		c.entries[client] = entry
+	}
+	return entry.mac
+}
+
+// refresh replaces cache entries of the family with the neighbor table
+func (c *neighborCache) refresh(ipv6 bool, now time.Time) {
+	for addr, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, addr)
+		}
+	}
+	if c.entries == nil {
+		c.entries = make(map[netip.Addr]neighborEntry)
+	}
+
+	list := c.list
+	if list == nil {
+		list = netlink.NeighList
+	}
+	family := netlink.FAMILY_V4
+	if ipv6 {
+		family = netlink.FAMILY_V6
+	}
+	neighbors, err := list(0, family)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to list neighbors")
+		return
+	}
+	for _, neighbor := range neighbors {
+		if neighbor.HardwareAddr == nil {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(neighbor.IP)
+		if ok {
+			c.entries[addr.Unmap()] = neighborEntry{mac: neighbor.HardwareAddr, expires: now.Add(neighborCacheTTL)}
+		}
+	}
+}
+
+// applyClientFilter turns client filtering of the group routing on when the
+// group has clients. Routing must be re-enabled to apply the change.
+func (g *Group) applyClientFilter() {
+	g.ifaceToIPSet.FilterClients = len(g.Clients) != 0
+	g.ifaceToIPSet6.FilterClients = len(g.Clients) != 0
+}
+
+// syncClients writes client selectors of the group into client sets
+func (g *Group) syncClients() error {
+	networks := make(map[string]*net.IPNet)
+	networks6 := make(map[string]*net.IPNet)
+	macs := make(map[string]net.HardwareAddr)
+	for _, client := range g.Clients {
+		network, mac, err := models.ParseClient(client)
+		if err != nil {
+			return err
+		}
+		switch {
+		case mac != nil:
+			macs[mac.String()] = mac
+		case network.IP.To4() != nil:
+			networks[network.String()] = network
+		default:
+			networks6[network.String()] = network
+		}
+	}
+
+	var errs []error
+	for _, set := range []struct {
+		ipset    *netfilterHelper.IPSet
+		networks map[string]*net.IPNet
+	}{
+		{g.clientSet, networks},
+		{g.clientSet6, networks6},
+	} {
+		err := syncClientSet(set.ipset, set.networks)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	oldMACs, err := g.macSet.ListMACs()
+	if err != nil {
+		return errors.Join(append(errs, fmt.Errorf("failed to get MAC set list: %w", err))...)
+	}
+	for key, mac := range macs {
+		if _, exists := oldMACs[key]; exists {
+			continue
+		}
+		err = g.macSet.AddMAC(mac)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for key := range oldMACs {
+		if _, exists := macs[key]; exists {
+			continue
+		}
+		mac, _ := net.ParseMAC(key)
+		err = g.macSet.DelMAC(mac)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func syncClientSet(ipset *netfilterHelper.IPSet, networks map[string]*net.IPNet) error {
+	addresses, err := ipset.List()
+	if err != nil {
+		return fmt.Errorf("failed to get client set list: %w", err)
+	}
+	oldNetworks, err := ipset.ListNets()
+	if err != nil {
+		return fmt.Errorf("failed to get client set list: %w", err)
+	}
+	for addr := range addresses {
+		ip := net.IP(addr)
+		oldNetworks[(&net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}).String()] = nil
+	}
+
+	var errs []error
+	for key, network := range networks {
+		if _, exists := oldNetworks[key]; exists {
+			continue
+		}
+		err = ipset.AddNet(network, nil)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for key := range oldNetworks {
+		if _, exists := networks[key]; exists {
+			continue
+		}
+		_, network, err := net.ParseCIDR(key)
+		if err == nil {
+			err = ipset.DelNet(network)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// setClients replaces client selectors of the group. Routing is re-enabled
+// when client filtering is turned on or off.
+func (g *Group) setClients(clients []string) error {
+	reEnable := g.Enabled && (len(g.Clients) == 0) != (len(clients) == 0)
+	if reEnable {
+		errs := g.Disable()
+		if errs != nil {
+			log.Warn().Int("group", g.ID).Err(errors.Join(errs...)).Msg("failed to disable group")
+		}
+	}
+
+	g.Clients = clients
+	g.resetLearnedDomains()
+	g.parseClients()
+	g.applyClientFilter()
+	err := g.syncClients()
+
+	if reEnable {
+		enableErr := g.Enable()
+		if enableErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to enable group: %w", enableErr))
+		}
+	}
+	return err
+}
+
+// clientIndex returns index of the client selector among clients comparing
+// their canonical forms, or -1. Client must be normalized.
+func clientIndex(clients []string, client string) int {
+	return slices.IndexFunc(clients, func(other string) bool {
+		normalized, err := models.NormalizeClient(other)
+		return err == nil && normalized == client
+	})
+}
+
+// AddClient adds client selector to the group in canonical form
+func (a *App) AddClient(groupID int, client string) error {
+	client, err := models.NormalizeClient(client)
+	if err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	group, exists := a.Groups[groupID]
+	if !exists {
+		return ErrGroupNotFound
+	}
+	if clientIndex(group.Clients, client) >= 0 {
+		return ErrClientConflict
+	}
+
+	clients := append(slices.Clone(group.Clients), client)
+	err = group.setClients(clients)
+	if err != nil {
+		return err
+	}
+	return a.SyncGroup(group)
+}
+
+// RemoveClient removes client selector from the group. Selector written
+// differently than the stored one is removed as well.
+func (a *App) RemoveClient(groupID int, client string) error {
+	client, err := models.NormalizeClient(client)
+	if err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	group, exists := a.Groups[groupID]
+	if !exists {
+		return ErrGroupNotFound
+	}
+	i := clientIndex(group.Clients, client)
+	if i < 0 {
+		return ErrClientNotFound
+	}
+
+	clients := slices.Delete(slices.Clone(group.Clients), i, i+1)
+	err = group.setClients(clients)
+	if err != nil {
+		return err
+	}
+	return a.SyncGroup(group)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"kvas2-go/dns-proxy"
+	"kvas2-go/models"
+)
+
+var (
+	ErrConfigLinkNameMissing   = errors.New("link name is not specified")
+	ErrConfigListenPortMissing = errors.New("listen port is not specified")
+	ErrConfigTargetDNSMissing  = errors.New("target DNS server address is not specified")
+	ErrConfigInvalidAddress    = errors.New("invalid address")
+)
+
+type ConfigFile struct {
+	Config Config          `json:"config"`
+	Groups []*models.Group `json:"groups"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		MinimalTTL:             time.Hour,
+		ChainPrefix:            "KVAS2_",
+		IpSetPrefix:            "kvas2_",
+		LinkName:               "br0",
+		TargetDNSServerAddress: "127.0.0.1:53",
+		CacheSize:              4096,
+		DNSWorkers:             32,
+		DNSQueueSize:           256,
+		ClientRateLimit:        100,
+		ClientRateBurst:        200,
+		ListenPort:             7548,
+		RecordsPath:            "/opt/var/lib/kvas2-go/records.json",
+		RecordsSaveInterval:    5 * time.Minute,
+		ListsRefreshInterval:   6 * time.Hour,
+		DatabaseCheckInterval:  time.Minute,
+	}
+}
+
+// UnmarshalJSON accepts durations in Go notation (e.g. "1h30m") instead of
+// nanoseconds.
+func (c *Config) UnmarshalJSON(data []byte) error {
+	type config Config
+	aux := struct {
+		*config
+		MinimalTTL            *string `json:"minimalTTL"`
+		RecordsSaveInterval   *string `json:"recordsSaveInterval"`
+		ListsRefreshInterval  *string `json:"listsRefreshInterval"`
+		DatabaseCheckInterval *string `json:"databaseCheckInterval"`
+	}{
+		config: (*config)(c),
+	}
+
+	err := json.Unmarshal(data, &aux)
+	if err != nil {
+		return err
+	}
+
+	for _, duration := range []struct {
+		name  string
+		value *string
+		dst   *time.Duration
+	}{
+		{"minimalTTL", aux.MinimalTTL, &c.MinimalTTL},
+		{"recordsSaveInterval", aux.RecordsSaveInterval, &c.RecordsSaveInterval},
+		{"listsRefreshInterval", aux.ListsRefreshInterval, &c.ListsRefreshInterval},
+		{"databaseCheckInterval", aux.DatabaseCheckInterval, &c.DatabaseCheckInterval},
+	} {
+		if duration.value == nil {
+			continue
+		}
+		*duration.dst, err = time.ParseDuration(*duration.value)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", duration.name, err)
+		}
+	}
+
+	return nil
+}
+
+func (c *Config) MarshalJSON() ([]byte, error) {
+	type config Config
+	return json.Marshal(struct {
+		*config
+		MinimalTTL            string `json:"minimalTTL"`
+		RecordsSaveInterval   string `json:"recordsSaveInterval"`
+		ListsRefreshInterval  string `json:"listsRefreshInterval"`
+		DatabaseCheckInterval string `json:"databaseCheckInterval"`
+	}{
+		config:                (*config)(c),
+		MinimalTTL:            c.MinimalTTL.String(),
+		RecordsSaveInterval:   c.RecordsSaveInterval.String(),
+		ListsRefreshInterval:  c.ListsRefreshInterval.String(),
+		DatabaseCheckInterval: c.DatabaseCheckInterval.String(),
+	})
+}
+
+// upstreamAddresses returns upstream DNS servers, TargetDNSServerAddress is
+// used when no upstreams are configured
+func (c *Config) upstreamAddresses() []string {
+	if len(c.UpstreamDNSServers) != 0 {
+		return c.UpstreamDNSServers
+	}
+	if c.TargetDNSServerAddress == "" {
+		return nil
+	}
+	return []string{c.TargetDNSServerAddress}
+}
+
+// staticRecords builds static records table of the proxy
+func (c *Config) staticRecords() (*dnsProxy.StaticRecords, error) {
+	records := dnsProxy.NewStaticRecords()
+	for name, addresses := range c.StaticRecords {
+		ips := make([]net.IP, len(addresses))
+		for i, address := range addresses {
+			ips[i] = net.ParseIP(address)
+			if ips[i] == nil {
+				return nil, fmt.Errorf("static record %s: %w: %s", name, ErrConfigInvalidAddress, address)
+			}
+		}
+		records.Set(name, ips)
+	}
+	return records, nil
+}
+
+func (c *Config) Validate() error {
+	if c.LinkName == "" {
+		return ErrConfigLinkNameMissing
+	}
+	if c.ListenPort == 0 {
+		return ErrConfigListenPortMissing
+	}
+	if len(c.upstreamAddresses()) == 0 {
+		return ErrConfigTargetDNSMissing
+	}
+	upstreams, err := dnsProxy.NewUpstreamPool(c.UpstreamStrategy, c.upstreamAddresses())
+	if err != nil {
+		return err
+	}
+	_ = upstreams.Close()
+	_, err = c.staticRecords()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (cf *ConfigFile) Validate() error {
+	err := cf.Config.Validate()
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+
+	groupIDs := make(map[int]struct{})
+	for i, group := range cf.Groups {
+		if _, exists := groupIDs[group.ID]; exists {
+			return fmt.Errorf("group #%d (id %d): %w", i, group.ID, ErrGroupIDConflict)
+		}
+		groupIDs[group.ID] = struct{}{}
+
+		err = group.Validate()
+		if err != nil {
+			return fmt.Errorf("group #%d (id %d): %w", i, group.ID, err)
+		}
+	}
+
+	return nil
+}
+
+func ParseConfig(data []byte) (*ConfigFile, error) {
+	cf := &ConfigFile{
+		Config: DefaultConfig(),
+	}
+
+	err := json.Unmarshal(data, cf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+
+	err = cf.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, group := range cf.Groups {
+		for _, domain := range group.Domains {
+			domain.Group = group
+		}
+	}
+
+	return cf, nil
+}
+
+func LoadConfig(path string) (*ConfigFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	return ParseConfig(data)
+}
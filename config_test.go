@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"kvas2-go/dns-proxy"
+	"kvas2-go/models"
+)
+
+func TestParseConfig(t *testing.T) {
+	cf, err := ParseConfig([]byte(`{
+		"config": {"minimalTTL": "30m", "linkName": "br1"},
+		"groups": [{"id": 1, "interface": "nwg0", "domains": [{"id": 1, "type": "plaintext", "domain": "example.com", "enable": true}]}]
+	}`))
+	if err != nil {
+		t.Fatalf("ParseConfig() returns error: %v", err)
+	}
+	if cf.Config.MinimalTTL != 30*time.Minute {
+		t.Fatalf("Config.MinimalTTL = %v, want \"30m\"", cf.Config.MinimalTTL)
+	}
+	if cf.Config.LinkName != "br1" {
+		t.Fatalf("Config.LinkName = %s, want \"br1\"", cf.Config.LinkName)
+	}
+	if cf.Config.ListenPort != DefaultConfig().ListenPort {
+		t.Fatalf("Config.ListenPort = %d, want default \"%d\"", cf.Config.ListenPort, DefaultConfig().ListenPort)
+	}
+	if len(cf.Groups) != 1 || len(cf.Groups[0].Domains) != 1 {
+		t.Fatalf("ParseConfig() groups = %v, want 1 group with 1 domain", cf.Groups)
+	}
+	if cf.Groups[0].Domains[0].Group != cf.Groups[0] {
+		t.Fatal("Domain.Group is not linked to parent group")
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	_, err := ParseConfig([]byte(`{"groups": [{"id": 1, "interface": "nwg0"}, {"id": 1, "interface": "nwg1"}]}`))
+	if !errors.Is(err, ErrGroupIDConflict) {
+		t.Fatalf("ParseConfig() with duplicated IDs returns %v, want ErrGroupIDConflict", err)
+	}
+
+	_, err = ParseConfig([]byte(`{"groups": [{"id": 1}]}`))
+	if !errors.Is(err, models.ErrGroupInterfaceMissing) {
+		t.Fatalf("ParseConfig() without interface returns %v, want ErrGroupInterfaceMissing", err)
+	}
+
+	_, err = ParseConfig([]byte(`{"groups": [{"id": 1, "interface": "nwg0", "domains": [{"type": "glob", "domain": "example.com"}]}]}`))
+	if !errors.Is(err, models.ErrUnknownDomainType) {
+		t.Fatalf("ParseConfig() with unknown domain type returns %v, want ErrUnknownDomainType", err)
+	}
+
+	_, err = ParseConfig([]byte(`{"config": {"upstreamStrategy": "random"}}`))
+	if !errors.Is(err, dnsProxy.ErrUnknownUpstreamStrategy) {
+		t.Fatalf("ParseConfig() with unknown upstream strategy returns %v, want ErrUnknownUpstreamStrategy", err)
+	}
+
+	_, err = ParseConfig([]byte(`{"config": {"staticRecords": {"nas.lan": ["192.168.1.300"]}}}`))
+	if !errors.Is(err, ErrConfigInvalidAddress) {
+		t.Fatalf("ParseConfig() with invalid static address returns %v, want ErrConfigInvalidAddress", err)
+	}
+
+	_, err = ParseConfig([]byte(`{"config": {"minimalTTL": "forever"}}`))
+	if err == nil {
+		t.Fatal("ParseConfig() with invalid duration returns nil")
+	}
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"kvas2-go/models"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Control socket protocol is newline-delimited JSON. Every request is
+// answered with a response carrying the same ID, several requests may be sent
+// over one connection. Plain text messages (e.g. "netfilter.d:iptables:nat"
+// from the NDM hook) are still accepted and never answered.
+const (
+	ControlSocketPath      = "/opt/var/run/kvas2-go.sock"
+	ControlProtocolVersion = 1
+
+	controlMaxMessageSize = 1024 * 1024
+)
+
+const (
+	controlErrInvalidRequest     = "invalid_request"
+	controlErrUnsupportedVersion = "unsupported_version"
+	controlErrUnknownCommand     = "unknown_command"
+	controlErrInvalidArguments   = "invalid_arguments"
+	controlErrNotFound           = "not_found"
+	controlErrConflict           = "conflict"
+	controlErrInternal           = "internal"
+)
+
+var (
+	ErrUnknownCommand      = errors.New("unknown command")
+	ErrInvalidArguments    = errors.New("invalid arguments")
+	ErrUnsupportedProtocol = errors.New("unsupported protocol version")
+	ErrMessageTooLarge     = errors.New("control message is too large")
+)
+
+type controlRequest struct {
+	Version int             `json:"version"`
+	ID      uint64          `json:"id"`
+	Command string          `json:"command"`
+	Args    json.RawMessage `json:"args,omitempty"`
+}
+
+type controlError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *controlError) Error() string {
+	return e.Message
+}
+
+type controlResponse struct {
+	Version int             `json:"version"`
+	ID      uint64          `json:"id"`
+	OK      bool            `json:"ok"`
+	Error   *controlError   `json:"error,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+type controlGroupArgs struct {
+	GroupID int `json:"groupID"`
+}
+
+type controlDomainArgs struct {
+	GroupID  int `json:"groupID"`
+	DomainID int `json:"domainID"`
+}
+
+type controlDomainAddArgs struct {
+	GroupID int            `json:"groupID"`
+	Domain  *models.Domain `json:"domain"`
+}
+
+type controlDomainImportArgs struct {
+	GroupID int              `json:"groupID"`
+	Domains []*models.Domain `json:"domains"`
+}
+
+type controlClientArgs struct {
+	GroupID int    `json:"groupID"`
+	Client  string `json:"client"`
+}
+
+type controlNetfilterDArgs struct {
+	Type  string `json:"type"`
+	Table string `json:"table"`
+}
+
+type controlCommand func(a *App, args json.RawMessage) (interface{}, error)
+
+// controlCommands is a registry of commands available on the control socket
+var controlCommands map[string]controlCommand
+
+func init() {
+	controlCommands = map[string]controlCommand{
+		"commands.list":   controlCommandsList,
+		"group.list":      controlGroupList,
+		"group.add":       controlGroupAdd,
+		"group.remove":    controlGroupRemove,
+		"domain.add":      controlDomainAdd,
+		"domain.remove":   controlDomainRemove,
+		"domain.import":   controlDomainImport,
+		"domain.enable":   controlDomainSetEnabled(true),
+		"domain.disable":  controlDomainSetEnabled(false),
+		"client.list":     controlClientList,
+		"client.add":      controlClientAdd,
+		"client.remove":   controlClientRemove,
+		"records.dump":    controlRecordsDump,
+		"lists.refresh":   controlListsRefresh,
+		"dns.stats":       controlDNSStats,
+		"ipset.show":      controlIPSetShow,
+		"interfaces.list": controlInterfacesList,
+		"health.list":     controlHealthList,
+		"netfilter.d":     controlNetfilterD,
+	}
+}
+
+func (a *App) handleControlConnection(conn net.Conn) {
+	defer func() {
+		// TODO: Handle error
+		_ = conn.Close()
+	}()
+
+	reader := bufio.NewReader(conn)
+	first, err := reader.Peek(1)
+	if err != nil {
+		return
+	}
+
+	if first[0] != '{' {
+		// Legacy plain text message from netfilter.d hook
+		buf := make([]byte, 1024)
+		n, err := reader.Read(buf)
+		if err != nil {
+			return
+		}
+		a.handleLegacyControlMessage(string(buf[:n]))
+		return
+	}
+
+	for {
+		data, err := readControlLine(reader, controlMaxMessageSize)
+		if errors.Is(err, ErrMessageTooLarge) {
+			// Rest of the line can't be skipped safely, connection is closed
+			response := newControlErrorResponse(0, controlErrInvalidRequest, err)
+			responseData, _ := json.Marshal(response)
+			_, _ = conn.Write(append(responseData, '\n'))
+			return
+		}
+		if len(bytes.TrimSpace(data)) != 0 {
+			response := a.handleControlRequest(data)
+			responseData, err := json.Marshal(response)
+			if err != nil {
+				log.Error().Err(err).Msg("failed to encode control response")
+				return
+			}
+
+			_, err = conn.Write(append(responseData, '\n'))
+			if err != nil {
+				log.Error().Err(err).Msg("failed to write control response")
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// readControlLine reads a request limited by size. Request is terminated by
+// newline or by closing the write side.
+func readControlLine(reader *bufio.Reader, limit int) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(line)+len(chunk) > limit {
+			return nil, ErrMessageTooLarge
+		}
+		line = append(line, chunk...)
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return line, err
+		}
+	}
+}
+
+// handleLegacyControlMessage runs "netfilter.d" command of the plain text
+// message "netfilter.d:<type>:<table>"
+func (a *App) handleLegacyControlMessage(message string) {
+	args := strings.Split(message, ":")
+	if len(args) != 3 || args[0] != "netfilter.d" {
+		log.Warn().Str("message", message).Msg("unknown legacy control message")
+		return
+	}
+
+	data, err := json.Marshal(controlNetfilterDArgs{Type: args[1], Table: args[2]})
+	if err == nil {
+		_, err = controlCommands["netfilter.d"](a, data)
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("failed to handle legacy control message")
+	}
+}
+
+func (a *App) handleNetfilterD(iptType, table string) {
+	log.Debug().Str("type", iptType).Str("table", table).Msg("netfilter.d event")
+	dnsOverrider := a.dnsOverrider4
+	if iptType == "ip6tables" {
+		dnsOverrider = a.dnsOverrider6
+	}
+	if dnsOverrider != nil && dnsOverrider.Enabled {
+		err := dnsOverrider.PutIPTable(table)
+		if err != nil {
+			log.Error().Err(err).Msg("error while fixing iptables after netfilter.d")
+		}
+	}
+
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	for _, group := range a.Groups {
+		ifaceToIPSet := group.ifaceToIPSet
+		if iptType == "ip6tables" {
+			ifaceToIPSet = group.ifaceToIPSet6
+		}
+		if ifaceToIPSet.Enabled {
+			err := ifaceToIPSet.PutIPTable(table)
+			if err != nil {
+				log.Error().Err(err).Msg("error while fixing iptables after netfilter.d")
+			}
+		}
+	}
+}
+
+func controlErrorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrUnknownCommand):
+		return controlErrUnknownCommand
+	case errors.Is(err, ErrInvalidArguments), isValidationError(err):
+		return controlErrInvalidArguments
+	case errors.Is(err, ErrGroupNotFound), errors.Is(err, ErrDomainNotFound), errors.Is(err, ErrClientNotFound):
+		return controlErrNotFound
+	case errors.Is(err, ErrGroupIDConflict), errors.Is(err, ErrDomainIDConflict), errors.Is(err, ErrClientConflict):
+		return controlErrConflict
+	}
+	return controlErrInternal
+}
+
+func newControlErrorResponse(id uint64, code string, err error) *controlResponse {
+	return &controlResponse{
+		Version: ControlProtocolVersion,
+		ID:      id,
+		Error: &controlError{
+			Code:    code,
+			Message: err.Error(),
+		},
+	}
+}
+
+func (a *App) handleControlRequest(data []byte) *controlResponse {
+	request := controlRequest{}
+	err := json.Unmarshal(data, &request)
+	if err != nil {
+		return newControlErrorResponse(0, controlErrInvalidRequest, fmt.Errorf("invalid request: %w", err))
+	}
+
+	// Requests without version are treated as the first version
+	if request.Version > ControlProtocolVersion {
+		return newControlErrorResponse(request.ID, controlErrUnsupportedVersion, fmt.Errorf("%w: %d", ErrUnsupportedProtocol, request.Version))
+	}
+
+	command, ok := controlCommands[request.Command]
+	if !ok {
+		err = fmt.Errorf("%w: %s", ErrUnknownCommand, request.Command)
+		return newControlErrorResponse(request.ID, controlErrUnknownCommand, err)
+	}
+
+	result, err := command(a, request.Args)
+	if err != nil {
+		return newControlErrorResponse(request.ID, controlErrorCode(err), err)
+	}
+
+	response := &controlResponse{
+		Version: ControlProtocolVersion,
+		ID:      request.ID,
+		OK:      true,
+	}
+	if result != nil {
+		response.Data, err = json.Marshal(result)
+		if err != nil {
+			return newControlErrorResponse(request.ID, controlErrInternal, fmt.Errorf("failed to encode result: %w", err))
+		}
+	}
+	return response
+}
+
+func decodeControlArgs(args json.RawMessage, v interface{}) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%w: arguments are required", ErrInvalidArguments)
+	}
+	err := json.Unmarshal(args, v)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidArguments, err)
+	}
+	return nil
+}
+
+func controlCommandsList(a *App, args json.RawMessage) (interface{}, error) {
+	commands := make([]string, 0, len(controlCommands))
+	for name := range controlCommands {
+		commands = append(commands, name)
+	}
+	sort.Strings(commands)
+	return commands, nil
+}
+
+func controlGroupList(a *App, args json.RawMessage) (interface{}, error) {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	// Encode under lock to avoid races with modifications
+	data, err := json.Marshal(a.sortedGroups())
+	return json.RawMessage(data), err
+}
+
+func controlGroupAdd(a *App, args json.RawMessage) (interface{}, error) {
+	group := &models.Group{}
+	err := decodeControlArgs(args, group)
+	if err != nil {
+		return nil, err
+	}
+	err = group.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return nil, a.AddGroup(group)
+}
+
+func controlGroupRemove(a *App, args json.RawMessage) (interface{}, error) {
+	groupArgs := controlGroupArgs{}
+	err := decodeControlArgs(args, &groupArgs)
+	if err != nil {
+		return nil, err
+	}
+	return nil, a.RemoveGroup(groupArgs.GroupID)
+}
+
+func controlDomainAdd(a *App, args json.RawMessage) (interface{}, error) {
+	domainArgs := controlDomainAddArgs{}
+	err := decodeControlArgs(args, &domainArgs)
+	if err != nil {
+		return nil, err
+	}
+	if domainArgs.Domain == nil {
+		return nil, fmt.Errorf("%w: domain is not specified", ErrInvalidArguments)
+	}
+	err = domainArgs.Domain.Validate()
+	if err != nil {
+		return nil, err
+	}
+	err = a.AddDomain(domainArgs.GroupID, domainArgs.Domain)
+	if err != nil {
+		return nil, err
+	}
+	return domainArgs.Domain.ID, nil
+}
+
+func controlDomainImport(a *App, args json.RawMessage) (interface{}, error) {
+	importArgs := controlDomainImportArgs{}
+	err := decodeControlArgs(args, &importArgs)
+	if err != nil {
+		return nil, err
+	}
+	for i, domain := range importArgs.Domains {
+		if domain == nil {
+			return nil, fmt.Errorf("%w: domain #%d is not specified", ErrInvalidArguments, i)
+		}
+		err = domain.Validate()
+		if err != nil {
+			return nil, fmt.Errorf("domain #%d (%s): %w", i, domain.Domain, err)
+		}
+	}
+	return a.ImportDomains(importArgs.GroupID, importArgs.Domains)
+}
+
+func controlDomainRemove(a *App, args json.RawMessage) (interface{}, error) {
+	domainArgs := controlDomainArgs{}
+	err := decodeControlArgs(args, &domainArgs)
+	if err != nil {
+		return nil, err
+	}
+	return nil, a.RemoveDomain(domainArgs.GroupID, domainArgs.DomainID)
+}
+
+func controlDomainSetEnabled(enable bool) controlCommand {
+	return func(a *App, args json.RawMessage) (interface{}, error) {
+		domainArgs := controlDomainArgs{}
+		err := decodeControlArgs(args, &domainArgs)
+		if err != nil {
+			return nil, err
+		}
+		return nil, a.SetDomainEnabled(domainArgs.GroupID, domainArgs.DomainID, enable)
+	}
+}
+
+func controlRecordsDump(a *App, args json.RawMessage) (interface{}, error) {
+	return a.Records.snapshot(), nil
+}
+
+func controlClientList(a *App, args json.RawMessage) (interface{}, error) {
+	groupArgs := controlGroupArgs{}
+	err := decodeControlArgs(args, &groupArgs)
+	if err != nil {
+		return nil, err
+	}
+	group, err := a.GetGroup(groupArgs.GroupID)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	clients := make([]string, len(group.Clients))
+	copy(clients, group.Clients)
+	return clients, nil
+}
+
+func controlClientAdd(a *App, args json.RawMessage) (interface{}, error) {
+	clientArgs := controlClientArgs{}
+	err := decodeControlArgs(args, &clientArgs)
+	if err != nil {
+		return nil, err
+	}
+	return nil, a.AddClient(clientArgs.GroupID, clientArgs.Client)
+}
+
+func controlClientRemove(a *App, args json.RawMessage) (interface{}, error) {
+	clientArgs := controlClientArgs{}
+	err := decodeControlArgs(args, &clientArgs)
+	if err != nil {
+		return nil, err
+	}
+	return nil, a.RemoveClient(clientArgs.GroupID, clientArgs.Client)
+}
+
+func controlListsRefresh(a *App, args json.RawMessage) (interface{}, error) {
+	a.requestListsRefresh()
+	return nil, nil
+}
+
+func controlDNSStats(a *App, args json.RawMessage) (interface{}, error) {
+	return a.DNSProxy.Stats(), nil
+}
+
+func controlIPSetShow(a *App, args json.RawMessage) (interface{}, error) {
+	groupArgs := controlGroupArgs{}
+	err := decodeControlArgs(args, &groupArgs)
+	if err != nil {
+		return nil, err
+	}
+	return a.groupIPSetContent(groupArgs.GroupID)
+}
+
+func controlInterfacesList(a *App, args json.RawMessage) (interface{}, error) {
+	return a.interfaceInfos()
+}
+
+func controlHealthList(a *App, args json.RawMessage) (interface{}, error) {
+	return a.HealthList(), nil
+}
+
+func controlNetfilterD(a *App, args json.RawMessage) (interface{}, error) {
+	netfilterDArgs := controlNetfilterDArgs{}
+	err := decodeControlArgs(args, &netfilterDArgs)
+	if err != nil {
+		return nil, err
+	}
+	a.handleNetfilterD(netfilterDArgs.Type, netfilterDArgs.Table)
+	return nil, nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"kvas2-go/models"
+)
+
+func TestControlSocketRoundTrip(t *testing.T) {
+	app := &App{
+		Groups:  make(map[int]*Group),
+		Records: NewRecords(),
+	}
+	app.Groups[1] = &Group{Group: &models.Group{ID: 1, Name: "Test", Interface: "nwg0", Clients: []string{"192.168.1.10"}}}
+
+	socketPath := filepath.Join(t.TempDir(), "kvas2-go.sock")
+	socket, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("net.Listen() returns error: %v", err)
+	}
+	defer socket.Close()
+	go func() {
+		for {
+			conn, err := socket.Accept()
+			if err != nil {
+				return
+			}
+			go app.handleControlConnection(conn)
+		}
+	}()
+
+	client := &ctlClient{SocketPath: socketPath}
+
+	groups := make([]*models.Group, 0)
+	err = client.Call("group.list", nil, &groups)
+	if err != nil {
+		t.Fatalf("group.list returns error: %v", err)
+	}
+	if len(groups) != 1 || groups[0].Name != "Test" {
+		t.Fatalf("group.list = %v, want 1 group named \"Test\"", groups)
+	}
+
+	err = client.Call("group.remove", controlGroupArgs{GroupID: 2}, nil)
+	var controlErr *controlError
+	if !errors.As(err, &controlErr) || controlErr.Code != controlErrNotFound {
+		t.Fatalf("group.remove of unknown group returns %v, want \"%s\" error", err, controlErrNotFound)
+	}
+
+	clients := make([]string, 0)
+	err = client.Call("client.list", controlGroupArgs{GroupID: 1}, &clients)
+	if err != nil || len(clients) != 1 || clients[0] != "192.168.1.10" {
+		t.Fatalf("client.list = %v, %v, want [\"192.168.1.10\"]", clients, err)
+	}
+
+	err = client.Call("client.add", controlClientArgs{GroupID: 1, Client: "tv.lan"}, nil)
+	if !errors.As(err, &controlErr) || controlErr.Code != controlErrInvalidArguments {
+		t.Fatalf("client.add of invalid client returns %v, want \"%s\" error", err, controlErrInvalidArguments)
+	}
+
+	err = client.Call("client.remove", controlClientArgs{GroupID: 1, Client: "192.168.1.11"}, nil)
+	if !errors.As(err, &controlErr) || controlErr.Code != controlErrNotFound {
+		t.Fatalf("client.remove of unknown client returns %v, want \"%s\" error", err, controlErrNotFound)
+	}
+
+	err = client.Call("unknown.command", nil, nil)
+	if !errors.As(err, &controlErr) || controlErr.Code != controlErrUnknownCommand {
+		t.Fatalf("unknown.command returns %v, want \"%s\" error", err, controlErrUnknownCommand)
+	}
+
+	err = client.Call("group.remove", nil, nil)
+	if !errors.As(err, &controlErr) || controlErr.Code != controlErrInvalidArguments {
+		t.Fatalf("group.remove without arguments returns %v, want \"%s\" error", err, controlErrInvalidArguments)
+	}
+
+	err = runCtl([]string{"-socket", socketPath, "group"}, io.Discard)
+	if !errors.Is(err, ErrCtlUsage) {
+		t.Fatalf("runCtl() with incomplete command returns %v, want ErrCtlUsage", err)
+	}
+}
+
+func TestControlSocketPipelining(t *testing.T) {
+	app := &App{
+		Groups:  make(map[int]*Group),
+		Records: NewRecords(),
+	}
+
+	client, server := net.Pipe()
+	go app.handleControlConnection(server)
+	defer client.Close()
+
+	go func() {
+		_, _ = client.Write([]byte(`{"version": 1, "id": 10, "command": "group.list"}` + "\n" +
+			`{"version": 99, "id": 11, "command": "group.list"}` + "\n"))
+	}()
+
+	decoder := json.NewDecoder(client)
+	for _, want := range []struct {
+		id   uint64
+		ok   bool
+		code string
+	}{
+		{10, true, ""},
+		{11, false, controlErrUnsupportedVersion},
+	} {
+		response := controlResponse{}
+		err := decoder.Decode(&response)
+		if err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if response.ID != want.id || response.OK != want.ok {
+			t.Fatalf("response = {id: %d, ok: %t}, want {id: %d, ok: %t}", response.ID, response.OK, want.id, want.ok)
+		}
+		if !want.ok && (response.Error == nil || response.Error.Code != want.code) {
+			t.Fatalf("response error = %v, want \"%s\"", response.Error, want.code)
+		}
+	}
+}
+
+func TestControlSocketLegacyMessage(t *testing.T) {
+	app := &App{Groups: make(map[int]*Group)}
+
+	var calls []controlNetfilterDArgs
+	original := controlCommands["netfilter.d"]
+	controlCommands["netfilter.d"] = func(a *App, args json.RawMessage) (interface{}, error) {
+		netfilterDArgs := controlNetfilterDArgs{}
+		err := decodeControlArgs(args, &netfilterDArgs)
+		calls = append(calls, netfilterDArgs)
+		return nil, err
+	}
+	t.Cleanup(func() {
+		controlCommands["netfilter.d"] = original
+	})
+
+	for _, message := range []string{"netfilter.d:iptables:nat", "netfilter.d:ip6tables", "unknown:iptables:nat"} {
+		client, server := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			app.handleControlConnection(server)
+			close(done)
+		}()
+
+		_, err := client.Write([]byte(message))
+		if err != nil {
+			t.Fatalf("failed to write legacy message: %v", err)
+		}
+		<-done
+		_ = client.Close()
+	}
+
+	if len(calls) != 1 || calls[0] != (controlNetfilterDArgs{Type: "iptables", Table: "nat"}) {
+		t.Fatalf(`netfilter.d calls = %v, want "[{iptables nat}]"`, calls)
+	}
+}
+
+func TestControlSocketLineLimit(t *testing.T) {
+	app := &App{Groups: make(map[int]*Group)}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go app.handleControlConnection(server)
+
+	// Connection is not limited, only the single request is
+	request := func(id int, size int) []byte {
+		data := []byte(fmt.Sprintf(`{"id": %d, "command": "commands.list"`, id))
+		data = append(data, bytes.Repeat([]byte(" "), size-len(data)-2)...)
+		return append(data, '}', '\n')
+	}
+	go func() {
+		for id, size := range []int{controlMaxMessageSize * 2 / 3, controlMaxMessageSize * 2 / 3, controlMaxMessageSize + 1} {
+			_, err := client.Write(request(id+1, size))
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	decoder := json.NewDecoder(client)
+	for _, want := range []struct {
+		id   uint64
+		ok   bool
+		code string
+	}{
+		{1, true, ""},
+		{2, true, ""},
+		{0, false, controlErrInvalidRequest},
+	} {
+		response := controlResponse{}
+		err := decoder.Decode(&response)
+		if err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if response.ID != want.id || response.OK != want.ok {
+			t.Fatalf("response = {id: %d, ok: %t}, want {id: %d, ok: %t}", response.ID, response.OK, want.id, want.ok)
+		}
+		if !want.ok && (response.Error == nil || response.Error.Code != want.code) {
+			t.Fatalf("response error = %v, want \"%s\"", response.Error, want.code)
+		}
+	}
+}
+
+func TestControlErrorCode(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		code string
+	}{
+		{fmt.Errorf("%w: %q", models.ErrInvalidCountry, "X1"), controlErrInvalidArguments},
+		{fmt.Errorf("%w: test", models.ErrInvalidRegex), controlErrInvalidArguments},
+		{ErrInvalidArguments, controlErrInvalidArguments},
+		{ErrGroupNotFound, controlErrNotFound},
+		{ErrClientConflict, controlErrConflict},
+		{errors.New("test"), controlErrInternal},
+	} {
+		if code := controlErrorCode(tc.err); code != tc.code {
+			t.Fatalf("controlErrorCode(%v) = %q, want %q", tc.err, code, tc.code)
+		}
+	}
+}
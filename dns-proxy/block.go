@@ -0,0 +1,55 @@
+package dnsProxy
+
+import (
+	"fmt"
+	"net"
+)
+
+type BlockMode int
+
+const (
+	BlockNone BlockMode = iota
+	// BlockNXDomain answers blocked names with NXDOMAIN
+	BlockNXDomain
+	// BlockNullAddress answers blocked names with 0.0.0.0 and ::
+	BlockNullAddress
+)
+
+// newBlockedResponse builds a local answer to the blocked request
+func newBlockedResponse(request []byte, mode BlockMode) ([]byte, error) {
+	if mode == BlockNXDomain {
+		return newErrorResponse(request, RCodeNXDomain)
+	}
+
+	msg, err := ParseResponse(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse request: %w", err)
+	}
+
+	response := Message{
+		ID: msg.ID,
+		Flags: Flags{
+			QR:     1,
+			Opcode: msg.Flags.Opcode,
+			RD:     msg.Flags.RD,
+			RA:     1,
+			RCode:  RCodeNoError,
+		},
+		QD: msg.QD,
+	}
+	for _, question := range msg.QD {
+		header := ResourceRecordHeader{
+			Name:  question.QName,
+			Type:  question.QType,
+			Class: question.QClass,
+			TTL:   DefaultStaticTTL,
+		}
+		switch question.QType {
+		case 1:
+			response.AN = append(response.AN, Address{ResourceRecordHeader: header, Address: net.IPv4zero.To4()})
+		case 28:
+			response.AN = append(response.AN, IPv6Address{ResourceRecordHeader: header, Address: net.IPv6zero})
+		}
+	}
+	return response.Encode(), nil
+}
@@ -0,0 +1,92 @@
+package dnsProxy
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestDNSProxyBlock(t *testing.T) {
+	address, served := startFakeUpstream(t)
+	pool, err := NewUpstreamPool(StrategyFailover, []string{address})
+	if err != nil {
+		t.Fatalf("NewUpstreamPool() returns error: %v", err)
+	}
+
+	handled := 0
+	mode := BlockNXDomain
+	proxy := New(0, pool)
+	proxy.BlockSelector = func(client netip.Addr, name string) BlockMode {
+		return mode
+	}
+	proxy.MsgHandler = func(client netip.Addr, msg *Message) {
+		handled++
+	}
+
+	response, err := proxy.exchange("udp", testClient, testRequest(1), DNSMaxUDPPackageSize)
+	if err != nil {
+		t.Fatalf("DNSProxy.exchange() returns error: %v", err)
+	}
+	msg, err := ParseResponse(response)
+	if err != nil {
+		t.Fatalf("ParseResponse() returns error: %v", err)
+	}
+	if msg.ID != 1 || msg.Flags.RCode != RCodeNXDomain {
+		t.Fatalf("DNSProxy.exchange() = %+v, want NXDOMAIN response to request 1", msg)
+	}
+
+	mode = BlockNullAddress
+	response, err = proxy.exchange("udp", testClient, testRequest(2), DNSMaxUDPPackageSize)
+	if err != nil {
+		t.Fatalf("DNSProxy.exchange() returns error: %v", err)
+	}
+	msg, err = ParseResponse(response)
+	if err != nil {
+		t.Fatalf("ParseResponse() returns error: %v", err)
+	}
+	if len(msg.AN) != 1 || !msg.AN[0].(Address).Address.Equal(net.IPv4zero) {
+		t.Fatalf(`DNSProxy.exchange() AN = %+v, want "0.0.0.0"`, msg.AN)
+	}
+
+	if len(served) != 0 || handled != 0 {
+		t.Fatalf("blocked queries reached upstream %d times and MsgHandler %d times, want 0", len(served), handled)
+	}
+}
+
+func TestDNSProxyBlockPerClient(t *testing.T) {
+	address, served := startFakeUpstream(t)
+	pool, err := NewUpstreamPool(StrategyFailover, []string{address})
+	if err != nil {
+		t.Fatalf("NewUpstreamPool() returns error: %v", err)
+	}
+
+	kid := netip.MustParseAddr("192.168.1.20")
+	handledClients := make([]netip.Addr, 0)
+	proxy := New(0, pool)
+	proxy.BlockSelector = func(client netip.Addr, name string) BlockMode {
+		if client == kid {
+			return BlockNXDomain
+		}
+		return BlockNone
+	}
+	proxy.MsgHandler = func(client netip.Addr, msg *Message) {
+		handledClients = append(handledClients, client)
+	}
+
+	response, err := proxy.exchange("udp", kid, testRequest(1), DNSMaxUDPPackageSize)
+	if err != nil {
+		t.Fatalf("DNSProxy.exchange() returns error: %v", err)
+	}
+	msg, err := ParseResponse(response)
+	if err != nil || msg.Flags.RCode != RCodeNXDomain {
+		t.Fatalf("DNSProxy.exchange() for blocked client = %+v, %v, want NXDOMAIN", msg, err)
+	}
+
+	_, err = proxy.exchange("udp", testClient, testRequest(2), DNSMaxUDPPackageSize)
+	if err != nil {
+		t.Fatalf("DNSProxy.exchange() returns error: %v", err)
+	}
+	if len(served) != 1 || len(handledClients) != 1 || handledClients[0] != testClient {
+		t.Fatalf("MsgHandler called for %v, want [%s]", handledClients, testClient)
+	}
+}
@@ -0,0 +1,279 @@
+package dnsProxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultCacheMaxTTL = 24 * time.Hour
+
+	typeOPT = 41
+)
+
+type cacheKey struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+type cacheEntry struct {
+	response []byte
+	// ttlOffsets are positions of TTL fields of resource records in response
+	ttlOffsets []int
+	ttls       []uint32
+	stored     time.Time
+	expires    time.Time
+}
+
+// Cache keeps upstream responses until the smallest TTL of their records
+// expires. Negative responses are kept for the SOA minimum TTL.
+type Cache struct {
+	MaxEntries int
+	MaxTTL     time.Duration
+
+	mutex   sync.Mutex
+	entries map[cacheKey]*cacheEntry
+	now     func() time.Time
+}
+
+func questionKey(msg *Message) (cacheKey, bool) {
+	if len(msg.QD) != 1 {
+		return cacheKey{}, false
+	}
+	return cacheKey{
+		Name:  strings.ToLower(msg.QD[0].QName.String()),
+		Type:  msg.QD[0].QType,
+		Class: msg.QD[0].QClass,
+	}, true
+}
+
+// requestKey returns key of the single question of the request
+func requestKey(request []byte) (cacheKey, bool) {
+	msg, err := ParseResponse(request)
+	if err != nil {
+		return cacheKey{}, false
+	}
+	return questionKey(msg)
+}
+
+// resourceRecordTTLOffsets walks through the message and returns positions of
+// TTL fields of all resource records except OPT pseudo-records
+func resourceRecordTTLOffsets(response []byte) ([]int, error) {
+	if len(response) < 12 {
+		return nil, io.EOF
+	}
+
+	qdCount := int(binary.BigEndian.Uint16(response[4:6]))
+	rrCount := int(binary.BigEndian.Uint16(response[6:8])) +
+		int(binary.BigEndian.Uint16(response[8:10])) +
+		int(binary.BigEndian.Uint16(response[10:12]))
+
+	var err error
+	pos := 12
+	for i := 0; i < qdCount; i++ {
+		_, pos, err = parseName(response, pos)
+		if err != nil {
+			return nil, err
+		}
+		pos += 4
+	}
+
+	offsets := make([]int, 0, rrCount)
+	for i := 0; i < rrCount; i++ {
+		_, pos, err = parseName(response, pos)
+		if err != nil {
+			return nil, err
+		}
+		if len(response) < pos+10 {
+			return nil, io.EOF
+		}
+		if binary.BigEndian.Uint16(response[pos:pos+2]) != typeOPT {
+			offsets = append(offsets, pos+4)
+		}
+		pos += 10 + int(binary.BigEndian.Uint16(response[pos+8:pos+10]))
+		if len(response) < pos {
+			return nil, io.EOF
+		}
+	}
+	return offsets, nil
+}
+
+// responseTTL returns how long the response may be cached, zero means the
+// response must not be cached
+func responseTTL(msg *Message) uint32 {
+	if msg.Flags.TC == 1 {
+		return 0
+	}
+
+	switch {
+	case msg.Flags.RCode == RCodeNoError && len(msg.AN) != 0:
+		ttl := uint32(0)
+		first := true
+		for _, records := range [][]ResourceRecord{msg.AN, msg.NS, msg.AR} {
+			for _, record := range records {
+				header := resourceRecordHeader(record)
+				if header == nil || header.Type == typeOPT {
+					continue
+				}
+				if first || header.TTL < ttl {
+					ttl = header.TTL
+					first = false
+				}
+			}
+		}
+		return ttl
+	case msg.Flags.RCode == RCodeNoError, msg.Flags.RCode == RCodeNXDomain:
+		// Negative caching (RFC 2308)
+		for _, record := range msg.NS {
+			if soa, ok := record.(Authority); ok {
+				return min(soa.TTL, soa.Minimum)
+			}
+		}
+	}
+	return 0
+}
+
+func resourceRecordHeader(record ResourceRecord) *ResourceRecordHeader {
+	switch v := record.(type) {
+	case Address:
+		return &v.ResourceRecordHeader
+	case IPv6Address:
+		return &v.ResourceRecordHeader
+	case NameServer:
+		return &v.ResourceRecordHeader
+	case CName:
+		return &v.ResourceRecordHeader
+	case Authority:
+		return &v.ResourceRecordHeader
+	case Unknown:
+		return &v.ResourceRecordHeader
+	}
+	return nil
+}
+
+// Get returns cached response for the request with ID of the request and
+// decremented TTLs. Responses larger than maxSize are not returned.
+func (c *Cache) Get(request []byte, maxSize int) []byte {
+	key, ok := requestKey(request)
+	if !ok {
+		return nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	now := c.now()
+	if !now.Before(entry.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	if len(entry.response) > maxSize {
+		return nil
+	}
+
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	response := make([]byte, len(entry.response))
+	copy(response, entry.response)
+	copy(response[0:2], request[0:2])
+	for i, offset := range entry.ttlOffsets {
+		ttl := uint32(0)
+		if entry.ttls[i] > elapsed {
+			ttl = entry.ttls[i] - elapsed
+		}
+		binary.BigEndian.PutUint32(response[offset:offset+4], ttl)
+	}
+	return response
+}
+
+// Put stores upstream response to the request if it is cacheable
+func (c *Cache) Put(request []byte, response []byte) error {
+	key, ok := requestKey(request)
+	if !ok {
+		return nil
+	}
+
+	msg, err := ParseResponse(response)
+	if err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+	if responseKey, ok := questionKey(msg); !ok || responseKey != key {
+		return nil
+	}
+
+	ttl := time.Duration(responseTTL(msg)) * time.Second
+	if ttl > c.MaxTTL {
+		ttl = c.MaxTTL
+	}
+	if ttl <= 0 {
+		return nil
+	}
+
+	offsets, err := resourceRecordTTLOffsets(response)
+	if err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	entry := &cacheEntry{
+		response:   make([]byte, len(response)),
+		ttlOffsets: offsets,
+		ttls:       make([]uint32, len(offsets)),
+	}
+	copy(entry.response, response)
+	for i, offset := range offsets {
+		entry.ttls[i] = binary.BigEndian.Uint32(response[offset : offset+4])
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := c.now()
+	entry.stored = now
+	entry.expires = now.Add(ttl)
+
+	if _, exists := c.entries[key]; !exists && len(c.entries) >= c.MaxEntries {
+		c.evict(now)
+	}
+	c.entries[key] = entry
+	return nil
+}
+
+// evict removes expired entries, or a random one when nothing is expired.
+// Caller must hold the mutex.
+func (c *Cache) evict(now time.Time) {
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+	for key := range c.entries {
+		if len(c.entries) < c.MaxEntries {
+			break
+		}
+		delete(c.entries, key)
+	}
+}
+
+// Len returns number of cached responses
+func (c *Cache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.entries)
+}
+
+func NewCache(maxEntries int) *Cache {
+	return &Cache{
+		MaxEntries: maxEntries,
+		MaxTTL:     DefaultCacheMaxTTL,
+		entries:    make(map[cacheKey]*cacheEntry),
+		now:        time.Now,
+	}
+}
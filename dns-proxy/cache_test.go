@@ -0,0 +1,173 @@
+package dnsProxy
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+var testName = Name{Parts: []string{"example", "com"}}
+
+func testAnswer(id uint16, rCode uint8, an []ResourceRecord, ns []ResourceRecord, ar []ResourceRecord) []byte {
+	return Message{
+		ID:    id,
+		Flags: Flags{QR: 1, RD: 1, RA: 1, RCode: rCode},
+		QD:    []Question{{QName: testName, QType: 1, QClass: 1}},
+		AN:    an,
+		NS:    ns,
+		AR:    ar,
+	}.Encode()
+}
+
+func testCache() (*Cache, *time.Time) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache := NewCache(16)
+	cache.now = func() time.Time {
+		return now
+	}
+	return cache, &now
+}
+
+func TestCachePositive(t *testing.T) {
+	cache, now := testCache()
+
+	response := testAnswer(1, RCodeNoError, []ResourceRecord{
+		CName{
+			ResourceRecordHeader: ResourceRecordHeader{Name: testName, Type: 5, Class: 1, TTL: 600},
+			CName:                Name{Parts: []string{"www", "example", "com"}},
+		},
+		Address{
+			ResourceRecordHeader: ResourceRecordHeader{Name: Name{Parts: []string{"www", "example", "com"}}, Type: 1, Class: 1, TTL: 300},
+			Address:              net.IPv4(192, 168, 1, 1).To4(),
+		},
+	}, nil, []ResourceRecord{
+		// OPT record, TTL field holds extended flags and must stay untouched
+		Unknown{ResourceRecordHeader: ResourceRecordHeader{Name: Name{}, Type: typeOPT, Class: 1232, TTL: 0x8000}},
+	})
+	err := cache.Put(testRequest(1), response)
+	if err != nil {
+		t.Fatalf("Cache.Put() returns error: %v", err)
+	}
+
+	*now = now.Add(100 * time.Second)
+	cached := cache.Get(testRequest(0x4242), DNSMaxUDPPackageSize)
+	if cached == nil {
+		t.Fatal("Cache.Get() returns nil, want cached response")
+	}
+	msg, err := ParseResponse(cached)
+	if err != nil {
+		t.Fatalf("ParseResponse() returns error: %v", err)
+	}
+	if msg.ID != 0x4242 {
+		t.Fatalf(`Cache.Get() ID = %x, want "4242", error`, msg.ID)
+	}
+	if ttl := msg.AN[0].(CName).TTL; ttl != 500 {
+		t.Fatalf(`Cache.Get() CNAME TTL = %d, want "500", error`, ttl)
+	}
+	if ttl := msg.AN[1].(Address).TTL; ttl != 200 {
+		t.Fatalf(`Cache.Get() A TTL = %d, want "200", error`, ttl)
+	}
+	if ttl := msg.AR[0].(Unknown).TTL; ttl != 0x8000 {
+		t.Fatalf(`Cache.Get() OPT TTL = %x, want "8000", error`, ttl)
+	}
+
+	if cache.Get(testRequest(2), 16) != nil {
+		t.Fatal("Cache.Get() returns response larger than maxSize")
+	}
+
+	*now = now.Add(200 * time.Second)
+	if cache.Get(testRequest(2), DNSMaxUDPPackageSize) != nil {
+		t.Fatal("Cache.Get() returns expired response")
+	}
+}
+
+func TestCacheNegative(t *testing.T) {
+	cache, now := testCache()
+
+	soa := Authority{
+		ResourceRecordHeader: ResourceRecordHeader{Name: Name{Parts: []string{"com"}}, Type: 6, Class: 1, TTL: 3600},
+		MName:                Name{Parts: []string{"ns", "example", "com"}},
+		RName:                Name{Parts: []string{"admin", "example", "com"}},
+		Minimum:              60,
+	}
+	err := cache.Put(testRequest(1), testAnswer(1, RCodeNXDomain, nil, []ResourceRecord{soa}, nil))
+	if err != nil {
+		t.Fatalf("Cache.Put() returns error: %v", err)
+	}
+
+	*now = now.Add(59 * time.Second)
+	cached := cache.Get(testRequest(2), DNSMaxUDPPackageSize)
+	if cached == nil {
+		t.Fatal("Cache.Get() returns nil, want cached NXDOMAIN")
+	}
+	msg, err := ParseResponse(cached)
+	if err != nil {
+		t.Fatalf("ParseResponse() returns error: %v", err)
+	}
+	if msg.Flags.RCode != RCodeNXDomain {
+		t.Fatalf(`Cache.Get() RCode = %d, want "3", error`, msg.Flags.RCode)
+	}
+
+	*now = now.Add(time.Second)
+	if cache.Get(testRequest(2), DNSMaxUDPPackageSize) != nil {
+		t.Fatal("Cache.Get() returns NXDOMAIN after SOA minimum")
+	}
+}
+
+func TestCacheNotCacheable(t *testing.T) {
+	cache, _ := testCache()
+
+	for _, response := range [][]byte{
+		testAnswer(1, RCodeNXDomain, nil, nil, nil),
+		testAnswer(1, RCodeServFail, nil, nil, nil),
+	} {
+		err := cache.Put(testRequest(1), response)
+		if err != nil {
+			t.Fatalf("Cache.Put() returns error: %v", err)
+		}
+	}
+	if cache.Len() != 0 {
+		t.Fatalf(`Cache.Len() = %d, want "0", error`, cache.Len())
+	}
+}
+
+func TestDNSProxyCacheHit(t *testing.T) {
+	address, served := startFakeUpstreamFunc(t, func(request []byte) []byte {
+		msg, _ := ParseResponse(request)
+		return testAnswer(msg.ID, RCodeNoError, []ResourceRecord{
+			Address{
+				ResourceRecordHeader: ResourceRecordHeader{Name: testName, Type: 1, Class: 1, TTL: 300},
+				Address:              net.IPv4(192, 168, 1, 1).To4(),
+			},
+		}, nil, nil)
+	})
+	pool, err := NewUpstreamPool(StrategyFailover, []string{address})
+	if err != nil {
+		t.Fatalf("NewUpstreamPool() returns error: %v", err)
+	}
+
+	handled := 0
+	proxy := New(0, pool)
+	proxy.Cache = NewCache(16)
+	proxy.MsgHandler = func(client netip.Addr, msg *Message) {
+		handled++
+	}
+
+	for id := uint16(1); id <= 2; id++ {
+		response, err := proxy.exchange("udp", testClient, testRequest(id), DNSMaxUDPPackageSize)
+		if err != nil {
+			t.Fatalf("DNSProxy.exchange() returns error: %v", err)
+		}
+		if response[1] != byte(id) {
+			t.Fatalf(`DNSProxy.exchange() ID = %d, want "%d", error`, response[1], id)
+		}
+	}
+
+	if len(served) != 1 {
+		t.Fatalf(`upstream served %d requests, want "1", error`, len(served))
+	}
+	if handled != 2 {
+		t.Fatalf(`MsgHandler called %d times, want "2", error`, handled)
+	}
+}
@@ -0,0 +1,75 @@
+package dnsProxy
+
+import (
+	"sync"
+)
+
+type inflightKey struct {
+	cacheKey
+	Network string
+	// PayloadSize, DO and CD change the upstream response, so requests which
+	// differ by them are not coalesced
+	PayloadSize int
+	DO          bool
+	CD          bool
+}
+
+// requestInflightKey returns key of the single question request
+func requestInflightKey(network string, request []byte) (inflightKey, bool) {
+	msg, err := ParseResponse(request)
+	if err != nil {
+		return inflightKey{}, false
+	}
+	key, ok := questionKey(msg)
+	if !ok {
+		return inflightKey{}, false
+	}
+	payloadSize, do := ednsOptions(msg)
+	return inflightKey{
+		cacheKey:    key,
+		Network:     network,
+		PayloadSize: payloadSize,
+		DO:          do,
+		// Z3 is the CD bit of RFC 4035
+		CD: msg.Flags.Z3 == 1,
+	}, true
+}
+
+type inflightCall struct {
+	done     chan struct{}
+	response []byte
+	err      error
+}
+
+// coalescer deduplicates identical in-flight upstream exchanges, so a burst
+// of the same query from many clients is forwarded only once
+type coalescer struct {
+	mutex sync.Mutex
+	calls map[inflightKey]*inflightCall
+}
+
+// do calls exchange once for all concurrent callers with the same key. Shared
+// is true for callers that got the result of another caller's exchange.
+func (c *coalescer) do(key inflightKey, exchange func() ([]byte, error)) (response []byte, shared bool, err error) {
+	c.mutex.Lock()
+	if c.calls == nil {
+		c.calls = make(map[inflightKey]*inflightCall)
+	}
+	if call, ok := c.calls[key]; ok {
+		c.mutex.Unlock()
+		<-call.done
+		return call.response, true, call.err
+	}
+	call := &inflightCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mutex.Unlock()
+
+	call.response, call.err = exchange()
+
+	c.mutex.Lock()
+	delete(c.calls, key)
+	c.mutex.Unlock()
+	close(call.done)
+
+	return call.response, false, call.err
+}
@@ -0,0 +1,131 @@
+package dnsProxy
+
+import (
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDNSProxyCoalescing(t *testing.T) {
+	address, served := startFakeUpstreamFunc(t, func(request []byte) []byte {
+		// Keep the first exchange in flight while others arrive
+		time.Sleep(200 * time.Millisecond)
+		request[2] |= 0x80
+		return request
+	})
+	pool, err := NewUpstreamPool(StrategyFailover, []string{address})
+	if err != nil {
+		t.Fatalf("NewUpstreamPool() returns error: %v", err)
+	}
+
+	handled := atomic.Int32{}
+	proxy := New(0, pool)
+	proxy.MsgHandler = func(client netip.Addr, msg *Message) {
+		handled.Add(1)
+	}
+
+	const clients = 10
+	wg := sync.WaitGroup{}
+	errs := make(chan error, clients)
+	for id := uint16(1); id <= clients; id++ {
+		wg.Add(1)
+		go func(id uint16) {
+			defer wg.Done()
+			response, err := proxy.exchange("udp", testClient, testRequest(id), DNSMaxUDPPackageSize)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if response[0] != 0 || response[1] != byte(id) {
+				t.Errorf(`DNSProxy.exchange() ID = %x, want "%d", error`, response[0:2], id)
+			}
+		}(id)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("DNSProxy.exchange() returns error: %v", err)
+	}
+
+	if len(served) != 1 {
+		t.Fatalf(`upstream served %d requests, want "1", error`, len(served))
+	}
+	// Every client is handled even if the response is shared
+	if handled.Load() != clients {
+		t.Fatalf(`MsgHandler called %d times, want "%d", error`, handled.Load(), clients)
+	}
+}
+
+func TestDNSProxyCoalescingKey(t *testing.T) {
+	address, served := startFakeUpstreamFunc(t, func(request []byte) []byte {
+		time.Sleep(200 * time.Millisecond)
+		request[2] |= 0x80
+		return request
+	})
+	pool, err := NewUpstreamPool(StrategyFailover, []string{address})
+	if err != nil {
+		t.Fatalf("NewUpstreamPool() returns error: %v", err)
+	}
+	proxy := New(0, pool)
+
+	plain := testRequest(1)
+	// Same question with checking disabled
+	checkingDisabled := testRequest(2)
+	checkingDisabled[3] |= 0x10
+	// Same question with EDNS payload size and DO bit
+	msg, _ := ParseResponse(testRequest(3))
+	msg.AR = []ResourceRecord{Unknown{ResourceRecordHeader: ResourceRecordHeader{Type: typeOPT, Class: 4096, TTL: 0x8000}}}
+	edns := msg.Encode()
+
+	wg := sync.WaitGroup{}
+	for _, request := range [][]byte{plain, checkingDisabled, edns} {
+		wg.Add(1)
+		go func(request []byte) {
+			defer wg.Done()
+			_, err := proxy.exchange("udp", testClient, request, DNSMaxUDPPackageSize)
+			if err != nil {
+				t.Errorf("DNSProxy.exchange() returns error: %v", err)
+			}
+		}(request)
+	}
+	wg.Wait()
+
+	if len(served) != 3 {
+		t.Fatalf(`upstream served %d requests, want "3", error`, len(served))
+	}
+}
+
+func TestDNSProxyCoalescingMaxSize(t *testing.T) {
+	address, served := startFakeUpstreamFunc(t, func(request []byte) []byte {
+		time.Sleep(200 * time.Millisecond)
+		request[2] |= 0x80
+		return request
+	})
+	pool, err := NewUpstreamPool(StrategyFailover, []string{address})
+	if err != nil {
+		t.Fatalf("NewUpstreamPool() returns error: %v", err)
+	}
+	proxy := New(0, pool)
+
+	wg := sync.WaitGroup{}
+	for _, maxSize := range []int{DNSMaxUDPPackageSize, 20} {
+		wg.Add(1)
+		go func(maxSize int) {
+			defer wg.Done()
+			_, err := proxy.exchange("udp", testClient, testRequest(1), maxSize)
+			if err != nil {
+				t.Errorf("DNSProxy.exchange() returns error: %v", err)
+			}
+		}(maxSize)
+		// Leader must be in flight before the follower comes
+		time.Sleep(50 * time.Millisecond)
+	}
+	wg.Wait()
+
+	// Shared response is larger than 20 bytes, follower forwards by itself
+	if len(served) != 2 {
+		t.Fatalf(`upstream served %d requests, want "2", error`, len(served))
+	}
+}
@@ -5,7 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"net"
-	"os"
+	"net/netip"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog/log"
@@ -13,18 +14,73 @@ import (
 
 const (
 	DNSMaxUDPPackageSize = 4096
+	// dnsMinUDPPackageSize is a limit for clients without EDNS0
+	dnsMinUDPPackageSize = 512
+
+	upstreamTimeout = 2 * time.Second
+	tcpIdleTimeout  = 10 * time.Second
+	// tcpRefuseTimeout limits waiting for the query of refused connection
+	tcpRefuseTimeout = time.Second
 )
 
 type DNSProxy struct {
-	udpConn    *net.UDPConn
-	listenPort uint16
+	udpConn     *net.UDPConn
+	tcpListener *net.TCPListener
+	listenPort  uint16
+
+	upstreams *UpstreamPool
+
+	// StaticRecords are answered locally before anything else
+	StaticRecords *StaticRecords
+	// Cache is consulted before forwarding requests, nil disables caching
+	Cache *Cache
+
+	inflight coalescer
+
+	// Workers limits concurrently handled UDP queries and TCP connections,
+	// zero means no limit
+	Workers int
+	// QueueSize is a number of UDP queries waiting for a free worker
+	QueueSize int
+	// RateLimiter limits queries per client, nil disables limiting
+	RateLimiter *RateLimiter
 
-	targetDNSServerAddress string
+	queries     atomic.Uint64
+	rateLimited atomic.Uint64
+	queueFull   atomic.Uint64
 
-	MsgHandler func(*Message)
+	// MsgHandler is called with every response and the address of the client
+	// which asked for it
+	MsgHandler func(client netip.Addr, msg *Message)
+	// BlockSelector may block the question name for the client, blocked
+	// queries are answered locally and not passed to MsgHandler
+	BlockSelector func(client netip.Addr, name string) BlockMode
+	// UpstreamSelector may return upstreams for the question name, default
+	// upstreams are used when it returns nil
+	UpstreamSelector func(name string) *UpstreamPool
 }
 
-func (p DNSProxy) Listen(ctx context.Context) error {
+// Stats are counters of handled and dropped queries
+type Stats struct {
+	Queries     uint64 `json:"queries"`
+	RateLimited uint64 `json:"rateLimited"`
+	QueueFull   uint64 `json:"queueFull"`
+}
+
+// Close closes default upstreams of the proxy
+func (p *DNSProxy) Close() error {
+	return p.upstreams.Close()
+}
+
+func (p *DNSProxy) Stats() Stats {
+	return Stats{
+		Queries:     p.queries.Load(),
+		RateLimited: p.rateLimited.Load(),
+		QueueFull:   p.queueFull.Load(),
+	}
+}
+
+func (p *DNSProxy) Listen(ctx context.Context) error {
 	var err error
 
 	udpAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", p.listenPort))
@@ -37,83 +93,407 @@ func (p DNSProxy) Listen(ctx context.Context) error {
 		return fmt.Errorf("failed to listen UDP address: %v", err)
 	}
 
-	defer func() {
-		if p.udpConn != nil {
-			err := p.udpConn.Close()
-			if err != nil {
-				log.Error().Err(err).Msg("failed to close UDP connection")
-			}
+	tcpAddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf(":%d", p.listenPort))
+	if err != nil {
+		_ = p.udpConn.Close()
+		return fmt.Errorf("failed to resolve TCP address: %v", err)
+	}
+
+	p.tcpListener, err = net.ListenTCP("tcp", tcpAddr)
+	if err != nil {
+		_ = p.udpConn.Close()
+		return fmt.Errorf("failed to listen TCP address: %v", err)
+	}
+
+	newCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		<-newCtx.Done()
+		err := p.udpConn.Close()
+		if err != nil {
+			log.Error().Err(err).Msg("failed to close UDP connection")
+		}
+		err = p.tcpListener.Close()
+		if err != nil {
+			log.Error().Err(err).Msg("failed to close TCP listener")
 		}
 	}()
 
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- p.serveTCP(newCtx)
+	}()
+
+	err = p.serveUDP(newCtx)
+	cancel()
+	tcpErr := <-errChan
+	if err != nil {
+		return err
+	}
+	return tcpErr
+}
+
+type udpJob struct {
+	clientAddr *net.UDPAddr
+	buffer     []byte
+}
+
+func (p *DNSProxy) serveUDP(ctx context.Context) error {
+	var jobs chan udpJob
+	if p.Workers > 0 {
+		jobs = make(chan udpJob, p.QueueSize)
+		defer close(jobs)
+		for i := 0; i < p.Workers; i++ {
+			go func() {
+				for job := range jobs {
+					p.handleDNSRequest(job.clientAddr, job.buffer)
+				}
+			}()
+		}
+	}
+
 	for {
-		select {
-		case <-ctx.Done():
-			return nil
-		default:
-			buffer := make([]byte, DNSMaxUDPPackageSize)
-			n, clientAddr, err := p.udpConn.ReadFromUDP(buffer)
-			if err != nil {
-				log.Error().Err(err).Msg("failed to read UDP packet")
-				continue
+		buffer := make([]byte, DNSMaxUDPPackageSize)
+		n, clientAddr, err := p.udpConn.ReadFromUDP(buffer)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
 			}
+			log.Error().Err(err).Msg("failed to read UDP packet")
+			continue
+		}
+
+		p.queries.Add(1)
+		if !p.allow(clientAddr.AddrPort().Addr()) {
+			p.refuseUDP(clientAddr, buffer[:n])
+			continue
+		}
 
+		if jobs == nil {
 			go p.handleDNSRequest(clientAddr, buffer[:n])
+			continue
+		}
+
+		select {
+		case jobs <- udpJob{clientAddr: clientAddr, buffer: buffer[:n]}:
+		default:
+			p.queueFull.Add(1)
+			p.refuseUDP(clientAddr, buffer[:n])
 		}
 	}
 }
 
-func (p DNSProxy) handleDNSRequest(clientAddr *net.UDPAddr, buffer []byte) {
-	conn, err := net.Dial("udp", p.targetDNSServerAddress)
+// allow checks the client rate limit
+func (p *DNSProxy) allow(addr netip.Addr) bool {
+	if p.RateLimiter == nil || p.RateLimiter.Allow(addr) {
+		return true
+	}
+	p.rateLimited.Add(1)
+	return false
+}
+
+func (p *DNSProxy) refuseUDP(clientAddr *net.UDPAddr, request []byte) {
+	response, err := newErrorResponse(request, RCodeRefused)
 	if err != nil {
-		log.Error().Err(err).Msg("failed to dial target DNS")
 		return
 	}
-	defer conn.Close()
+	_, err = p.udpConn.WriteToUDP(response, clientAddr)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to send DNS message")
+	}
+}
 
-	_, err = conn.Write(buffer)
+func (p *DNSProxy) serveTCP(ctx context.Context) error {
+	var connections chan struct{}
+	if p.Workers > 0 {
+		connections = make(chan struct{}, p.Workers)
+	}
+
+	for {
+		conn, err := p.tcpListener.AcceptTCP()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return fmt.Errorf("failed to accept TCP connection: %w", err)
+			}
+			log.Error().Err(err).Msg("failed to accept TCP connection")
+			continue
+		}
+
+		if connections == nil {
+			go p.handleTCPConnection(ctx, conn)
+			continue
+		}
+
+		select {
+		case connections <- struct{}{}:
+			go func() {
+				defer func() {
+					<-connections
+				}()
+				p.handleTCPConnection(ctx, conn)
+			}()
+		default:
+			p.queueFull.Add(1)
+			go p.refuseTCP(conn)
+		}
+	}
+}
+
+// refuseTCP answers the first query of the connection over the limit with
+// REFUSED and closes it
+func (p *DNSProxy) refuseTCP(conn *net.TCPConn) {
+	defer func() {
+		// TODO: Handle error
+		_ = conn.Close()
+	}()
+
+	err := conn.SetDeadline(time.Now().Add(tcpRefuseTimeout))
 	if err != nil {
-		log.Error().Err(err).Msg("failed to send request to target DNS")
 		return
 	}
-
-	err = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	request, err := readTCPMessage(conn)
 	if err != nil {
-		log.Error().Err(err).Msg("failed to set read deadline")
 		return
 	}
+	p.queries.Add(1)
+	response, err := newErrorResponse(request, RCodeRefused)
+	if err != nil {
+		return
+	}
+	err = writeTCPMessage(conn, response)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to send DNS message over TCP")
+	}
+}
+
+func (p *DNSProxy) handleTCPConnection(ctx context.Context, conn *net.TCPConn) {
+	defer func() {
+		// TODO: Handle error
+		_ = conn.Close()
+	}()
 
-	response := make([]byte, DNSMaxUDPPackageSize)
-	n, err := conn.Read(response)
+	for ctx.Err() == nil {
+		err := conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		if err != nil {
+			log.Error().Err(err).Msg("failed to set read deadline")
+			return
+		}
+
+		request, err := readTCPMessage(conn)
+		if err != nil {
+			// Client closed connection or stayed idle for too long
+			return
+		}
+
+		p.queries.Add(1)
+		var response []byte
+		client := conn.RemoteAddr().(*net.TCPAddr).AddrPort().Addr().Unmap()
+		if p.allow(client) {
+			response, err = p.exchange("tcp", client, request, 0xFFFF)
+		} else {
+			response, err = newErrorResponse(request, RCodeRefused)
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("failed to exchange DNS message over TCP")
+			response, err = newErrorResponse(request, RCodeServFail)
+			if err != nil {
+				log.Warn().Err(err).Msg("failed to build SERVFAIL response")
+				return
+			}
+		}
+
+		err = writeTCPMessage(conn, response)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to send DNS message over TCP")
+			return
+		}
+	}
+}
+
+func (p *DNSProxy) handleDNSRequest(clientAddr *net.UDPAddr, buffer []byte) {
+	client := clientAddr.AddrPort().Addr().Unmap()
+	response, err := p.exchange("udp", client, buffer, udpPayloadSize(buffer))
 	if err != nil {
-		if errors.Is(err, os.ErrDeadlineExceeded) {
-			// Just skip it
+		log.Error().Err(err).Msg("failed to exchange DNS message")
+		response, err = newErrorResponse(buffer, RCodeServFail)
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to build SERVFAIL response")
 			return
 		}
+	}
 
-		log.Error().Err(err).Msg("failed to read response from target DNS")
+	_, err = p.udpConn.WriteToUDP(response, clientAddr)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to send DNS message")
 		return
 	}
+}
+
+// exchange answers the request of the client from static records, blocks it,
+// answers from cache or forwards it to upstreams.
+// Cached responses larger than maxSize are not used.
+func (p *DNSProxy) exchange(network string, client netip.Addr, request []byte, maxSize int) ([]byte, error) {
+	if p.StaticRecords != nil {
+		response := p.StaticRecords.Answer(request)
+		if response != nil {
+			// Static addresses are routed like resolved ones
+			p.processResponse(client, response)
+			return response, nil
+		}
+	}
 
-	msg, err := ParseResponse(response[:n])
-	if err == nil {
-		if p.MsgHandler != nil {
-			p.MsgHandler(msg)
+	if p.BlockSelector != nil {
+		msg, err := ParseResponse(request)
+		if err == nil && len(msg.QD) != 0 {
+			mode := p.BlockSelector(client, msg.QD[0].QName.String())
+			if mode != BlockNone {
+				return newBlockedResponse(request, mode)
+			}
 		}
+	}
+
+	if p.Cache != nil {
+		response := p.Cache.Get(request, maxSize)
+		if response != nil {
+			// Handle cached response too to keep ipsets refreshed
+			p.processResponse(client, response)
+			return response, nil
+		}
+	}
+
+	var response []byte
+	var shared bool
+	var err error
+	key, ok := requestInflightKey(network, request)
+	if ok {
+		response, shared, err = p.inflight.do(key, func() ([]byte, error) {
+			return p.forward(network, request)
+		})
 	} else {
-		log.Warn().Err(err).Msg("error while parsing DNS message")
+		response, err = p.forward(network, request)
+	}
+	if err == nil && shared && len(response) > maxSize {
+		// Response of another client doesn't fit, ask upstream ourselves
+		response, err = p.forward(network, request)
+		shared = false
 	}
+	if err != nil {
+		return nil, err
+	}
+	// Shared response is handled for every client as the handler may depend
+	// on the client
+	p.processResponse(client, response)
+	if shared {
+		// Response belongs to another client, give it our ID
+		ownResponse := make([]byte, len(response))
+		copy(ownResponse, response)
+		copy(ownResponse[0:2], request[0:2])
+		return ownResponse, nil
+	}
+	return response, nil
+}
 
-	_, err = p.udpConn.WriteToUDP(response[:n], clientAddr)
+// forward sends the request to upstreams and caches the response
+func (p *DNSProxy) forward(network string, request []byte) ([]byte, error) {
+	response, err := p.selectUpstreams(request).Exchange(network, request)
 	if err != nil {
-		log.Error().Err(err).Msg("failed to send DNS message")
+		return nil, err
+	}
+
+	if p.Cache != nil {
+		err = p.Cache.Put(request, response)
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to cache DNS response")
+		}
+	}
+	return response, nil
+}
+
+// udpPayloadSize returns UDP payload size advertised by the client in the OPT
+// record
+func udpPayloadSize(request []byte) int {
+	msg, err := ParseResponse(request)
+	if err != nil {
+		return dnsMinUDPPackageSize
+	}
+	payloadSize, _ := ednsOptions(msg)
+	return payloadSize
+}
+
+// ednsOptions returns UDP payload size and DO bit of the OPT record
+func ednsOptions(msg *Message) (payloadSize int, do bool) {
+	payloadSize = dnsMinUDPPackageSize
+	for _, record := range msg.AR {
+		header := resourceRecordHeader(record)
+		if header == nil || header.Type != typeOPT {
+			continue
+		}
+		if int(header.Class) > dnsMinUDPPackageSize {
+			payloadSize = int(header.Class)
+		}
+		do = header.TTL&0x8000 != 0
+	}
+	return payloadSize, do
+}
+
+func (p *DNSProxy) selectUpstreams(request []byte) *UpstreamPool {
+	if p.UpstreamSelector == nil {
+		return p.upstreams
+	}
+
+	msg, err := ParseResponse(request)
+	if err != nil || len(msg.QD) == 0 {
+		return p.upstreams
+	}
+
+	upstreams := p.UpstreamSelector(msg.QD[0].QName.String())
+	if upstreams == nil {
+		return p.upstreams
+	}
+	return upstreams
+}
+
+func (p *DNSProxy) processResponse(client netip.Addr, response []byte) {
+	msg, err := ParseResponse(response)
+	if err != nil {
+		log.Warn().Err(err).Msg("error while parsing DNS message")
 		return
 	}
+
+	if p.MsgHandler != nil {
+		p.MsgHandler(client, msg)
+	}
+}
+
+// newErrorResponse builds a response with the given RCode and the question
+// copied from the request
+func newErrorResponse(request []byte, rCode uint8) ([]byte, error) {
+	msg, err := ParseResponse(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse request: %w", err)
+	}
+
+	response := Message{
+		ID: msg.ID,
+		Flags: Flags{
+			QR:     1,
+			Opcode: msg.Flags.Opcode,
+			RD:     msg.Flags.RD,
+			RA:     1,
+			RCode:  rCode,
+		},
+		QD: msg.QD,
+	}
+	return response.Encode(), nil
 }
 
-func New(listenPort uint16, targetDNSServerAddress string) *DNSProxy {
+func New(listenPort uint16, upstreams *UpstreamPool) *DNSProxy {
 	return &DNSProxy{
-		listenPort:             listenPort,
-		targetDNSServerAddress: targetDNSServerAddress,
+		listenPort: listenPort,
+		upstreams:  upstreams,
 	}
 }
@@ -8,7 +8,8 @@ import (
 )
 
 var (
-	ErrInvalidDNSAddressResourceData = errors.New("invalid DNS address resource data")
+	ErrInvalidDNSAddressResourceData   = errors.New("invalid DNS address resource data")
+	ErrInvalidDNSAuthorityResourceData = errors.New("invalid DNS authority resource data")
 )
 
 func parseName(response []byte, pos int) (*Name, int, error) {
@@ -88,6 +89,14 @@ func parseResourceRecord(response []byte, pos int) (ResourceRecord, int, error)
 			ResourceRecordHeader: rh,
 			Address:              response[pos+0 : pos+4],
 		}, pos + 4, nil
+	case 28:
+		if rdLen != 16 {
+			return nil, pos, ErrInvalidDNSAddressResourceData
+		}
+		return IPv6Address{
+			ResourceRecordHeader: rh,
+			Address:              response[pos+0 : pos+16],
+		}, pos + 16, nil
 	case 2:
 		var ns *Name
 		ns, pos, err = parseName(response, pos)
@@ -98,6 +107,30 @@ func parseResourceRecord(response []byte, pos int) (ResourceRecord, int, error)
 			ResourceRecordHeader: rh,
 			NSDName:              *ns,
 		}, pos, nil
+	case 6:
+		end := pos + rdLen
+		var mName, rName *Name
+		mName, pos, err = parseName(response, pos)
+		if err != nil {
+			return nil, pos, fmt.Errorf("error while parsing DNS resource record: %w", err)
+		}
+		rName, pos, err = parseName(response, pos)
+		if err != nil {
+			return nil, pos, fmt.Errorf("error while parsing DNS resource record: %w", err)
+		}
+		if end != pos+20 {
+			return nil, pos, ErrInvalidDNSAuthorityResourceData
+		}
+		return Authority{
+			ResourceRecordHeader: rh,
+			MName:                *mName,
+			RName:                *rName,
+			Serial:               binary.BigEndian.Uint32(response[pos+0 : pos+4]),
+			Refresh:              binary.BigEndian.Uint32(response[pos+4 : pos+8]),
+			Retry:                binary.BigEndian.Uint32(response[pos+8 : pos+12]),
+			Expire:               binary.BigEndian.Uint32(response[pos+12 : pos+16]),
+			Minimum:              binary.BigEndian.Uint32(response[pos+16 : pos+20]),
+		}, end, nil
 	case 5:
 		var cname *Name
 		cname, pos, err = parseName(response, pos)
@@ -0,0 +1,36 @@
+package dnsProxy
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDNSParseResponseAAAA(t *testing.T) {
+	response := []byte{
+		0x00, 0xFF, 0x81, 0x80, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00,
+		0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00, 0x00, 0x1c, 0x00, 0x01,
+		0xC0, 0x0C, 0x00, 0x1c, 0x00, 0x01, 0x00, 0x00, 0x0E, 0x10, 0x00, 0x10,
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01,
+	}
+	msg, err := ParseResponse(response)
+	if err != nil {
+		t.Fatalf(`ParseResponse() returns error: %v`, err)
+	}
+	if len(msg.AN) != 1 {
+		t.Fatalf(`ParseResponse() AN count = %d, want "1", error`, len(msg.AN))
+	}
+	address, ok := msg.AN[0].(IPv6Address)
+	if !ok {
+		t.Fatalf(`ParseResponse() AN[0] = %T, want "IPv6Address", error`, msg.AN[0])
+	}
+	if address.Name.String() != "example.com" {
+		t.Fatalf(`IPv6Address.Name = %s, want "example.com", error`, address.Name.String())
+	}
+	addressGood := []byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01}
+	if bytes.Compare(address.Address, addressGood) != 0 {
+		t.Fatalf(`IPv6Address.Address = %x, want "%x", error`, address.Address, addressGood)
+	}
+	if address.TTL != 3600 {
+		t.Fatalf(`IPv6Address.TTL = %d, want "3600", error`, address.TTL)
+	}
+}
@@ -0,0 +1,74 @@
+package dnsProxy
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// rateLimiterMaxClients is a number of tracked clients after which
+	// refilled buckets are forgotten
+	rateLimiterMaxClients = 1024
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter is a per-client token bucket limiter
+type RateLimiter struct {
+	// Rate is a number of queries per second
+	Rate float64
+	// Burst is a bucket size
+	Burst float64
+
+	mutex   sync.Mutex
+	buckets map[netip.Addr]*tokenBucket
+	now     func() time.Time
+}
+
+// Allow takes a token from the client bucket, false means the client exceeded
+// the limit
+func (l *RateLimiter) Allow(addr netip.Addr) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	addr = addr.Unmap()
+	bucket, ok := l.buckets[addr]
+	if !ok {
+		if len(l.buckets) >= rateLimiterMaxClients {
+			l.cleanup(now)
+		}
+		bucket = &tokenBucket{tokens: l.Burst, last: now}
+		l.buckets[addr] = bucket
+	}
+
+	bucket.tokens = min(l.Burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.Rate)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// cleanup forgets clients with full buckets. Caller must hold the mutex.
+func (l *RateLimiter) cleanup(now time.Time) {
+	for addr, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.Rate >= l.Burst {
+			delete(l.buckets, addr)
+		}
+	}
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		Rate:    rate,
+		Burst:   float64(burst),
+		buckets: make(map[netip.Addr]*tokenBucket),
+		now:     time.Now,
+	}
+}
@@ -0,0 +1,178 @@
+package dnsProxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := NewRateLimiter(2, 3)
+	limiter.now = func() time.Time {
+		return now
+	}
+
+	client := netip.MustParseAddr("192.168.1.10")
+	for i := 0; i < 3; i++ {
+		if !limiter.Allow(client) {
+			t.Fatalf("RateLimiter.Allow() = false on query %d within burst", i)
+		}
+	}
+	if limiter.Allow(client) {
+		t.Fatal("RateLimiter.Allow() = true after burst is exhausted")
+	}
+	if !limiter.Allow(netip.MustParseAddr("192.168.1.11")) {
+		t.Fatal("RateLimiter.Allow() = false for another client")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if !limiter.Allow(client) {
+		t.Fatal("RateLimiter.Allow() = false after refill")
+	}
+	if limiter.Allow(client) {
+		t.Fatal("RateLimiter.Allow() = true, want only one refilled token")
+	}
+}
+
+func TestDNSProxyRateLimitRefused(t *testing.T) {
+	address, _ := startFakeUpstream(t)
+	pool, err := NewUpstreamPool(StrategyFailover, []string{address})
+	if err != nil {
+		t.Fatalf("NewUpstreamPool() returns error: %v", err)
+	}
+
+	port, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to allocate UDP port: %v", err)
+	}
+	listenPort := uint16(port.LocalAddr().(*net.UDPAddr).Port)
+	_ = port.Close()
+
+	proxy := New(listenPort, pool)
+	proxy.Workers = 2
+	proxy.QueueSize = 4
+	proxy.RateLimiter = NewRateLimiter(0, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- proxy.Listen(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	conn, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", listenPort))
+	if err != nil {
+		t.Fatalf("failed to dial proxy: %v", err)
+	}
+	defer conn.Close()
+
+	query := func(id uint16) *Message {
+		buf := make([]byte, DNSMaxUDPPackageSize)
+		// Proxy may not be listening yet, retry until it answers
+		for i := 0; i < 50; i++ {
+			_, _ = conn.Write(testRequest(id))
+			_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			n, err := conn.Read(buf)
+			if err != nil {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			msg, err := ParseResponse(buf[:n])
+			if err != nil {
+				t.Fatalf("ParseResponse() returns error: %v", err)
+			}
+			return msg
+		}
+		t.Fatal("proxy does not answer")
+		return nil
+	}
+
+	if msg := query(1); msg.Flags.RCode != RCodeNoError {
+		t.Fatalf(`first query RCode = %d, want "0", error`, msg.Flags.RCode)
+	}
+	if msg := query(2); msg.Flags.RCode != RCodeRefused {
+		t.Fatalf(`second query RCode = %d, want "5", error`, msg.Flags.RCode)
+	}
+	if stats := proxy.Stats(); stats.RateLimited != 1 {
+		t.Fatalf(`Stats().RateLimited = %d, want "1", error`, stats.RateLimited)
+	}
+}
+
+func TestDNSProxyTCPConnectionLimitRefused(t *testing.T) {
+	address, _ := startFakeUpstream(t)
+	pool, err := NewUpstreamPool(StrategyFailover, []string{address})
+	if err != nil {
+		t.Fatalf("NewUpstreamPool() returns error: %v", err)
+	}
+
+	port, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to allocate TCP port: %v", err)
+	}
+	listenPort := uint16(port.Addr().(*net.TCPAddr).Port)
+	_ = port.Close()
+
+	proxy := New(listenPort, pool)
+	proxy.Workers = 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- proxy.Listen(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	query := func(conn net.Conn, id uint16) (*Message, error) {
+		_ = conn.SetDeadline(time.Now().Add(time.Second))
+		err := writeTCPMessage(conn, testRequest(id))
+		if err != nil {
+			return nil, err
+		}
+		response, err := readTCPMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+		return ParseResponse(response)
+	}
+
+	// The first connection takes the only slot and stays open
+	var first net.Conn
+	for i := 0; i < 50; i++ {
+		first, err = net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", listenPort))
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("failed to dial proxy: %v", err)
+	}
+	defer first.Close()
+	msg, err := query(first, 1)
+	if err != nil || msg.Flags.RCode == RCodeRefused {
+		t.Fatalf("query over the first connection = %v, %v, want answer", msg, err)
+	}
+
+	second, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", listenPort))
+	if err != nil {
+		t.Fatalf("failed to dial proxy: %v", err)
+	}
+	defer second.Close()
+	msg, err = query(second, 2)
+	if err != nil || msg.Flags.RCode != RCodeRefused {
+		t.Fatalf(`query over the connection over limit = %v, %v, want RCode "5"`, msg, err)
+	}
+	if stats := proxy.Stats(); stats.QueueFull != 1 {
+		t.Fatalf(`Stats().QueueFull = %d, want "1", error`, stats.QueueFull)
+	}
+}
@@ -0,0 +1,97 @@
+package dnsProxy
+
+import (
+	"net"
+	"strings"
+	"sync"
+)
+
+const (
+	DefaultStaticTTL = 60
+)
+
+// StaticRecords is a table of names pinned to fixed addresses. Queries for
+// these names are answered by the proxy without forwarding.
+type StaticRecords struct {
+	TTL uint32
+
+	mutex   sync.RWMutex
+	records map[string][]net.IP
+}
+
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// Set replaces addresses of the name, empty list removes the name
+func (s *StaticRecords) Set(name string, addresses []net.IP) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	name = normalizeName(name)
+	if len(addresses) == 0 {
+		delete(s.records, name)
+		return
+	}
+	s.records[name] = addresses
+}
+
+// Lookup returns addresses of the name and whether the name is static
+func (s *StaticRecords) Lookup(name string) ([]net.IP, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	addresses, ok := s.records[normalizeName(name)]
+	return addresses, ok
+}
+
+// Answer builds a response to the request if the question is a static name.
+// Types other than A and AAAA get an empty answer.
+func (s *StaticRecords) Answer(request []byte) []byte {
+	msg, err := ParseResponse(request)
+	if err != nil || len(msg.QD) != 1 || msg.QD[0].QClass != 1 {
+		return nil
+	}
+
+	question := msg.QD[0]
+	addresses, ok := s.Lookup(question.QName.String())
+	if !ok {
+		return nil
+	}
+
+	header := ResourceRecordHeader{
+		Name:  question.QName,
+		Type:  question.QType,
+		Class: question.QClass,
+		TTL:   s.TTL,
+	}
+	answers := make([]ResourceRecord, 0, len(addresses))
+	for _, address := range addresses {
+		switch {
+		case question.QType == 1 && address.To4() != nil:
+			answers = append(answers, Address{ResourceRecordHeader: header, Address: address.To4()})
+		case question.QType == 28 && address.To4() == nil:
+			answers = append(answers, IPv6Address{ResourceRecordHeader: header, Address: address.To16()})
+		}
+	}
+
+	return Message{
+		ID: msg.ID,
+		Flags: Flags{
+			QR:     1,
+			Opcode: msg.Flags.Opcode,
+			AA:     1,
+			RD:     msg.Flags.RD,
+			RA:     1,
+			RCode:  RCodeNoError,
+		},
+		QD: msg.QD,
+		AN: answers,
+	}.Encode()
+}
+
+func NewStaticRecords() *StaticRecords {
+	return &StaticRecords{
+		TTL:     DefaultStaticTTL,
+		records: make(map[string][]net.IP),
+	}
+}
@@ -0,0 +1,59 @@
+package dnsProxy
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestStaticRecordsAnswer(t *testing.T) {
+	records := NewStaticRecords()
+	records.Set("Example.com.", []net.IP{net.ParseIP("192.168.1.1"), net.ParseIP("2001:db8::1")})
+
+	msg, err := ParseResponse(records.Answer(testRequest(0x1234)))
+	if err != nil {
+		t.Fatalf("ParseResponse() returns error: %v", err)
+	}
+	if msg.ID != 0x1234 || msg.Flags.QR != 1 || msg.Flags.RCode != RCodeNoError {
+		t.Fatalf("StaticRecords.Answer() = %+v, want NOERROR response to request 0x1234", msg)
+	}
+	if len(msg.AN) != 1 {
+		t.Fatalf(`StaticRecords.Answer() AN count = %d, want "1", error`, len(msg.AN))
+	}
+	address, ok := msg.AN[0].(Address)
+	if !ok || !address.Address.Equal(net.ParseIP("192.168.1.1")) || address.TTL != DefaultStaticTTL {
+		t.Fatalf(`StaticRecords.Answer() AN[0] = %+v, want "192.168.1.1"`, msg.AN[0])
+	}
+
+	records.Set("example.com", nil)
+	if records.Answer(testRequest(1)) != nil {
+		t.Fatal("StaticRecords.Answer() answers removed name")
+	}
+}
+
+func TestDNSProxyStaticRecords(t *testing.T) {
+	address, served := startFakeUpstream(t)
+	pool, err := NewUpstreamPool(StrategyFailover, []string{address})
+	if err != nil {
+		t.Fatalf("NewUpstreamPool() returns error: %v", err)
+	}
+
+	var handled *Message
+	proxy := New(0, pool)
+	proxy.StaticRecords = NewStaticRecords()
+	proxy.StaticRecords.Set("example.com", []net.IP{net.ParseIP("10.0.0.1")})
+	proxy.MsgHandler = func(client netip.Addr, msg *Message) {
+		handled = msg
+	}
+
+	_, err = proxy.exchange("udp", testClient, testRequest(1), DNSMaxUDPPackageSize)
+	if err != nil {
+		t.Fatalf("DNSProxy.exchange() returns error: %v", err)
+	}
+	if len(served) != 0 {
+		t.Fatalf(`upstream served %d requests, want "0", error`, len(served))
+	}
+	if handled == nil || len(handled.AN) != 1 {
+		t.Fatal("MsgHandler is not called with static answer")
+	}
+}
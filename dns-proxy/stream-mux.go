@@ -0,0 +1,76 @@
+package dnsProxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrConnectionClosed = errors.New("upstream connection closed")
+
+// streamMuxConn pipelines queries over a single stream connection (RFC 7766
+// section 6.2.1.1). Queries are sent with rewritten IDs and responses, which
+// may come out of order, are matched back to waiters by the pending table.
+type streamMuxConn struct {
+	pendingQueries
+
+	conn       net.Conn
+	writeMutex sync.Mutex
+	// lastRead is a time of the last read response in Unix nanoseconds
+	lastRead atomic.Int64
+}
+
+func newStreamMuxConn(conn net.Conn) *streamMuxConn {
+	c := &streamMuxConn{conn: conn}
+	c.lastRead.Store(time.Now().UnixNano())
+	go c.readLoop()
+	return c
+}
+
+func (c *streamMuxConn) readLoop() {
+	for {
+		response, err := readTCPMessage(c.conn)
+		if err != nil {
+			// Stream can not be resynchronised after any error
+			if errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) {
+				err = ErrConnectionClosed
+			}
+			c.fail(err)
+			_ = c.conn.Close()
+			return
+		}
+		c.lastRead.Store(time.Now().UnixNano())
+		c.resolve(response)
+	}
+}
+
+func (c *streamMuxConn) exchange(request []byte, timeout time.Duration) ([]byte, error) {
+	sent := time.Now().UnixNano()
+	response, err := c.pendingQueries.exchange(request, timeout, func(query []byte) error {
+		c.writeMutex.Lock()
+		defer c.writeMutex.Unlock()
+
+		err := c.conn.SetWriteDeadline(time.Now().Add(timeout))
+		if err != nil {
+			return err
+		}
+		err = writeTCPMessage(c.conn, query)
+		if err != nil {
+			// Partially written message breaks the stream
+			_ = c.conn.Close()
+		}
+		return err
+	})
+	if errors.Is(err, ErrUpstreamTimeout) && c.lastRead.Load() < sent {
+		// Nothing is read since the query was sent, connection is dead
+		_ = c.conn.Close()
+	}
+	return response, err
+}
+
+func (c *streamMuxConn) Close() error {
+	return c.conn.Close()
+}
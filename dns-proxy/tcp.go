@@ -0,0 +1,45 @@
+package dnsProxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var (
+	ErrDNSMessageTooLarge = errors.New("DNS message too large for TCP framing")
+)
+
+// readTCPMessage reads a single DNS message prefixed with a two-byte length
+// field as described in RFC 1035 section 4.2.2.
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	_, err := io.ReadFull(r, length[:])
+	if err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	_, err = io.ReadFull(r, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// writeTCPMessage writes a DNS message prefixed with a two-byte length field.
+// Length and message are sent in a single write to avoid splitting them into
+// separate segments.
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	if len(msg) > 0xFFFF {
+		return ErrDNSMessageTooLarge
+	}
+
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf[0:2], uint16(len(msg)))
+	copy(buf[2:], msg)
+
+	_, err := w.Write(buf)
+	return err
+}
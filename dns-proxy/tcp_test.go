@@ -0,0 +1,46 @@
+package dnsProxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestDNSWriteTCPMessage(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{})
+	err := writeTCPMessage(buf, []byte{0x01, 0x02, 0x03})
+	if err != nil {
+		t.Fatalf(`writeTCPMessage() returns error: %v`, err)
+	}
+	encodedGood := []byte{0x00, 0x03, 0x01, 0x02, 0x03}
+	if bytes.Compare(buf.Bytes(), encodedGood) != 0 {
+		t.Fatalf(`writeTCPMessage() = %x, want "%x", error`, buf.Bytes(), encodedGood)
+	}
+}
+
+func TestDNSReadTCPMessage(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{0x00, 0x03, 0x01, 0x02, 0x03, 0x00, 0x01, 0xFF})
+	msg, err := readTCPMessage(buf)
+	if err != nil {
+		t.Fatalf(`readTCPMessage() returns error: %v`, err)
+	}
+	if bytes.Compare(msg, []byte{0x01, 0x02, 0x03}) != 0 {
+		t.Fatalf(`readTCPMessage() = %x, want "010203", error`, msg)
+	}
+	msg, err = readTCPMessage(buf)
+	if err != nil {
+		t.Fatalf(`readTCPMessage() returns error: %v`, err)
+	}
+	if bytes.Compare(msg, []byte{0xFF}) != 0 {
+		t.Fatalf(`readTCPMessage() = %x, want "ff", error`, msg)
+	}
+}
+
+func TestDNSReadTCPMessageTruncated(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{0x00, 0x03, 0x01})
+	_, err := readTCPMessage(buf)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf(`readTCPMessage() error = %v, want "%v"`, err, io.ErrUnexpectedEOF)
+	}
+}
@@ -0,0 +1,323 @@
+package dnsProxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dnsMessageContentType = "application/dns-message"
+)
+
+var (
+	ErrUnsupportedScheme = errors.New("unsupported upstream scheme")
+	ErrBadHTTPResponse   = errors.New("bad DNS-over-HTTPS response")
+)
+
+// Transport delivers DNS messages to an upstream server
+type Transport interface {
+	// Exchange sends request and returns raw response. Network of the client
+	// request ("udp" or "tcp") is a hint used by plain DNS transport only.
+	Exchange(network string, request []byte) ([]byte, error)
+	String() string
+	// Close releases sockets and connections of the transport. Exchange
+	// fails after that.
+	Close() error
+}
+
+// NewTransport creates transport by the upstream address. Supported forms:
+//
+//	1.1.1.1, 1.1.1.1:53, udp://1.1.1.1 - plain DNS, TCP is used for TCP clients
+//	tcp://1.1.1.1:53                    - plain DNS over TCP only
+//	tls://1.1.1.1:853#cloudflare-dns.com - DNS-over-TLS, fragment overrides SNI
+//	https://1.1.1.1/dns-query           - DNS-over-HTTPS with POST requests
+//	https+get://1.1.1.1/dns-query       - DNS-over-HTTPS with GET requests
+func NewTransport(address string) (Transport, error) {
+	if !strings.Contains(address, "://") {
+		return newPlainTransport(withDefaultPort(address, "53"), ""), nil
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream address: %w", err)
+	}
+
+	switch u.Scheme {
+	case "udp":
+		return newPlainTransport(withDefaultPort(u.Host, "53"), ""), nil
+	case "tcp":
+		return newPlainTransport(withDefaultPort(u.Host, "53"), "tcp"), nil
+	case "tls":
+		serverName := u.Fragment
+		if serverName == "" {
+			serverName = u.Hostname()
+		}
+		return newTLSTransport(withDefaultPort(u.Host, "853"), &tls.Config{ServerName: serverName}), nil
+	case "https", "https+get":
+		method := http.MethodPost
+		if u.Scheme == "https+get" {
+			method = http.MethodGet
+			u.Scheme = "https"
+		}
+		return newHTTPSTransport(u.String(), method, &http.Client{
+			Transport: &http.Transport{
+				ForceAttemptHTTP2:   true,
+				MaxIdleConnsPerHost: 4,
+				IdleConnTimeout:     90 * time.Second,
+			},
+			Timeout: upstreamTimeout,
+		}), nil
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedScheme, u.Scheme)
+}
+
+func withDefaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// exchangeStream sends framed request over stream connection and reads
+// framed response
+func exchangeStream(conn net.Conn, request []byte) ([]byte, error) {
+	err := conn.SetDeadline(time.Now().Add(upstreamTimeout))
+	if err != nil {
+		return nil, fmt.Errorf("failed to set deadline: %w", err)
+	}
+
+	err = writeTCPMessage(conn, request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request to upstream: %w", err)
+	}
+
+	response, err := readTCPMessage(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response from upstream: %w", err)
+	}
+	return response, nil
+}
+
+type plainTransport struct {
+	Address string
+	// Network forces network, client network is used when empty
+	Network string
+
+	udp *udpMux
+}
+
+func newPlainTransport(address string, network string) *plainTransport {
+	return &plainTransport{
+		Address: address,
+		Network: network,
+		udp:     newUDPMux(address, upstreamUDPSockets),
+	}
+}
+
+func (t *plainTransport) String() string {
+	if t.Network != "" {
+		return t.Network + "://" + t.Address
+	}
+	return t.Address
+}
+
+func (t *plainTransport) Close() error {
+	return t.udp.Close()
+}
+
+func (t *plainTransport) Exchange(network string, request []byte) ([]byte, error) {
+	if t.Network != "" {
+		network = t.Network
+	}
+
+	if network != "tcp" {
+		return t.udp.Exchange(request)
+	}
+
+	conn, err := net.Dial(network, t.Address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial upstream: %w", err)
+	}
+	defer conn.Close()
+
+	return exchangeStream(conn, request)
+}
+
+// tlsTransport implements DNS-over-TLS (RFC 7858). Connection is kept open
+// and shared by concurrent queries, which are pipelined over it.
+type tlsTransport struct {
+	Address   string
+	TLSConfig *tls.Config
+
+	mutex  sync.Mutex
+	conn   *streamMuxConn
+	closed bool
+}
+
+func newTLSTransport(address string, tlsConfig *tls.Config) *tlsTransport {
+	return &tlsTransport{
+		Address:   address,
+		TLSConfig: tlsConfig,
+	}
+}
+
+func (t *tlsTransport) String() string {
+	return "tls://" + t.Address
+}
+
+func (t *tlsTransport) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.closed = true
+	if t.conn == nil {
+		return nil
+	}
+	err := t.conn.Close()
+	t.conn = nil
+	return err
+}
+
+// getConn returns the open connection or dials a new one. Connection is
+// replaced when it is broken or equal to stale.
+func (t *tlsTransport) getConn(stale *streamMuxConn) (*streamMuxConn, bool, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.closed {
+		return nil, false, net.ErrClosed
+	}
+
+	if t.conn != nil && t.conn != stale && !t.conn.broken() {
+		return t.conn, true, nil
+	}
+	if t.conn != nil {
+		_ = t.conn.Close()
+		t.conn = nil
+	}
+
+	dialer := &net.Dialer{Timeout: upstreamTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", t.Address, t.TLSConfig)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to dial upstream: %w", err)
+	}
+	t.conn = newStreamMuxConn(conn)
+	return t.conn, false, nil
+}
+
+func (t *tlsTransport) Exchange(network string, request []byte) ([]byte, error) {
+	conn, reused, err := t.getConn(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := conn.exchange(request, upstreamTimeout)
+	if err == nil || !reused || errors.Is(err, ErrUpstreamTimeout) {
+		return response, err
+	}
+
+	// Server may close idle connection at any time, try with a new one
+	conn, _, err = t.getConn(conn)
+	if err != nil {
+		return nil, err
+	}
+	return conn.exchange(request, upstreamTimeout)
+}
+
+// httpsTransport implements DNS-over-HTTPS (RFC 8484)
+type httpsTransport struct {
+	URL    string
+	Method string
+	Client *http.Client
+}
+
+func newHTTPSTransport(url string, method string, client *http.Client) *httpsTransport {
+	return &httpsTransport{
+		URL:    url,
+		Method: method,
+		Client: client,
+	}
+}
+
+func (t *httpsTransport) String() string {
+	return t.URL
+}
+
+func (t *httpsTransport) Close() error {
+	t.Client.CloseIdleConnections()
+	return nil
+}
+
+func (t *httpsTransport) Exchange(network string, request []byte) ([]byte, error) {
+	if len(request) < 2 {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	var req *http.Request
+	var err error
+	if t.Method == http.MethodGet {
+		// ID should be zero to make GET requests cache friendly
+		query := make([]byte, len(request))
+		copy(query, request)
+		binary.BigEndian.PutUint16(query[0:2], 0)
+
+		var u *url.URL
+		u, err = url.Parse(t.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream URL: %w", err)
+		}
+		values := u.Query()
+		values.Set("dns", base64.RawURLEncoding.EncodeToString(query))
+		u.RawQuery = values.Encode()
+		req, err = http.NewRequest(http.MethodGet, u.String(), nil)
+	} else {
+		req, err = http.NewRequest(http.MethodPost, t.URL, bytes.NewReader(request))
+		if err == nil {
+			req.Header.Set("Content-Type", dnsMessageContentType)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", dnsMessageContentType)
+
+	resp, err := t.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request to upstream: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: status %d", ErrBadHTTPResponse, resp.StatusCode)
+	}
+	contentType := resp.Header.Get("Content-Type")
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != dnsMessageContentType {
+		return nil, fmt.Errorf("%w: content type %q", ErrBadHTTPResponse, contentType)
+	}
+
+	response, err := io.ReadAll(io.LimitReader(resp.Body, 0xFFFF))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response from upstream: %w", err)
+	}
+	if len(response) < 2 {
+		return nil, fmt.Errorf("%w: message too short", ErrBadHTTPResponse)
+	}
+
+	// Restore ID of the original request
+	copy(response[0:2], request[0:2])
+	return response, nil
+}
@@ -0,0 +1,296 @@
+package dnsProxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const slowDoTQueryDelay = 500 * time.Millisecond
+
+func TestNewTransport(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+	}{
+		{"127.0.0.1", "127.0.0.1:53"},
+		{"127.0.0.1:5353", "127.0.0.1:5353"},
+		{"udp://127.0.0.1", "127.0.0.1:53"},
+		{"tcp://[::1]", "tcp://[::1]:53"},
+		{"tls://1.1.1.1#cloudflare-dns.com", "tls://1.1.1.1:853"},
+		{"https://1.1.1.1/dns-query", "https://1.1.1.1/dns-query"},
+		{"https+get://1.1.1.1/dns-query", "https://1.1.1.1/dns-query"},
+	}
+	for _, test := range tests {
+		transport, err := NewTransport(test.address)
+		if err != nil {
+			t.Fatalf(`NewTransport(%q) error = %v`, test.address, err)
+		}
+		if transport.String() != test.want {
+			t.Fatalf(`NewTransport(%q) = %s, want "%s", error`, test.address, transport.String(), test.want)
+		}
+	}
+
+	transport, err := NewTransport("tls://1.1.1.1#cloudflare-dns.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverName := transport.(*tlsTransport).TLSConfig.ServerName; serverName != "cloudflare-dns.com" {
+		t.Fatalf(`tlsTransport.TLSConfig.ServerName = %s, want "cloudflare-dns.com", error`, serverName)
+	}
+
+	_, err = NewTransport("quic://1.1.1.1")
+	if !errors.Is(err, ErrUnsupportedScheme) {
+		t.Fatalf(`NewTransport("quic://1.1.1.1") error = %v, want "%v"`, err, ErrUnsupportedScheme)
+	}
+}
+
+func startFakeDoHServer(t *testing.T, requests *atomic.Int32) *httptest.Server {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		var request []byte
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			request, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		case http.MethodPost:
+			if r.Header.Get("Content-Type") != dnsMessageContentType {
+				w.WriteHeader(http.StatusUnsupportedMediaType)
+				return
+			}
+			request, err = io.ReadAll(r.Body)
+		}
+		if err != nil || len(request) < 3 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		request[2] |= 0x80
+		w.Header().Set("Content-Type", dnsMessageContentType)
+		_, _ = w.Write(request)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestHTTPSTransport(t *testing.T) {
+	for _, method := range []string{http.MethodPost, http.MethodGet} {
+		requests := &atomic.Int32{}
+		server := startFakeDoHServer(t, requests)
+		transport := newHTTPSTransport(server.URL+"/dns-query", method, server.Client())
+
+		request := testRequest(0x1234)
+		response, err := transport.Exchange("udp", request)
+		if err != nil {
+			t.Fatalf(`%s httpsTransport.Exchange() error = %v`, method, err)
+		}
+		if !bytes.Equal(response[0:2], request[0:2]) {
+			t.Fatalf(`%s httpsTransport.Exchange() ID = %x, want "%x", error`, method, response[0:2], request[0:2])
+		}
+		if response[2]&0x80 == 0 {
+			t.Fatalf(`%s httpsTransport.Exchange() QR = 0, want "1", error`, method)
+		}
+		if requests.Load() != 1 {
+			t.Fatalf(`%s requests = %d, want "1", error`, method, requests.Load())
+		}
+	}
+}
+
+func TestHTTPSTransportBadResponse(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	transport := newHTTPSTransport(server.URL, http.MethodPost, server.Client())
+	_, err := transport.Exchange("udp", testRequest(1))
+	if !errors.Is(err, ErrBadHTTPResponse) {
+		t.Fatalf(`httpsTransport.Exchange() error = %v, want "%v"`, err, ErrBadHTTPResponse)
+	}
+}
+
+func TestHTTPSTransportContentTypeParameters(t *testing.T) {
+	for _, contentType := range []string{"application/dns-message; charset=utf-8", "Application/DNS-Message"} {
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			request, _ := io.ReadAll(r.Body)
+			w.Header().Set("Content-Type", contentType)
+			_, _ = w.Write(request)
+		}))
+
+		transport := newHTTPSTransport(server.URL, http.MethodPost, server.Client())
+		_, err := transport.Exchange("udp", testRequest(1))
+		server.Close()
+		if err != nil {
+			t.Fatalf(`httpsTransport.Exchange() with content type %q error = %v`, contentType, err)
+		}
+	}
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write(testRequest(1))
+	}))
+	defer server.Close()
+
+	transport := newHTTPSTransport(server.URL, http.MethodPost, server.Client())
+	_, err := transport.Exchange("udp", testRequest(1))
+	if !errors.Is(err, ErrBadHTTPResponse) {
+		t.Fatalf(`httpsTransport.Exchange() with content type "text/html" error = %v, want "%v"`, err, ErrBadHTTPResponse)
+	}
+}
+
+// startFakeDoTServer starts DNS-over-TLS server answering every request with
+// the request itself marked as response. TXT queries are answered after a
+// delay, so responses may come out of order. Returns address, client TLS
+// config and accepted connections counter.
+func startFakeDoTServer(t *testing.T) (string, *tls.Config, *atomic.Int32) {
+	// Borrow self-signed certificate from httptest
+	certServer := httptest.NewTLSServer(http.NotFoundHandler())
+	t.Cleanup(certServer.Close)
+	clientConfig := certServer.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	clientConfig.ServerName = "example.com"
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: certServer.TLS.Certificates})
+	if err != nil {
+		t.Fatalf("failed to start fake DoT server: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	accepted := &atomic.Int32{}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func(conn net.Conn) {
+				defer conn.Close()
+				var writeMutex sync.Mutex
+				for {
+					request, err := readTCPMessage(conn)
+					if err != nil {
+						return
+					}
+					go func() {
+						msg, err := ParseResponse(request)
+						if err == nil && len(msg.QD) > 0 && msg.QD[0].QType == 16 {
+							time.Sleep(slowDoTQueryDelay)
+						}
+						request[2] |= 0x80
+						writeMutex.Lock()
+						_ = writeTCPMessage(conn, request)
+						writeMutex.Unlock()
+					}()
+				}
+			}(conn)
+		}
+	}()
+
+	return listener.Addr().String(), clientConfig, accepted
+}
+
+func TestTLSTransport(t *testing.T) {
+	address, tlsConfig, accepted := startFakeDoTServer(t)
+	transport := newTLSTransport(address, tlsConfig)
+
+	for id := uint16(1); id <= 3; id++ {
+		request := testRequest(id)
+		response, err := transport.Exchange("udp", request)
+		if err != nil {
+			t.Fatalf(`tlsTransport.Exchange() error = %v`, err)
+		}
+		if !bytes.Equal(response[0:2], request[0:2]) {
+			t.Fatalf(`tlsTransport.Exchange() ID = %x, want "%x", error`, response[0:2], request[0:2])
+		}
+	}
+
+	if accepted.Load() != 1 {
+		t.Fatalf(`accepted connections = %d, want "1", error`, accepted.Load())
+	}
+}
+
+func TestTLSTransportReconnect(t *testing.T) {
+	address, tlsConfig, accepted := startFakeDoTServer(t)
+	transport := newTLSTransport(address, tlsConfig)
+
+	_, err := transport.Exchange("udp", testRequest(1))
+	if err != nil {
+		t.Fatalf(`tlsTransport.Exchange() error = %v`, err)
+	}
+
+	// Simulate connection closed by server while idle
+	_ = transport.conn.Close()
+
+	_, err = transport.Exchange("udp", testRequest(2))
+	if err != nil {
+		t.Fatalf(`tlsTransport.Exchange() after close error = %v`, err)
+	}
+	if accepted.Load() != 2 {
+		t.Fatalf(`accepted connections = %d, want "2", error`, accepted.Load())
+	}
+}
+
+func TestTLSTransportPipelining(t *testing.T) {
+	address, tlsConfig, accepted := startFakeDoTServer(t)
+	transport := newTLSTransport(address, tlsConfig)
+	defer transport.Close()
+
+	slowRequest := Message{
+		ID:    1,
+		Flags: Flags{RD: 1},
+		QD: []Question{
+			{QName: Name{Parts: []string{"example", "com"}}, QType: 16, QClass: 1},
+		},
+	}.Encode()
+	slowErr := make(chan error, 1)
+	go func() {
+		response, err := transport.Exchange("udp", slowRequest)
+		if err == nil && !bytes.Equal(response[0:2], slowRequest[0:2]) {
+			err = fmt.Errorf("ID = %x, want %x", response[0:2], slowRequest[0:2])
+		}
+		slowErr <- err
+	}()
+
+	// Wait for the slow query to be sent
+	for {
+		transport.mutex.Lock()
+		conn := transport.conn
+		transport.mutex.Unlock()
+		if conn != nil && conn.pendingCount() == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	request := testRequest(2)
+	response, err := transport.Exchange("udp", request)
+	if err != nil {
+		t.Fatalf(`tlsTransport.Exchange() error = %v`, err)
+	}
+	if !bytes.Equal(response[0:2], request[0:2]) {
+		t.Fatalf(`tlsTransport.Exchange() ID = %x, want "%x", error`, response[0:2], request[0:2])
+	}
+	if elapsed := time.Since(start); elapsed >= slowDoTQueryDelay {
+		t.Fatalf(`tlsTransport.Exchange() waits for slow query, elapsed = %v`, elapsed)
+	}
+
+	err = <-slowErr
+	if err != nil {
+		t.Fatalf(`tlsTransport.Exchange() of slow query error = %v`, err)
+	}
+	if accepted.Load() != 1 {
+		t.Fatalf(`accepted connections = %d, want "1", error`, accepted.Load())
+	}
+}
@@ -7,6 +7,15 @@ import (
 	"strings"
 )
 
+const (
+	RCodeNoError  = 0
+	RCodeFormErr  = 1
+	RCodeServFail = 2
+	RCodeNXDomain = 3
+	RCodeNotImp   = 4
+	RCodeRefused  = 5
+)
+
 type ResourceRecord interface {
 	EncodeResource() []byte
 }
@@ -93,6 +102,19 @@ func (a Address) EncodeResource() []byte {
 	return rr.Bytes()
 }
 
+type IPv6Address struct {
+	ResourceRecordHeader
+	Address net.IP
+}
+
+func (a IPv6Address) EncodeResource() []byte {
+	rr := bytes.NewBuffer([]byte{})
+	rr.Write(a.ResourceRecordHeader.EncodeHeader())
+	rr.Write([]byte{0x00, 0x10})
+	rr.Write(a.Address[:])
+	return rr.Bytes()
+}
+
 type NameServer struct {
 	ResourceRecordHeader
 	NSDName Name
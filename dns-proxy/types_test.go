@@ -87,6 +87,23 @@ func TestDNSAddressEncode(t *testing.T) {
 	}
 }
 
+func TestDNSIPv6AddressEncode(t *testing.T) {
+	dnsAddress := IPv6Address{
+		ResourceRecordHeader: ResourceRecordHeader{
+			Name:  Name{Parts: []string{"example", "com"}},
+			Type:  0xF0,
+			Class: 0xF0,
+			TTL:   0x77770FF0,
+		},
+		Address: []byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01},
+	}
+	dnsAddressEncoded := dnsAddress.EncodeResource()
+	dnsAddressEncodedGood := []byte{0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00, 0x00, 0xF0, 0x00, 0xF0, 0x77, 0x77, 0x0F, 0xF0, 0x00, 0x10, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01}
+	if bytes.Compare(dnsAddressEncoded, dnsAddressEncodedGood) != 0 {
+		t.Fatalf(`IPv6Address.EncodeResource() = %x, want "%x", error`, dnsAddressEncoded, dnsAddressEncodedGood)
+	}
+}
+
 func TestDNSNameServerEncode(t *testing.T) {
 	dnsNameServer := NameServer{
 		ResourceRecordHeader: ResourceRecordHeader{
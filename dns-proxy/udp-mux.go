@@ -0,0 +1,334 @@
+package dnsProxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	upstreamUDPSockets = 4
+	// upstreamSocketLifetime limits how long a socket keeps its source port,
+	// so spoofers can't learn it once and keep guessing IDs
+	upstreamSocketLifetime = 10 * time.Minute
+)
+
+var (
+	ErrUpstreamTimeout = errors.New("upstream timeout")
+	ErrTooManyPending  = errors.New("too many pending queries")
+)
+
+type udpMuxResult struct {
+	response []byte
+	err      error
+}
+
+// udpMuxQuery is a query waiting for the response
+type udpMuxQuery struct {
+	question cacheKey
+	result   chan udpMuxResult
+}
+
+// messageQuestion returns the first question of the message. Key is empty
+// when the message has no questions.
+func messageQuestion(msg []byte) (cacheKey, bool) {
+	if len(msg) < 12 {
+		return cacheKey{}, false
+	}
+	if binary.BigEndian.Uint16(msg[4:6]) == 0 {
+		return cacheKey{}, true
+	}
+	name, pos, err := parseName(msg, 12)
+	if err != nil || len(msg) < pos+4 {
+		return cacheKey{}, false
+	}
+	return cacheKey{
+		Name:  strings.ToLower(name.String()),
+		Type:  binary.BigEndian.Uint16(msg[pos : pos+2]),
+		Class: binary.BigEndian.Uint16(msg[pos+2 : pos+4]),
+	}, true
+}
+
+// pendingQueries is a table of queries sent with rewritten IDs and waiting
+// for responses
+type pendingQueries struct {
+	mutex   sync.Mutex
+	pending map[uint16]udpMuxQuery
+	err     error
+}
+
+func (c *pendingQueries) register(question cacheKey) (uint16, chan udpMuxResult, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.err != nil {
+		return 0, nil, c.err
+	}
+	if len(c.pending) > 0xFFFF {
+		return 0, nil, ErrTooManyPending
+	}
+	if c.pending == nil {
+		c.pending = make(map[uint16]udpMuxQuery)
+	}
+
+	// Random IDs make responses harder to spoof
+	id := uint16(rand.Uint32())
+	for {
+		if _, exists := c.pending[id]; !exists {
+			break
+		}
+		id++
+	}
+
+	result := make(chan udpMuxResult, 1)
+	c.pending[id] = udpMuxQuery{question: question, result: result}
+	return id, result, nil
+}
+
+func (c *pendingQueries) unregister(id uint16) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.pending, id)
+}
+
+// failPending completes all pending queries with the error
+func (c *pendingQueries) failPending(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for id, query := range c.pending {
+		query.result <- udpMuxResult{err: err}
+		delete(c.pending, id)
+	}
+}
+
+// fail marks the connection broken and completes all pending queries
+func (c *pendingQueries) fail(err error) {
+	c.mutex.Lock()
+	c.err = err
+	c.mutex.Unlock()
+	c.failPending(err)
+}
+
+// resolve passes the response to the query with the same ID and question.
+// Response is copied.
+func (c *pendingQueries) resolve(response []byte) bool {
+	if len(response) < 12 {
+		return false
+	}
+
+	id := binary.BigEndian.Uint16(response[0:2])
+	question, questionOK := messageQuestion(response)
+	c.mutex.Lock()
+	query, ok := c.pending[id]
+	// Responses must repeat the question, so spoofers have to guess it
+	// along with the ID
+	ok = ok && questionOK && query.question == question
+	if ok {
+		delete(c.pending, id)
+	}
+	c.mutex.Unlock()
+	if !ok {
+		log.Debug().Uint16("id", id).Msg("unexpected DNS response from upstream")
+		return false
+	}
+
+	query.result <- udpMuxResult{response: slices.Clone(response)}
+	return true
+}
+
+// exchange sends the request with rewritten ID by send and waits for the
+// response
+func (c *pendingQueries) exchange(request []byte, timeout time.Duration, send func(query []byte) error) ([]byte, error) {
+	if len(request) < 12 {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	question, ok := messageQuestion(request)
+	if !ok {
+		return nil, io.ErrUnexpectedEOF
+	}
+	originalID := binary.BigEndian.Uint16(request[0:2])
+	id, result, err := c.register(question)
+	if err != nil {
+		return nil, err
+	}
+
+	query := make([]byte, len(request))
+	copy(query, request)
+	binary.BigEndian.PutUint16(query[0:2], id)
+
+	err = send(query)
+	if err != nil {
+		c.unregister(id)
+		return nil, fmt.Errorf("failed to send request to upstream: %w", err)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case res := <-result:
+		if res.err != nil {
+			return nil, fmt.Errorf("failed to read response from upstream: %w", res.err)
+		}
+		binary.BigEndian.PutUint16(res.response[0:2], originalID)
+		return res.response, nil
+	case <-timer.C:
+		c.unregister(id)
+		return nil, ErrUpstreamTimeout
+	}
+}
+
+func (c *pendingQueries) broken() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.err != nil
+}
+
+func (c *pendingQueries) pendingCount() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.pending)
+}
+
+// udpMuxConn is a long-lived socket connected to the upstream. Queries are
+// sent with rewritten IDs and matched back to waiters by the pending table.
+type udpMuxConn struct {
+	pendingQueries
+
+	conn    *net.UDPConn
+	created time.Time
+}
+
+func (c *udpMuxConn) readLoop() {
+	buf := make([]byte, DNSMaxUDPPackageSize)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				c.fail(err)
+				return
+			}
+			// Upstream is unreachable (e.g. ICMP port unreachable), queries
+			// sent to it will not be answered
+			c.failPending(err)
+			continue
+		}
+		c.resolve(buf[:n])
+	}
+}
+
+func (c *udpMuxConn) exchange(request []byte, timeout time.Duration) ([]byte, error) {
+	return c.pendingQueries.exchange(request, timeout, func(query []byte) error {
+		_, err := c.conn.Write(query)
+		return err
+	})
+}
+
+func (c *udpMuxConn) expired(now time.Time) bool {
+	return now.Sub(c.created) > upstreamSocketLifetime
+}
+
+func (c *udpMuxConn) Close() error {
+	return c.conn.Close()
+}
+
+// udpMux spreads queries to the upstream over a small pool of long-lived
+// UDP sockets instead of dialing a new one per query
+type udpMux struct {
+	Address string
+	Timeout time.Duration
+
+	mutex  sync.Mutex
+	conns  []*udpMuxConn
+	next   atomic.Uint32
+	closed bool
+}
+
+func (m *udpMux) conn() (*udpMuxConn, error) {
+	// Modulo is taken in uint32, int overflows on 32-bit targets
+	i := int((m.next.Add(1) - 1) % uint32(len(m.conns)))
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// Sockets are not reopened for queries still using closed mux
+	if m.closed {
+		return nil, net.ErrClosed
+	}
+
+	now := time.Now()
+	old := m.conns[i]
+	if old != nil && !old.broken() && !old.expired(now) {
+		return old, nil
+	}
+	if old != nil && !old.broken() {
+		// Queries already sent through the old socket are answered or time
+		// out before it is closed
+		time.AfterFunc(m.Timeout, func() {
+			_ = old.Close()
+		})
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", m.Address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve upstream: %w", err)
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial upstream: %w", err)
+	}
+
+	m.conns[i] = &udpMuxConn{
+		conn:    conn,
+		created: now,
+	}
+	go m.conns[i].readLoop()
+	return m.conns[i], nil
+}
+
+func (m *udpMux) Exchange(request []byte) ([]byte, error) {
+	conn, err := m.conn()
+	if err != nil {
+		return nil, err
+	}
+	return conn.exchange(request, m.Timeout)
+}
+
+// Close closes all sockets, pending queries fail
+func (m *udpMux) Close() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.closed = true
+	var errs []error
+	for i, conn := range m.conns {
+		if conn == nil {
+			continue
+		}
+		err := conn.Close()
+		if err != nil {
+			errs = append(errs, err)
+		}
+		m.conns[i] = nil
+	}
+	return errors.Join(errs...)
+}
+
+func newUDPMux(address string, sockets int) *udpMux {
+	return &udpMux{
+		Address: address,
+		Timeout: upstreamTimeout,
+		conns:   make([]*udpMuxConn, sockets),
+	}
+}
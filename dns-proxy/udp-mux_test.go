@@ -0,0 +1,179 @@
+package dnsProxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUDPMuxRewritesIDs(t *testing.T) {
+	address, _ := startFakeUpstream(t)
+	mux := newUDPMux(address, 2)
+	defer mux.Close()
+
+	const queries = 50
+	wg := sync.WaitGroup{}
+	for i := 0; i < queries; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Every client uses the same ID, but asks for its own name
+			name := fmt.Sprintf("q%d.example.com", i)
+			request := Message{
+				ID: 1,
+				QD: []Question{{QName: Name{Parts: strings.Split(name, ".")}, QType: 1, QClass: 1}},
+			}.Encode()
+			response, err := mux.Exchange(request)
+			if err != nil {
+				t.Errorf("udpMux.Exchange() returns error: %v", err)
+				return
+			}
+			msg, err := ParseResponse(response)
+			if err != nil {
+				t.Errorf("ParseResponse() returns error: %v", err)
+				return
+			}
+			if msg.ID != 1 {
+				t.Errorf(`udpMux.Exchange() ID = %d, want "1", error`, msg.ID)
+			}
+			if msg.QD[0].QName.String() != name {
+				t.Errorf(`udpMux.Exchange() QName = %s, want "%s", error`, msg.QD[0].QName.String(), name)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, conn := range mux.conns {
+		if conn != nil && conn.pendingCount() != 0 {
+			t.Fatalf(`pending queries = %d, want "0", error`, conn.pendingCount())
+		}
+	}
+}
+
+func TestUDPMuxTimeout(t *testing.T) {
+	// Upstream reads requests and never answers
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to start fake upstream: %v", err)
+	}
+	defer conn.Close()
+
+	mux := newUDPMux(conn.LocalAddr().String(), 1)
+	mux.Timeout = 50 * time.Millisecond
+	defer mux.Close()
+
+	_, err = mux.Exchange(testRequest(1))
+	if !errors.Is(err, ErrUpstreamTimeout) {
+		t.Fatalf(`udpMux.Exchange() error = %v, want "%v"`, err, ErrUpstreamTimeout)
+	}
+	if mux.conns[0].pendingCount() != 0 {
+		t.Fatalf(`pending queries = %d, want "0", error`, mux.conns[0].pendingCount())
+	}
+}
+
+func TestUDPMuxReconnectsAfterClose(t *testing.T) {
+	address, _ := startFakeUpstream(t)
+	mux := newUDPMux(address, 1)
+	defer mux.Close()
+
+	_, err := mux.Exchange(testRequest(1))
+	if err != nil {
+		t.Fatalf("udpMux.Exchange() returns error: %v", err)
+	}
+
+	_ = mux.conns[0].Close()
+	// Wait for the reader to notice closed socket
+	for !mux.conns[0].broken() {
+		time.Sleep(time.Millisecond)
+	}
+
+	_, err = mux.Exchange(testRequest(2))
+	if err != nil {
+		t.Fatalf("udpMux.Exchange() after close returns error: %v", err)
+	}
+}
+
+// BenchmarkPlainTransportUDP measures throughput of concurrent queries to a
+// local fake upstream over shared sockets
+func BenchmarkPlainTransportUDP(b *testing.B) {
+	address, _ := startFakeUpstream(b)
+	transport := newPlainTransport(address, "")
+	defer transport.udp.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		request := testRequest(1)
+		for pb.Next() {
+			_, err := transport.Exchange("udp", request)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func TestUDPMuxDropsMismatchedQuestion(t *testing.T) {
+	// Upstream answers with the right ID, but for another name
+	address, _ := startFakeUpstreamFunc(t, func(request []byte) []byte {
+		msg, _ := ParseResponse(request)
+		msg.Flags.QR = 1
+		msg.QD[0].QName = Name{Parts: []string{"spoofed", "example", "com"}}
+		return msg.Encode()
+	})
+	mux := newUDPMux(address, 1)
+	mux.Timeout = 50 * time.Millisecond
+	defer mux.Close()
+
+	_, err := mux.Exchange(testRequest(1))
+	if !errors.Is(err, ErrUpstreamTimeout) {
+		t.Fatalf(`udpMux.Exchange() error = %v, want "%v"`, err, ErrUpstreamTimeout)
+	}
+}
+
+func TestUDPMuxRotatesSockets(t *testing.T) {
+	address, _ := startFakeUpstream(t)
+	mux := newUDPMux(address, 1)
+	mux.Timeout = 10 * time.Millisecond
+	defer mux.Close()
+
+	_, err := mux.Exchange(testRequest(1))
+	if err != nil {
+		t.Fatalf("udpMux.Exchange() returns error: %v", err)
+	}
+	old := mux.conns[0]
+	old.created = time.Now().Add(-upstreamSocketLifetime - time.Second)
+
+	_, err = mux.Exchange(testRequest(2))
+	if err != nil {
+		t.Fatalf("udpMux.Exchange() after rotation returns error: %v", err)
+	}
+	if mux.conns[0] == old {
+		t.Fatal("udpMux kept expired socket")
+	}
+	// Old socket is closed once its queries time out
+	for !old.broken() {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestUDPMuxCounterWrap(t *testing.T) {
+	address, _ := startFakeUpstream(t)
+	mux := newUDPMux(address, 3)
+	defer mux.Close()
+
+	// Counter past 2^31 is negative as 32-bit int
+	mux.next.Store(1<<31 + 1)
+	_, err := mux.Exchange(testRequest(1))
+	if err != nil {
+		t.Fatalf("udpMux.Exchange() returns error: %v", err)
+	}
+	if mux.conns[(1<<31+1)%3] == nil {
+		t.Fatalf("udpMux used socket other than #%d", (1<<31+1)%3)
+	}
+}
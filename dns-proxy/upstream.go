@@ -0,0 +1,199 @@
+package dnsProxy
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	StrategyFailover   = "failover"
+	StrategyRoundRobin = "round-robin"
+	StrategyFastest    = "fastest"
+
+	upstreamMinBackoff = time.Second
+	upstreamMaxBackoff = time.Minute
+)
+
+var (
+	ErrUnknownUpstreamStrategy = errors.New("unknown upstream strategy")
+	ErrNoUpstreams             = errors.New("no upstreams")
+	ErrAllUpstreamsFailed      = errors.New("all upstreams failed")
+)
+
+type Upstream struct {
+	Address string
+
+	transport Transport
+
+	mutex        sync.Mutex
+	failures     int
+	backoffUntil time.Time
+	rtt          time.Duration
+}
+
+// IsHealthy reports whether upstream is not in backoff after failures
+func (u *Upstream) IsHealthy(now time.Time) bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return !now.Before(u.backoffUntil)
+}
+
+// RTT returns smoothed response time, zero if upstream has not answered yet
+func (u *Upstream) RTT() time.Duration {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.rtt
+}
+
+func (u *Upstream) markSuccess(rtt time.Duration) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.failures = 0
+	u.backoffUntil = time.Time{}
+	if u.rtt == 0 {
+		u.rtt = rtt
+	} else {
+		u.rtt = (u.rtt*7 + rtt) / 8
+	}
+}
+
+func (u *Upstream) markFailure(now time.Time) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	backoff := upstreamMinBackoff << u.failures
+	if backoff > upstreamMaxBackoff || backoff <= 0 {
+		backoff = upstreamMaxBackoff
+	} else {
+		u.failures++
+	}
+	u.backoffUntil = now.Add(backoff)
+}
+
+// Exchange sends the request using the upstream transport. Network of the
+// client request ("udp" or "tcp") is passed to the transport as a hint.
+func (u *Upstream) Exchange(network string, request []byte) ([]byte, error) {
+	return u.transport.Exchange(network, request)
+}
+
+// Close closes the upstream transport
+func (u *Upstream) Close() error {
+	return u.transport.Close()
+}
+
+// NewUpstream creates upstream with transport selected by the address scheme,
+// see NewTransport
+func NewUpstream(address string) (*Upstream, error) {
+	transport, err := NewTransport(address)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", address, err)
+	}
+	return &Upstream{
+		Address:   address,
+		transport: transport,
+	}, nil
+}
+
+type UpstreamPool struct {
+	Strategy  string
+	Upstreams []*Upstream
+
+	next atomic.Uint32
+}
+
+// order returns upstreams in the order they should be tried. Upstreams in
+// backoff are moved to the end, so they are still used when nothing else
+// works.
+func (p *UpstreamPool) order(now time.Time) []*Upstream {
+	upstreams := make([]*Upstream, len(p.Upstreams))
+	copy(upstreams, p.Upstreams)
+
+	switch p.Strategy {
+	case StrategyRoundRobin:
+		if len(upstreams) > 0 {
+			// Modulo is taken in uint32, int overflows on 32-bit targets
+			shift := int((p.next.Add(1) - 1) % uint32(len(upstreams)))
+			upstreams = append(upstreams[shift:], upstreams[:shift]...)
+		}
+	case StrategyFastest:
+		sort.SliceStable(upstreams, func(i, j int) bool {
+			return upstreams[i].RTT() < upstreams[j].RTT()
+		})
+	}
+
+	healthy := make([]*Upstream, 0, len(upstreams))
+	unhealthy := make([]*Upstream, 0)
+	for _, upstream := range upstreams {
+		if upstream.IsHealthy(now) {
+			healthy = append(healthy, upstream)
+		} else {
+			unhealthy = append(unhealthy, upstream)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// Exchange tries upstreams one by one according to the strategy until one of
+// them answers.
+func (p *UpstreamPool) Exchange(network string, request []byte) ([]byte, error) {
+	if len(p.Upstreams) == 0 {
+		return nil, ErrNoUpstreams
+	}
+
+	var lastErr error
+	for _, upstream := range p.order(time.Now()) {
+		start := time.Now()
+		response, err := upstream.Exchange(network, request)
+		if err != nil {
+			upstream.markFailure(time.Now())
+			lastErr = fmt.Errorf("%s: %w", upstream.Address, err)
+			continue
+		}
+		upstream.markSuccess(time.Since(start))
+		return response, nil
+	}
+
+	return nil, fmt.Errorf("%w: %w", ErrAllUpstreamsFailed, lastErr)
+}
+
+// Close closes transports of all upstreams. Pool can't be used after that.
+func (p *UpstreamPool) Close() error {
+	var errs []error
+	for _, upstream := range p.Upstreams {
+		err := upstream.Close()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", upstream.Address, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func NewUpstreamPool(strategy string, addresses []string) (*UpstreamPool, error) {
+	switch strategy {
+	case "":
+		strategy = StrategyFailover
+	case StrategyFailover, StrategyRoundRobin, StrategyFastest:
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownUpstreamStrategy, strategy)
+	}
+
+	if len(addresses) == 0 {
+		return nil, ErrNoUpstreams
+	}
+
+	pool := &UpstreamPool{
+		Strategy:  strategy,
+		Upstreams: make([]*Upstream, len(addresses)),
+	}
+	for i, address := range addresses {
+		upstream, err := NewUpstream(address)
+		if err != nil {
+			return nil, err
+		}
+		pool.Upstreams[i] = upstream
+	}
+	return pool, nil
+}
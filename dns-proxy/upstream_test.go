@@ -0,0 +1,196 @@
+package dnsProxy
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+var testClient = netip.MustParseAddr("192.168.1.10")
+
+// startFakeUpstream starts UDP DNS server answering every request with the
+// request itself marked as response. Returns address and served requests
+// counter channel.
+func startFakeUpstream(t testing.TB) (string, chan struct{}) {
+	return startFakeUpstreamFunc(t, func(request []byte) []byte {
+		request[2] |= 0x80
+		return request
+	})
+}
+
+// startFakeUpstreamFunc starts UDP DNS server answering every request with
+// the result of handler
+func startFakeUpstreamFunc(t testing.TB, handler func(request []byte) []byte) (string, chan struct{}) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to start fake upstream: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	served := make(chan struct{}, 1024)
+	go func() {
+		buf := make([]byte, DNSMaxUDPPackageSize)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			select {
+			case served <- struct{}{}:
+			default:
+			}
+			_, _ = conn.WriteToUDP(handler(buf[:n]), addr)
+		}
+	}()
+
+	return conn.LocalAddr().String(), served
+}
+
+// deadUpstreamAddress returns address of a closed UDP port
+func deadUpstreamAddress(t testing.TB) string {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to allocate UDP port: %v", err)
+	}
+	address := conn.LocalAddr().String()
+	_ = conn.Close()
+	return address
+}
+
+func testRequest(id uint16) []byte {
+	return Message{
+		ID:    id,
+		Flags: Flags{RD: 1},
+		QD: []Question{
+			{QName: Name{Parts: []string{"example", "com"}}, QType: 1, QClass: 1},
+		},
+	}.Encode()
+}
+
+func TestUpstreamPoolFailover(t *testing.T) {
+	address, served := startFakeUpstream(t)
+	pool, err := NewUpstreamPool(StrategyFailover, []string{deadUpstreamAddress(t), address})
+	if err != nil {
+		t.Fatalf("NewUpstreamPool() returns error: %v", err)
+	}
+
+	response, err := pool.Exchange("udp", testRequest(1))
+	if err != nil {
+		t.Fatalf("UpstreamPool.Exchange() returns error: %v", err)
+	}
+	if len(response) < 2 || response[1] != 1 {
+		t.Fatalf("UpstreamPool.Exchange() = %x, want response with ID 1", response)
+	}
+	<-served
+
+	if pool.Upstreams[0].IsHealthy(time.Now()) {
+		t.Fatal("failed upstream is healthy after failure")
+	}
+	if order := pool.order(time.Now()); order[0] != pool.Upstreams[1] {
+		t.Fatal("failed upstream is not moved to the end")
+	}
+}
+
+func TestUpstreamPoolRoundRobin(t *testing.T) {
+	address1, served1 := startFakeUpstream(t)
+	address2, served2 := startFakeUpstream(t)
+	pool, err := NewUpstreamPool(StrategyRoundRobin, []string{address1, address2})
+	if err != nil {
+		t.Fatalf("NewUpstreamPool() returns error: %v", err)
+	}
+
+	for i := 0; i < 4; i++ {
+		_, err = pool.Exchange("udp", testRequest(uint16(i)))
+		if err != nil {
+			t.Fatalf("UpstreamPool.Exchange() returns error: %v", err)
+		}
+	}
+	if len(served1) != 2 || len(served2) != 2 {
+		t.Fatalf("round-robin served %d and %d requests, want 2 and 2", len(served1), len(served2))
+	}
+}
+
+func TestUpstreamPoolRoundRobinCounterWrap(t *testing.T) {
+	pool, err := NewUpstreamPool(StrategyRoundRobin, []string{"127.0.0.1:53", "127.0.0.2:53", "127.0.0.3:53"})
+	if err != nil {
+		t.Fatalf("NewUpstreamPool() returns error: %v", err)
+	}
+
+	// Counter past 2^31 is negative as 32-bit int
+	pool.next.Store(1<<31 + 1)
+	upstreams := pool.order(time.Now())
+	if len(upstreams) != 3 || upstreams[0] != pool.Upstreams[(1<<31+1)%3] {
+		t.Fatalf("UpstreamPool.order() starts with %v, want upstream #%d", upstreams[0].Address, (1<<31+1)%3)
+	}
+
+	pool.next.Store(1<<32 - 1)
+	upstreams = pool.order(time.Now())
+	if upstreams[0] != pool.Upstreams[(1<<32-1)%3] {
+		t.Fatalf("UpstreamPool.order() starts with %v, want upstream #%d", upstreams[0].Address, (1<<32-1)%3)
+	}
+}
+
+func TestUpstreamPoolClose(t *testing.T) {
+	address, _ := startFakeUpstream(t)
+	pool, err := NewUpstreamPool(StrategyFailover, []string{address, "tls://127.0.0.1:853"})
+	if err != nil {
+		t.Fatalf("NewUpstreamPool() returns error: %v", err)
+	}
+	_, err = pool.Exchange("udp", testRequest(1))
+	if err != nil {
+		t.Fatalf("UpstreamPool.Exchange() returns error: %v", err)
+	}
+
+	err = pool.Close()
+	if err != nil {
+		t.Fatalf("UpstreamPool.Close() returns error: %v", err)
+	}
+	for _, conn := range pool.Upstreams[0].transport.(*plainTransport).udp.conns {
+		if conn != nil {
+			t.Fatal("UpstreamPool.Close() left open sockets")
+		}
+	}
+	for _, upstream := range pool.Upstreams {
+		_, err = upstream.Exchange("udp", testRequest(2))
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("Upstream.Exchange() after close returns %v, want net.ErrClosed", err)
+		}
+	}
+}
+
+func TestUpstreamPoolAllFailed(t *testing.T) {
+	pool, err := NewUpstreamPool(StrategyFastest, []string{deadUpstreamAddress(t)})
+	if err != nil {
+		t.Fatalf("NewUpstreamPool() returns error: %v", err)
+	}
+
+	_, err = pool.Exchange("udp", testRequest(1))
+	if !errors.Is(err, ErrAllUpstreamsFailed) {
+		t.Fatalf("UpstreamPool.Exchange() returns %v, want ErrAllUpstreamsFailed", err)
+	}
+}
+
+func TestNewUpstreamPoolUnknownStrategy(t *testing.T) {
+	_, err := NewUpstreamPool("random", []string{"127.0.0.1:53"})
+	if !errors.Is(err, ErrUnknownUpstreamStrategy) {
+		t.Fatalf("NewUpstreamPool() returns %v, want ErrUnknownUpstreamStrategy", err)
+	}
+}
+
+func TestDNSNewErrorResponse(t *testing.T) {
+	response, err := newErrorResponse(testRequest(0x1234), RCodeServFail)
+	if err != nil {
+		t.Fatalf("newErrorResponse() returns error: %v", err)
+	}
+	msg, err := ParseResponse(response)
+	if err != nil {
+		t.Fatalf("ParseResponse() returns error: %v", err)
+	}
+	if msg.ID != 0x1234 || msg.Flags.QR != 1 || msg.Flags.RCode != RCodeServFail || len(msg.QD) != 1 {
+		t.Fatalf("newErrorResponse() = %+v, want SERVFAIL response to request 0x1234", msg)
+	}
+}
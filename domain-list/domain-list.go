@@ -0,0 +1,176 @@
+package domainList
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"kvas2-go/models"
+)
+
+const (
+	// FormatPlain is one domain per line, "*" makes the line a wildcard
+	FormatPlain = "plain"
+	// FormatHosts is the hosts file format: "0.0.0.0 example.com"
+	FormatHosts = "hosts"
+	// FormatAdblock is the adblock filter format, only "||example.com^"
+	// rules are supported
+	FormatAdblock = "adblock"
+	// FormatDnsmasq is dnsmasq configuration with "ipset=/example.com/set"
+	// or "nftset=/example.com/set" lines, domains match with subdomains
+	FormatDnsmasq = "dnsmasq"
+)
+
+var (
+	ErrUnknownFormat = errors.New("unknown list format")
+)
+
+// hostsIgnored are names present in most hosts files which must not be
+// blocked
+var hostsIgnored = map[string]struct{}{
+	"localhost":             {},
+	"localhost.localdomain": {},
+	"local":                 {},
+	"broadcasthost":         {},
+	"ip6-localhost":         {},
+	"ip6-loopback":          {},
+	"ip6-localnet":          {},
+	"ip6-mcastprefix":       {},
+	"ip6-allnodes":          {},
+	"ip6-allrouters":        {},
+	"ip6-allhosts":          {},
+	"0.0.0.0":               {},
+}
+
+// Parse reads domains from the list in the given format. Duplicated domains
+// are skipped.
+func Parse(r io.Reader, format string) ([]*models.Domain, error) {
+	var parseLine func(line string) []*models.Domain
+	switch format {
+	case FormatPlain:
+		parseLine = parsePlainLine
+	case FormatHosts:
+		parseLine = parseHostsLine
+	case FormatAdblock:
+		parseLine = parseAdblockLine
+	case FormatDnsmasq:
+		parseLine = parseDnsmasqLine
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownFormat, format)
+	}
+
+	domains := make([]*models.Domain, 0)
+	seen := make(map[string]struct{})
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		for _, domain := range parseLine(strings.TrimSpace(scanner.Text())) {
+			key := domain.Type + ":" + domain.Domain
+			if _, exists := seen[key]; exists {
+				continue
+			}
+			seen[key] = struct{}{}
+			domains = append(domains, domain)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read list: %w", err)
+	}
+	return domains, nil
+}
+
+func newDomain(domainType, domain string) *models.Domain {
+	return &models.Domain{
+		Type:   domainType,
+		Domain: strings.ToLower(strings.TrimSuffix(domain, ".")),
+		Enable: true,
+	}
+}
+
+func stripComment(line string) string {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+	return strings.TrimSpace(line)
+}
+
+func parsePlainLine(line string) []*models.Domain {
+	line = stripComment(line)
+	if line == "" {
+		return nil
+	}
+	if strings.Contains(line, "*") {
+		return []*models.Domain{newDomain("wildcard", line)}
+	}
+	return []*models.Domain{newDomain("plaintext", line)}
+}
+
+func parseHostsLine(line string) []*models.Domain {
+	fields := strings.Fields(stripComment(line))
+	if len(fields) < 2 {
+		return nil
+	}
+
+	domains := make([]*models.Domain, 0, len(fields)-1)
+	for _, name := range fields[1:] {
+		if _, ignored := hostsIgnored[strings.ToLower(name)]; ignored {
+			continue
+		}
+		domains = append(domains, newDomain("plaintext", name))
+	}
+	return domains
+}
+
+func parseAdblockLine(line string) []*models.Domain {
+	// Comments, exceptions and cosmetic rules
+	if line == "" || line[0] == '!' || line[0] == '[' || strings.HasPrefix(line, "@@") || strings.Contains(line, "#") {
+		return nil
+	}
+	if !strings.HasPrefix(line, "||") {
+		return nil
+	}
+
+	rule := strings.TrimPrefix(line, "||")
+	end := strings.IndexAny(rule, "^$")
+	if end < 0 {
+		return nil
+	}
+	// Rules with options apply to a subset of requests only
+	if strings.Contains(rule[end:], "$") {
+		return nil
+	}
+
+	name := rule[:end]
+	if name == "" || strings.ContainsAny(name, "/*:") {
+		return nil
+	}
+	return []*models.Domain{newDomain("suffix", name)}
+}
+
+func parseDnsmasqLine(line string) []*models.Domain {
+	line = stripComment(line)
+	var rule string
+	switch {
+	case strings.HasPrefix(line, "ipset=/"):
+		rule = strings.TrimPrefix(line, "ipset=/")
+	case strings.HasPrefix(line, "nftset=/"):
+		rule = strings.TrimPrefix(line, "nftset=/")
+	default:
+		return nil
+	}
+
+	// The last part is a set name
+	names := strings.Split(rule, "/")
+	names = names[:len(names)-1]
+
+	domains := make([]*models.Domain, 0, len(names))
+	for _, name := range names {
+		name = strings.TrimPrefix(name, ".")
+		if name == "" {
+			continue
+		}
+		domains = append(domains, newDomain("suffix", name))
+	}
+	return domains
+}
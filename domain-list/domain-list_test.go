@@ -0,0 +1,70 @@
+package domainList
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func domainsString(t *testing.T, list string, format string) string {
+	domains, err := Parse(strings.NewReader(list), format)
+	if err != nil {
+		t.Fatalf("Parse() returns error: %v", err)
+	}
+	parts := make([]string, len(domains))
+	for i, domain := range domains {
+		if !domain.Enable {
+			t.Fatalf("Parse() domain %s is disabled", domain.Domain)
+		}
+		parts[i] = domain.Type + ":" + domain.Domain
+	}
+	return strings.Join(parts, ",")
+}
+
+func TestParseHosts(t *testing.T) {
+	list := `# Blocklist
+127.0.0.1 localhost
+::1 ip6-localhost ip6-loopback
+0.0.0.0 0.0.0.0
+0.0.0.0 ads.example.com Tracker.Example.com # trackers
+0.0.0.0 ads.example.com
+`
+	got := domainsString(t, list, FormatHosts)
+	want := "plaintext:ads.example.com,plaintext:tracker.example.com"
+	if got != want {
+		t.Fatalf(`Parse(hosts) = %s, want "%s", error`, got, want)
+	}
+}
+
+func TestParseAdblock(t *testing.T) {
+	list := `[Adblock Plus 2.0]
+! Title: Example
+||ads.example.com^
+||tracker.example.net^$third-party
+@@||good.example.com^
+example.org##.banner
+||cdn.example.com/ads/*
+/banner/*
+||metrics.example.org^|
+`
+	got := domainsString(t, list, FormatAdblock)
+	want := "suffix:ads.example.com,suffix:metrics.example.org"
+	if got != want {
+		t.Fatalf(`Parse(adblock) = %s, want "%s", error`, got, want)
+	}
+}
+
+func TestParsePlain(t *testing.T) {
+	got := domainsString(t, "example.com\n# comment\n*.example.net\n\n", FormatPlain)
+	want := "plaintext:example.com,wildcard:*.example.net"
+	if got != want {
+		t.Fatalf(`Parse(plain) = %s, want "%s", error`, got, want)
+	}
+}
+
+func TestParseUnknownFormat(t *testing.T) {
+	_, err := Parse(strings.NewReader(""), "csv")
+	if !errors.Is(err, ErrUnknownFormat) {
+		t.Fatalf(`Parse() error = %v, want "%v"`, err, ErrUnknownFormat)
+	}
+}
@@ -0,0 +1,200 @@
+package domainList
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"kvas2-go/models"
+)
+
+const (
+	// maxListSize limits downloaded list size
+	maxListSize = 64 * 1024 * 1024
+)
+
+var (
+	ErrBadStatus = errors.New("bad HTTP status")
+)
+
+// Source is a list of domains located in a local file or at HTTP URL. Source
+// remembers validators of the last fetch, so unchanged lists are not parsed
+// again. Fetch must not be called concurrently.
+type Source struct {
+	URL    string
+	Format string
+	// CachePath is a file keeping the last fetched body of the remote list.
+	// Cache is not used when empty.
+	CachePath string
+
+	mutex        sync.Mutex
+	etag         string
+	lastModified string
+	modTime      time.Time
+	domains      []*models.Domain
+}
+
+// Domains returns domains of the last successful fetch
+func (s *Source) Domains() []*models.Domain {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.domains
+}
+
+func (s *Source) isRemote() bool {
+	return strings.HasPrefix(s.URL, "http://") || strings.HasPrefix(s.URL, "https://")
+}
+
+// Fetch loads the list. Changed is false when the list is not modified since
+// the last fetch. When the remote list is never fetched and fails to load,
+// domains are loaded from the cache and changed is true along with the error.
+func (s *Source) Fetch(ctx context.Context, client *http.Client) (changed bool, err error) {
+	if !s.isRemote() {
+		return s.fetchFile()
+	}
+
+	changed, err = s.fetchHTTP(ctx, client)
+	if err != nil && s.Domains() == nil && s.loadCache() {
+		return true, err
+	}
+	return changed, err
+}
+
+// loadCache loads domains from the cache file
+func (s *Source) loadCache() bool {
+	if s.CachePath == "" {
+		return false
+	}
+	file, err := os.Open(s.CachePath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	domains, err := Parse(file, s.Format)
+	if err != nil {
+		return false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.domains = domains
+	return true
+}
+
+// saveCache replaces the cache file with the list body
+func (s *Source) saveCache(data []byte) error {
+	if s.CachePath == "" {
+		return nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(s.CachePath), 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create list cache directory: %w", err)
+	}
+
+	tmpPath := s.CachePath + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write list cache: %w", err)
+	}
+
+	err = os.Rename(tmpPath, s.CachePath)
+	if err != nil {
+		return fmt.Errorf("failed to replace list cache: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Source) fetchFile() (bool, error) {
+	path := strings.TrimPrefix(s.URL, "file://")
+	stat, err := os.Stat(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to stat list: %w", err)
+	}
+	s.mutex.Lock()
+	unchanged := s.domains != nil && stat.ModTime().Equal(s.modTime)
+	s.mutex.Unlock()
+	if unchanged {
+		return false, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to open list: %w", err)
+	}
+	defer file.Close()
+
+	domains, err := Parse(file, s.Format)
+	if err != nil {
+		return false, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.domains = domains
+	s.modTime = stat.ModTime()
+	return true, nil
+}
+
+func (s *Source) fetchHTTP(ctx context.Context, client *http.Client) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to create request: %w", err)
+	}
+	s.mutex.Lock()
+	if s.domains != nil {
+		if s.etag != "" {
+			req.Header.Set("If-None-Match", s.etag)
+		}
+		if s.lastModified != "" {
+			req.Header.Set("If-Modified-Since", s.lastModified)
+		}
+	}
+	s.mutex.Unlock()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to fetch list: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return false, nil
+	case http.StatusOK:
+	default:
+		return false, fmt.Errorf("%w: %d", ErrBadStatus, resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxListSize))
+	if err != nil {
+		return false, fmt.Errorf("failed to read list: %w", err)
+	}
+	domains, err := Parse(bytes.NewReader(data), s.Format)
+	if err != nil {
+		return false, err
+	}
+
+	s.mutex.Lock()
+	s.domains = domains
+	s.etag = resp.Header.Get("ETag")
+	s.lastModified = resp.Header.Get("Last-Modified")
+	s.mutex.Unlock()
+
+	return true, s.saveCache(data)
+}
+
+func NewSource(url, format string) *Source {
+	return &Source{
+		URL:    url,
+		Format: format,
+	}
+}
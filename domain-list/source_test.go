@@ -0,0 +1,136 @@
+package domainList
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSourceFetchHTTP(t *testing.T) {
+	list := "ipset=/example.com/.example.org/kvas\nserver=/example.net/1.1.1.1\n"
+	notModified := atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte(list))
+	}))
+	defer server.Close()
+
+	source := NewSource(server.URL+"/list.conf", FormatDnsmasq)
+	changed, err := source.Fetch(context.Background(), server.Client())
+	if err != nil {
+		t.Fatalf("Source.Fetch() returns error: %v", err)
+	}
+	if !changed {
+		t.Fatal("Source.Fetch() = false on the first fetch")
+	}
+	domains := source.Domains()
+	if len(domains) != 2 || domains[0].Domain != "example.com" || domains[1].Domain != "example.org" || domains[1].Type != "suffix" {
+		t.Fatalf(`Source.Domains() = %v, want "example.com" and "example.org" suffixes`, domains)
+	}
+
+	changed, err = source.Fetch(context.Background(), server.Client())
+	if err != nil {
+		t.Fatalf("Source.Fetch() returns error: %v", err)
+	}
+	if changed || notModified.Load() != 1 {
+		t.Fatalf("Source.Fetch() changed = %t with %d not modified responses, want false and 1", changed, notModified.Load())
+	}
+	if len(source.Domains()) != 2 {
+		t.Fatal("Source.Domains() lost domains after not modified response")
+	}
+}
+
+func TestSourceFetchHTTPError(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	source := NewSource(server.URL, FormatPlain)
+	_, err := source.Fetch(context.Background(), server.Client())
+	if err == nil {
+		t.Fatal("Source.Fetch() returns nil error on 404")
+	}
+}
+
+func TestSourceFetchHTTPCache(t *testing.T) {
+	failing := atomic.Bool{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		_, _ = w.Write([]byte("example.com\n"))
+	}))
+	defer server.Close()
+
+	cachePath := filepath.Join(t.TempDir(), "lists", "list.txt")
+	source := NewSource(server.URL, FormatPlain)
+	source.CachePath = cachePath
+	_, err := source.Fetch(context.Background(), server.Client())
+	if err != nil {
+		t.Fatalf("Source.Fetch() returns error: %v", err)
+	}
+
+	// Source of the restarted service fails to fetch the list
+	failing.Store(true)
+	source = NewSource(server.URL, FormatPlain)
+	source.CachePath = cachePath
+	changed, err := source.Fetch(context.Background(), server.Client())
+	if err == nil || !changed {
+		t.Fatalf("Source.Fetch() = %t, %v, want true and error", changed, err)
+	}
+	domains := source.Domains()
+	if len(domains) != 1 || domains[0].Domain != "example.com" {
+		t.Fatalf(`Source.Domains() = %v, want "example.com" from cache`, domains)
+	}
+
+	// Cache is loaded only while the list is never fetched
+	changed, err = source.Fetch(context.Background(), server.Client())
+	if err == nil || changed {
+		t.Fatalf("Source.Fetch() = %t, %v, want false and error", changed, err)
+	}
+}
+
+func TestSourceFetchFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	err := os.WriteFile(path, []byte("0.0.0.0 ads.example.com\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := NewSource(path, FormatHosts)
+	changed, err := source.Fetch(context.Background(), nil)
+	if err != nil || !changed {
+		t.Fatalf("Source.Fetch() = %t, %v, want true", changed, err)
+	}
+
+	changed, err = source.Fetch(context.Background(), nil)
+	if err != nil || changed {
+		t.Fatalf("Source.Fetch() of unchanged file = %t, %v, want false", changed, err)
+	}
+
+	err = os.WriteFile(path, []byte("0.0.0.0 ads.example.com tracker.example.com\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(path, time.Now(), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed, err = source.Fetch(context.Background(), nil)
+	if err != nil || !changed {
+		t.Fatalf("Source.Fetch() of modified file = %t, %v, want true", changed, err)
+	}
+	if len(source.Domains()) != 2 {
+		t.Fatalf(`Source.Domains() count = %d, want "2", error`, len(source.Domains()))
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"slices"
+
+	"kvas2-go/netfilter-helper"
+
+	"github.com/rs/zerolog/log"
+	"github.com/vishvananda/netlink"
+)
+
+// linkIsUp reports whether the interface exists and is up. Tunnels often
+// report unknown operational state, so it is treated as up.
+func linkIsUp(ifaceName string) bool {
+	link, err := netlink.LinkByName(ifaceName)
+	if err != nil {
+		return false
+	}
+	attrs := link.Attrs()
+	if attrs.Flags&net.FlagUp == 0 {
+		return false
+	}
+	return attrs.OperState == netlink.OperUp || attrs.OperState == netlink.OperUnknown
+}
+
+// selectInterfaces returns interfaces to route through: the first interface
+// which is up or all of them with multipath. The first interface is returned
+// when all interfaces are down, so routes are ready when it comes back.
+func selectInterfaces(ifaceNames []string, multipath bool, isUp func(string) bool) []string {
+	active := make([]string, 0, len(ifaceNames))
+	for _, ifaceName := range ifaceNames {
+		if !isUp(ifaceName) {
+			continue
+		}
+		active = append(active, ifaceName)
+		if !multipath {
+			break
+		}
+	}
+	if len(active) == 0 && len(ifaceNames) != 0 {
+		active = append(active, ifaceNames[0])
+	}
+	return active
+}
+
+func (g *Group) activeInterfaces() []string {
+	return selectInterfaces(g.InterfaceNames(), g.Multipath, g.interfaceUp)
+}
+
+// usesInterface reports whether the interface is one of the group interfaces
+func (g *Group) usesInterface(ifaceName string) bool {
+	return slices.Contains(g.InterfaceNames(), ifaceName)
+}
+
+func (g *Group) setActiveInterfaces(ifaceNames []string) {
+	g.ifaceToIPSet.IfaceNames = slices.Clone(ifaceNames)
+	g.ifaceToIPSet6.IfaceNames = slices.Clone(ifaceNames)
+}
+
+// updateInterfaces switches routing of the group to the active interfaces
+// and deletes or restores the ip rule. Changed is false when the active
+// interfaces are the same.
+func (g *Group) updateInterfaces() (changed bool, err error) {
+	active := g.activeInterfaces()
+	changed = !slices.Equal(active, g.ifaceToIPSet.IfaceNames)
+	if changed {
+		log.Info().Int("group", g.ID).Strs("from", g.ifaceToIPSet.IfaceNames).Strs("to", active).Msg("switching group interfaces")
+		g.setActiveInterfaces(active)
+	}
+	if !g.Enabled {
+		return changed, nil
+	}
+
+	var errs []error
+	if changed {
+		for _, ifaceToIPSet := range []*netfilterHelper.IfaceToIPSet{g.ifaceToIPSet, g.ifaceToIPSet6} {
+			if !ifaceToIPSet.Enabled {
+				continue
+			}
+			err = ifaceToIPSet.PutIPTable("nat")
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			err = ifaceToIPSet.IfaceHandle()
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	err = g.updateRule()
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return changed, errors.Join(errs...)
+}
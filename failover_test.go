@@ -0,0 +1,55 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"kvas2-go/models"
+)
+
+func TestSelectInterfaces(t *testing.T) {
+	up := map[string]bool{"nwg1": true, "nwg2": true}
+	isUp := func(ifaceName string) bool { return up[ifaceName] }
+
+	tests := []struct {
+		name       string
+		ifaceNames []string
+		multipath  bool
+		want       []string
+	}{
+		{"first up", []string{"nwg0", "nwg1", "nwg2"}, false, []string{"nwg1"}},
+		{"preferred up", []string{"nwg2", "nwg1"}, false, []string{"nwg2"}},
+		{"multipath", []string{"nwg0", "nwg1", "nwg2"}, true, []string{"nwg1", "nwg2"}},
+		{"all down", []string{"nwg0", "nwg3"}, false, []string{"nwg0"}},
+		{"all down multipath", []string{"nwg0", "nwg3"}, true, []string{"nwg0"}},
+		{"empty", nil, false, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := selectInterfaces(tt.ifaceNames, tt.multipath, isUp)
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("selectInterfaces() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGroupRuleDisabled(t *testing.T) {
+	group := &Group{Group: &models.Group{
+		ID:          1,
+		Interface:   "kvas2-missing0",
+		HealthCheck: &models.HealthCheck{Type: "icmp", Target: "1.1.1.1", DisableRule: true},
+	}}
+	if !group.ruleDisabled() {
+		t.Fatal("Group.ruleDisabled() = false without interfaces up")
+	}
+
+	group.HealthCheck.DisableRule = false
+	if group.ruleDisabled() {
+		t.Fatal("Group.ruleDisabled() = true without disableRule")
+	}
+
+	if !group.interfaceHealthy("kvas2-missing0") {
+		t.Fatal("Group.interfaceHealthy() = false without checkers")
+	}
+}
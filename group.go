@@ -1,13 +1,22 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"net"
+	"slices"
+	"sync"
 	"time"
 
+	"kvas2-go/dns-proxy"
+	"kvas2-go/domain-list"
+	"kvas2-go/health-check"
 	"kvas2-go/models"
 	"kvas2-go/netfilter-helper"
+	"kvas2-go/prefix-database"
 
 	"github.com/coreos/go-iptables/iptables"
+	"github.com/rs/zerolog/log"
 )
 
 type Group struct {
@@ -15,9 +24,154 @@ type Group struct {
 
 	Enabled bool
 
-	iptables     *iptables.IPTables
-	ipset        *netfilterHelper.IPSet
-	ifaceToIPSet *netfilterHelper.IfaceToIPSet
+	upstreams *dnsProxy.UpstreamPool
+
+	lists []*domainList.Source
+	// listIndex is an index of domains loaded from lists
+	listIndex *domainIndex
+	// listCacheDir keeps the last fetched bodies of remote lists
+	listCacheDir string
+
+	prefixes *prefixDatabase.Database
+	// staticAddresses are host entries of static networks, filled by
+	// App.SyncGroup
+	staticAddresses map[string]struct{}
+
+	// learnedDomains are domains queried by clients of the scoped group with
+	// their deadlines. They are not persisted, so scoped group starts empty.
+	learnedMutex   sync.Mutex
+	learnedDomains map[string]time.Time
+	// clientSelectors are parsed Clients
+	clientSelectors []clientSelector
+
+	iptables      *iptables.IPTables
+	ipset         *netfilterHelper.IPSet
+	ipset6        *netfilterHelper.IPSet
+	clientSet     *netfilterHelper.IPSet
+	clientSet6    *netfilterHelper.IPSet
+	macSet        *netfilterHelper.IPSet
+	ifaceToIPSet  *netfilterHelper.IfaceToIPSet
+	ifaceToIPSet6 *netfilterHelper.IfaceToIPSet
+
+	// checkers probe the group interfaces while the group is enabled
+	checkers       map[string]*healthCheck.Checker
+	stopHealth     context.CancelFunc
+	onHealthChange func(group *Group, event healthCheck.Event)
+}
+
+// IsMatch reports whether domain name matches any enabled domain of the group
+// including domains loaded from lists
+func (g *Group) IsMatch(domainName string) bool {
+	for _, domain := range g.Domains {
+		if domain.IsEnabled() && domain.IsMatch(domainName) {
+			return true
+		}
+	}
+	return g.listIndex.isMatch(domainName)
+}
+
+// Networks returns prefixes of enabled "cidr", "asn" and "geoip" rules of
+// the group. ASN and country rules are empty without prefix database.
+func (g *Group) Networks() []*net.IPNet {
+	networks := make([]*net.IPNet, 0)
+	for _, domain := range g.Domains {
+		if !domain.IsEnabled() || !domain.IsNetwork() {
+			continue
+		}
+
+		var err error
+		switch domain.Type {
+		case "cidr":
+			var network *net.IPNet
+			network, err = domain.Network()
+			if err == nil {
+				networks = append(networks, network)
+			}
+		case "asn":
+			var asn uint32
+			asn, err = domain.ASN()
+			if err == nil && g.prefixes != nil {
+				networks = append(networks, g.prefixes.ASN(asn)...)
+			}
+		case "geoip":
+			var country string
+			country, err = domain.Country()
+			if err == nil && g.prefixes != nil {
+				networks = append(networks, g.prefixes.Country(country)...)
+			}
+		}
+		if err != nil {
+			log.Warn().Int("group", g.ID).Str("network", domain.Domain).Err(err).Msg("skipping invalid network")
+		}
+	}
+	return networks
+}
+
+// addDatabaseSelection adds ASNs and countries of enabled "asn" and "geoip"
+// rules to the prefix database selection
+func (g *Group) addDatabaseSelection(asns map[uint32]struct{}, countries map[string]struct{}) {
+	for _, domain := range g.Domains {
+		if !domain.IsEnabled() {
+			continue
+		}
+		switch domain.Type {
+		case "asn":
+			asn, err := domain.ASN()
+			if err == nil {
+				asns[asn] = struct{}{}
+			}
+		case "geoip":
+			country, err := domain.Country()
+			if err == nil {
+				countries[country] = struct{}{}
+			}
+		}
+	}
+}
+
+// hasDatabaseRules reports whether the group has rules resolved from prefix
+// database
+func (g *Group) hasDatabaseRules() bool {
+	for _, domain := range g.Domains {
+		if domain.Type == "asn" || domain.Type == "geoip" {
+			return true
+		}
+	}
+	return false
+}
+
+// isStaticAddress reports whether address is a permanent host entry of the
+// group, which must not be replaced by DNS-learned entry with timeout
+func (g *Group) isStaticAddress(address net.IP) bool {
+	if ip4 := address.To4(); ip4 != nil {
+		address = ip4
+	}
+	_, exists := g.staticAddresses[string(address)]
+	return exists
+}
+
+// reserveIPSets grows the group ipsets to fit the IPv4 and IPv6 entries
+func (g *Group) reserveIPSets(count4, count6 int) error {
+	err := g.ipset.Reserve(count4)
+	if err != nil {
+		return fmt.Errorf("failed to grow ipset: %w", err)
+	}
+	err = g.ipset6.Reserve(count6)
+	if err != nil {
+		return fmt.Errorf("failed to grow ipset (IPv6): %w", err)
+	}
+	return nil
+}
+
+// AddIP adds DNS-learned address to the group ipset
+func (g *Group) AddIP(address net.IP, ttl time.Duration) error {
+	if g.isStaticAddress(address) {
+		return nil
+	}
+	if address.To4() == nil {
+		return g.AddIPv6(address, ttl)
+	}
+	return g.AddIPv4(address, ttl)
 }
 
 func (g *Group) AddIPv4(address net.IP, ttl time.Duration) error {
@@ -33,43 +187,244 @@ func (g *Group) ListIPv4() (map[string]*uint32, error) {
 	return g.ipset.List()
 }
 
+func (g *Group) AddNetIPv4(network *net.IPNet) error {
+	permanent := uint32(0)
+	return g.ipset.AddNet(network, &permanent)
+}
+
+func (g *Group) DelNetIPv4(network *net.IPNet) error {
+	return g.ipset.DelNet(network)
+}
+
+func (g *Group) ListNetIPv4() (map[string]*uint32, error) {
+	return g.ipset.ListNets()
+}
+
+func (g *Group) AddIPv6(address net.IP, ttl time.Duration) error {
+	ttlSeconds := uint32(ttl.Seconds())
+	return g.ipset6.AddIP(address, &ttlSeconds)
+}
+
+func (g *Group) DelIPv6(address net.IP) error {
+	return g.ipset6.Del(address)
+}
+
+func (g *Group) ListIPv6() (map[string]*uint32, error) {
+	return g.ipset6.List()
+}
+
+func (g *Group) AddNetIPv6(network *net.IPNet) error {
+	permanent := uint32(0)
+	return g.ipset6.AddNet(network, &permanent)
+}
+
+func (g *Group) DelNetIPv6(network *net.IPNet) error {
+	return g.ipset6.DelNet(network)
+}
+
+func (g *Group) ListNetIPv6() (map[string]*uint32, error) {
+	return g.ipset6.ListNets()
+}
+
+func (g *Group) fixProtectRules() [][]string {
+	rules := make([][]string, 0, len(g.InterfaceNames()))
+	for _, ifaceName := range g.InterfaceNames() {
+		rules = append(rules, []string{"-o", ifaceName, "-m", "state", "--state", "NEW", "-j", "_NDM_SL_PROTECT"})
+	}
+	return rules
+}
+
 func (g *Group) Enable() error {
-	if g.Enabled {
+	// Block groups have nothing to route
+	if g.Enabled || g.IsBlock() {
 		return nil
 	}
 	defer func() {
 		if !g.Enabled {
-			_ = g.Disable()
+			_ = g.disable()
 		}
 	}()
 
 	if g.FixProtect {
-		g.iptables.AppendUnique("filter", "_NDM_SL_FORWARD", "-o", g.Interface, "-m", "state", "--state", "NEW", "-j", "_NDM_SL_PROTECT")
+		for _, rule := range g.fixProtectRules() {
+			err := g.iptables.AppendUnique("filter", "_NDM_SL_FORWARD", rule...)
+			if err != nil {
+				return fmt.Errorf("failed to fix protect: %w", err)
+			}
+		}
 	}
 
+	g.startHealthChecks()
+	g.setActiveInterfaces(g.activeInterfaces())
+	g.ifaceToIPSet.RuleDisabled = g.ruleDisabled()
+	g.ifaceToIPSet6.RuleDisabled = g.ifaceToIPSet.RuleDisabled
+
 	err := g.ifaceToIPSet.Enable()
 	if err != nil {
 		return err
 	}
 
+	// IPv6 is optional: interface may have no IPv6 support at all
+	err = g.ifaceToIPSet6.Enable()
+	if err != nil {
+		log.Warn().Int("group", g.ID).Err(err).Msg("failed to enable IPv6 routing")
+	}
+
 	g.Enabled = true
 
 	return nil
 }
 
 func (g *Group) Disable() []error {
-	var errs []error
-
 	if !g.Enabled {
 		return nil
 	}
 
+	return g.disable()
+}
+
+func (g *Group) disable() []error {
+	var errs []error
+
+	if g.FixProtect {
+		for _, rule := range g.fixProtectRules() {
+			err := g.iptables.DeleteIfExists("filter", "_NDM_SL_FORWARD", rule...)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to delete fix protect rule: %w", err))
+			}
+		}
+	}
+
 	errs2 := g.ifaceToIPSet.Disable()
 	if errs2 != nil {
 		errs = append(errs, errs2...)
 	}
 
+	errs2 = g.ifaceToIPSet6.Disable()
+	if errs2 != nil {
+		errs = append(errs, errs2...)
+	}
+
+	err := g.stopHealthChecks()
+	if err != nil {
+		errs = append(errs, err)
+	}
+
 	g.Enabled = false
 
 	return errs
 }
+
+// Destroy disables group and destroys its ipsets. Group can't be used after
+// that.
+func (g *Group) Destroy() []error {
+	errs := g.Disable()
+
+	err := g.closeUpstreams()
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	err = g.ipset.Destroy()
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	err = g.ipset6.Destroy()
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	for _, ipset := range []*netfilterHelper.IPSet{g.clientSet, g.clientSet6, g.macSet} {
+		if ipset == nil {
+			continue
+		}
+		err = ipset.Destroy()
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+// closeUpstreams closes DNS upstreams of the group, so their sockets and
+// connections are not leaked when the group is updated or removed
+func (g *Group) closeUpstreams() error {
+	if g.upstreams == nil {
+		return nil
+	}
+	err := g.upstreams.Close()
+	g.upstreams = nil
+	if err != nil {
+		return fmt.Errorf("failed to close group upstreams: %w", err)
+	}
+	return nil
+}
+
+// applyRouting passes routing settings of the group to routing helpers.
+// Routing must be re-enabled to apply them.
+func (g *Group) applyRouting() {
+	for _, ifaceToIPSet := range []*netfilterHelper.IfaceToIPSet{g.ifaceToIPSet, g.ifaceToIPSet6} {
+		ifaceToIPSet.RulePriority = g.RulePriority
+		// Bypass traffic leaves WAN through its gateway, not to the link
+		ifaceToIPSet.ResolveGateway = g.Mode == models.GroupModeBypass
+	}
+	g.setActiveInterfaces(g.activeInterfaces())
+	// Gateways are validated by models.Group.Validate
+	g.ifaceToIPSet.Gateway = net.ParseIP(g.Gateway)
+	g.ifaceToIPSet6.Gateway = net.ParseIP(g.Gateway6)
+}
+
+// Update replaces group settings. Group is re-enabled when routing settings
+// changed, so that old chains, rules and routes are cleaned up.
+func (g *Group) Update(group *models.Group, upstreams *dnsProxy.UpstreamPool) []error {
+	var errs []error
+
+	wasEnabled := g.Enabled
+	reEnable := wasEnabled && (g.Mode != group.Mode || !slices.Equal(g.InterfaceNames(), group.InterfaceNames()) ||
+		g.Multipath != group.Multipath || g.FixProtect != group.FixProtect ||
+		g.Gateway != group.Gateway || g.Gateway6 != group.Gateway6 || g.RulePriority != group.RulePriority ||
+		(len(g.Clients) == 0) != (len(group.Clients) == 0))
+	if reEnable {
+		errs = g.Disable()
+	}
+	restartHealth := !sameHealthCheck(g.HealthCheck, group.HealthCheck)
+
+	if g.ScopeDNS != group.ScopeDNS || !slices.Equal(g.Clients, group.Clients) {
+		g.resetLearnedDomains()
+	}
+	g.Group = group
+	err := g.closeUpstreams()
+	if err != nil {
+		errs = append(errs, err)
+	}
+	g.upstreams = upstreams
+	g.setLists(group.Lists)
+	g.applyRouting()
+	g.parseClients()
+	g.applyClientFilter()
+	err = g.syncClients()
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	if reEnable {
+		err = g.Enable()
+		if err != nil {
+			errs = append(errs, err)
+		}
+	} else if wasEnabled && restartHealth {
+		err = g.stopHealthChecks()
+		if err != nil {
+			errs = append(errs, err)
+		}
+		g.startHealthChecks()
+		_, err = g.updateInterfaces()
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"kvas2-go/models"
+	"kvas2-go/netfilter-helper"
+	"kvas2-go/prefix-database"
+)
+
+func TestGroupNetworks(t *testing.T) {
+	group := &Group{Group: &models.Group{
+		ID: 1,
+		Domains: []*models.Domain{
+			{Type: "cidr", Domain: "149.154.160.0/20", Enable: true},
+			{Type: "cidr", Domain: "91.108.56.1", Enable: true},
+			{Type: "cidr", Domain: "95.161.64.0/20", Enable: false},
+			{Type: "plaintext", Domain: "telegram.org", Enable: true},
+		},
+	}}
+
+	networks := group.Networks()
+	if len(networks) != 2 || networks[0].String() != "149.154.160.0/20" || networks[1].String() != "91.108.56.1/32" {
+		t.Fatalf(`Group.Networks() = %v, want "149.154.160.0/20" and "91.108.56.1/32"`, networks)
+	}
+
+	group.staticAddresses = map[string]struct{}{string(networks[1].IP): {}}
+	if !group.isStaticAddress(net.ParseIP("91.108.56.1")) {
+		t.Fatal("Group.isStaticAddress(\"91.108.56.1\") = false, want true")
+	}
+	if group.isStaticAddress(net.ParseIP("149.154.160.1")) {
+		t.Fatal("Group.isStaticAddress(\"149.154.160.1\") = true, want false")
+	}
+}
+
+func TestGroupNetworksPrefixDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pfx2as")
+	err := os.WriteFile(path, []byte("31.13.24.0\t21\t32934\n1.0.0.0\t24\t13335\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefixes := prefixDatabase.New(path, "")
+	group := &Group{
+		Group: &models.Group{
+			ID: 1,
+			Domains: []*models.Domain{
+				{Type: "asn", Domain: "AS32934", Enable: true},
+				{Type: "asn", Domain: "AS13335", Enable: false},
+				{Type: "geoip", Domain: "NL", Enable: true},
+			},
+		},
+		prefixes: prefixes,
+	}
+
+	asns, countries := make(map[uint32]struct{}), make(map[string]struct{})
+	group.addDatabaseSelection(asns, countries)
+	if len(asns) != 1 || len(countries) != 1 {
+		t.Fatalf(`Group.addDatabaseSelection() = %v, %v, want "map[32934:{}]", "map[NL:{}]"`, asns, countries)
+	}
+	_, err = prefixes.Load(asns, countries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prefixes.ASN(13335)) != 0 {
+		t.Fatalf(`Database.ASN(13335) = %v, want no prefixes of disabled rule`, prefixes.ASN(13335))
+	}
+
+	networks := group.Networks()
+	if len(networks) != 1 || networks[0].String() != "31.13.24.0/21" {
+		t.Fatalf(`Group.Networks() = %v, want "31.13.24.0/21"`, networks)
+	}
+}
+
+func TestGroupApplyRoutingBypass(t *testing.T) {
+	group := &Group{
+		Group:         &models.Group{ID: 1, Mode: models.GroupModeBypass, Interface: "eth3"},
+		ifaceToIPSet:  &netfilterHelper.IfaceToIPSet{},
+		ifaceToIPSet6: &netfilterHelper.IfaceToIPSet{},
+	}
+	group.applyRouting()
+	if !group.ifaceToIPSet.ResolveGateway || !group.ifaceToIPSet6.ResolveGateway {
+		t.Fatal("Group.applyRouting() does not resolve gateway of bypass group")
+	}
+
+	group.Mode = models.GroupModeRoute
+	group.applyRouting()
+	if group.ifaceToIPSet.ResolveGateway || group.ifaceToIPSet6.ResolveGateway {
+		t.Fatal("Group.applyRouting() resolves gateway of route group")
+	}
+}
+
+func TestAppScheduleMissingPrefixes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pfx2as")
+	err := os.WriteFile(path, []byte("31.13.24.0\t21\t32934\n1.0.0.0\t24\t13335\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &App{
+		Groups:         make(map[int]*Group),
+		prefixes:       prefixDatabase.New(path, ""),
+		prefixesReload: make(chan struct{}, 1),
+	}
+	group := &Group{Group: &models.Group{ID: 1, Domains: []*models.Domain{
+		{Type: "asn", Domain: "AS32934", Enable: true},
+	}}}
+
+	app.scheduleMissingPrefixes(group)
+	select {
+	case <-app.prefixesReload:
+	default:
+		t.Fatal("App.scheduleMissingPrefixes() does not request reload of missing ASN")
+	}
+
+	_, err = app.prefixes.Load(map[uint32]struct{}{32934: {}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.scheduleMissingPrefixes(group)
+	select {
+	case <-app.prefixesReload:
+		t.Fatal("App.scheduleMissingPrefixes() requests reload of loaded ASN")
+	default:
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sort"
+
+	"kvas2-go/health-check"
+	"kvas2-go/models"
+
+	"github.com/rs/zerolog/log"
+)
+
+// interfaceHealth is a health state of the group interface
+type interfaceHealth struct {
+	GroupID   int    `json:"groupID"`
+	Interface string `json:"interface"`
+	LinkUp    bool   `json:"linkUp"`
+	Healthy   bool   `json:"healthy"`
+	Active    bool   `json:"active"`
+}
+
+// sameHealthCheck reports whether health check settings are equal
+func sameHealthCheck(a, b *models.HealthCheck) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// startHealthChecks runs checkers of the group interfaces until
+// stopHealthChecks is called
+func (g *Group) startHealthChecks() {
+	if g.HealthCheck == nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	g.stopHealth = cancel
+	g.checkers = make(map[string]*healthCheck.Checker)
+	for _, ifaceName := range g.InterfaceNames() {
+		checker := healthCheck.New(g.HealthCheck.Type, ifaceName, g.HealthCheck.Target,
+			g.HealthCheck.Interval, g.HealthCheck.Timeout, g.HealthCheck.Rise, g.HealthCheck.Fall)
+		checker.OnChange = func(event healthCheck.Event) {
+			if g.onHealthChange != nil {
+				g.onHealthChange(g, event)
+			}
+		}
+		g.checkers[ifaceName] = checker
+		go checker.Run(ctx)
+	}
+}
+
+// stopHealthChecks stops checkers and restores the ip rule deleted by them
+func (g *Group) stopHealthChecks() error {
+	if g.stopHealth != nil {
+		g.stopHealth()
+		g.stopHealth = nil
+	}
+	g.checkers = nil
+	return errors.Join(g.ifaceToIPSet.SetRuleDisabled(false), g.ifaceToIPSet6.SetRuleDisabled(false))
+}
+
+// interfaceHealthy reports whether the interface passes health checks.
+// Interfaces without checker are healthy.
+func (g *Group) interfaceHealthy(ifaceName string) bool {
+	checker, exists := g.checkers[ifaceName]
+	return !exists || checker.Healthy()
+}
+
+// interfaceUp reports whether the interface is up and healthy
+func (g *Group) interfaceUp(ifaceName string) bool {
+	return linkIsUp(ifaceName) && g.interfaceHealthy(ifaceName)
+}
+
+// ruleDisabled reports whether the ip rule must be deleted: health check
+// asks for it and no interface is up and healthy
+func (g *Group) ruleDisabled() bool {
+	return g.HealthCheck != nil && g.HealthCheck.DisableRule && !slices.ContainsFunc(g.InterfaceNames(), g.interfaceUp)
+}
+
+// updateRule deletes or restores the ip rule according to the interfaces
+// health
+func (g *Group) updateRule() error {
+	disabled := g.ruleDisabled()
+	if disabled == g.ifaceToIPSet.RuleDisabled {
+		return nil
+	}
+
+	if disabled {
+		log.Warn().Int("group", g.ID).Msg("no healthy interfaces, group rule is deleted")
+	} else {
+		log.Info().Int("group", g.ID).Msg("group rule is restored")
+	}
+	return errors.Join(g.ifaceToIPSet.SetRuleDisabled(disabled), g.ifaceToIPSet6.SetRuleDisabled(disabled))
+}
+
+// handleHealthChange switches the group interfaces on health state
+// transition
+func (a *App) handleHealthChange(group *Group, event healthCheck.Event) {
+	if event.Healthy {
+		log.Info().Int("group", group.ID).Str("interface", event.Interface).Msg("interface is healthy")
+	} else {
+		log.Warn().Int("group", group.ID).Str("interface", event.Interface).Err(event.Err).Msg("interface is unhealthy")
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	// Group may be removed or disabled while waiting for lock
+	if a.Groups[group.ID] != group || group.checkers[event.Interface] == nil {
+		return
+	}
+	_, err := group.updateInterfaces()
+	if err != nil {
+		log.Error().Int("group", group.ID).Err(err).Msg("error while switching interfaces")
+	}
+}
+
+// HealthList returns health state of the interfaces of all groups
+func (a *App) HealthList() []interfaceHealth {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	result := make([]interfaceHealth, 0)
+	for _, group := range a.Groups {
+		if group.IsBlock() {
+			continue
+		}
+		for _, ifaceName := range group.InterfaceNames() {
+			result = append(result, interfaceHealth{
+				GroupID:   group.ID,
+				Interface: ifaceName,
+				LinkUp:    linkIsUp(ifaceName),
+				Healthy:   group.interfaceHealthy(ifaceName),
+				Active:    slices.Contains(group.ifaceToIPSet.IfaceNames, ifaceName),
+			})
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].GroupID < result[j].GroupID
+	})
+	return result
+}
@@ -0,0 +1,139 @@
+package healthCheck
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultInterval = 10 * time.Second
+	DefaultTimeout  = 2 * time.Second
+	DefaultRise     = 2
+	DefaultFall     = 3
+)
+
+// Event is a state transition of the checked interface
+type Event struct {
+	Interface string
+	Healthy   bool
+	// Err is an error of the last probe when interface becomes unhealthy
+	Err error
+}
+
+// Checker probes the target through the interface periodically. Interface
+// is healthy until Fall probes in a row fail and becomes healthy again after
+// Rise probes in a row succeed.
+type Checker struct {
+	Interface string
+	Type      string
+	Target    string
+	Interval  time.Duration
+	Timeout   time.Duration
+	Rise      int
+	Fall      int
+	// OnChange is called on every state transition
+	OnChange func(event Event)
+
+	probe func(ctx context.Context) error
+
+	mutex     sync.Mutex
+	unhealthy bool
+	successes int
+	failures  int
+}
+
+// Healthy reports the current state of the interface
+func (c *Checker) Healthy() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return !c.unhealthy
+}
+
+// Check runs a single probe and updates the state. OnChange is called when
+// the state changes.
+func (c *Checker) Check(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	err := c.probe(ctx)
+	// Probes interrupted by shutdown say nothing about the interface
+	if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+		return
+	}
+
+	event, changed := c.report(err)
+	if changed && c.OnChange != nil {
+		c.OnChange(event)
+	}
+}
+
+func (c *Checker) report(err error) (Event, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err != nil {
+		c.successes = 0
+		c.failures++
+		if c.unhealthy || c.failures < c.Fall {
+			return Event{}, false
+		}
+		c.unhealthy = true
+		return Event{Interface: c.Interface, Healthy: false, Err: err}, true
+	}
+
+	c.failures = 0
+	c.successes++
+	if !c.unhealthy || c.successes < c.Rise {
+		return Event{}, false
+	}
+	c.unhealthy = false
+	return Event{Interface: c.Interface, Healthy: true}, true
+}
+
+// Run checks the interface every interval until the context is done
+func (c *Checker) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+
+	c.Check(ctx)
+	for {
+		select {
+		case <-ticker.C:
+			c.Check(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// New returns checker of the interface. Zero interval, timeout and
+// thresholds are replaced by defaults.
+func New(checkType, ifaceName, target string, interval, timeout time.Duration, rise, fall int) *Checker {
+	c := &Checker{
+		Interface: ifaceName,
+		Type:      checkType,
+		Target:    target,
+		Interval:  interval,
+		Timeout:   timeout,
+		Rise:      rise,
+		Fall:      fall,
+	}
+	if c.Interval <= 0 {
+		c.Interval = DefaultInterval
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = DefaultTimeout
+	}
+	if c.Rise <= 0 {
+		c.Rise = DefaultRise
+	}
+	if c.Fall <= 0 {
+		c.Fall = DefaultFall
+	}
+	c.probe = func(ctx context.Context) error {
+		return Probe(ctx, c.Type, c.Interface, c.Target)
+	}
+	return c
+}
@@ -0,0 +1,68 @@
+package healthCheck
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestCheckerTransitions(t *testing.T) {
+	probeErr := errors.New("timeout")
+	results := []error{nil, probeErr, probeErr, nil, probeErr, probeErr, probeErr, nil, nil, probeErr, nil, nil}
+	// Fall 3 and rise 2 make a single unhealthy and a single healthy event
+	wantEvents := []Event{
+		{Interface: "nwg0", Healthy: false, Err: probeErr},
+		{Interface: "nwg0", Healthy: true},
+	}
+
+	checker := New(TypeICMP, "nwg0", "1.1.1.1", 0, 0, 2, 3)
+	events := make([]Event, 0)
+	checker.OnChange = func(event Event) {
+		events = append(events, event)
+	}
+	i := 0
+	checker.probe = func(ctx context.Context) error {
+		err := results[i]
+		i++
+		return err
+	}
+
+	for range results {
+		checker.Check(context.Background())
+		if i == 7 && checker.Healthy() {
+			t.Fatal("Checker.Healthy() = true after 3 failed probes")
+		}
+	}
+	if !checker.Healthy() {
+		t.Fatal("Checker.Healthy() = false after 2 successful probes")
+	}
+	if len(events) != len(wantEvents) {
+		t.Fatalf("Checker events = %v, want %v", events, wantEvents)
+	}
+	for j, event := range events {
+		if event != wantEvents[j] {
+			t.Fatalf("Checker event #%d = %v, want %v", j, event, wantEvents[j])
+		}
+	}
+}
+
+func TestCheckerCanceled(t *testing.T) {
+	checker := New(TypeTCP, "nwg0", "1.1.1.1:443", 0, 0, 1, 1)
+	checker.probe = func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	checker.Check(ctx)
+	if !checker.Healthy() {
+		t.Fatal("Checker.Healthy() = false after canceled probe")
+	}
+}
+
+func TestProbeUnknownType(t *testing.T) {
+	err := Probe(context.Background(), "http", "lo", "127.0.0.1")
+	if !errors.Is(err, ErrUnknownType) {
+		t.Fatalf("Probe() = %v, want ErrUnknownType", err)
+	}
+}
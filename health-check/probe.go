@@ -0,0 +1,189 @@
+package healthCheck
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"kvas2-go/dns-proxy"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	TypeICMP = "icmp"
+	TypeTCP  = "tcp"
+	TypeDNS  = "dns"
+)
+
+var (
+	ErrUnknownType   = errors.New("unknown health check type")
+	ErrInvalidTarget = errors.New("invalid health check target")
+)
+
+// bindToDevice returns socket control function binding sockets to the
+// interface with SO_BINDTODEVICE, so probes pass through the interface
+// regardless of the routing tables
+func bindToDevice(ifaceName string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var bindErr error
+		err := c.Control(func(fd uintptr) {
+			bindErr = unix.BindToDevice(int(fd), ifaceName)
+		})
+		if err != nil {
+			return err
+		}
+		if bindErr != nil {
+			return fmt.Errorf("failed to bind to %s: %w", ifaceName, bindErr)
+		}
+		return nil
+	}
+}
+
+// Probe checks whether the target answers through the interface. Target is
+// an address for ICMP, host and port for TCP, DNS server address with
+// optional port for DNS.
+func Probe(ctx context.Context, checkType, ifaceName, target string) error {
+	switch checkType {
+	case TypeICMP:
+		return probeICMP(ctx, ifaceName, target)
+	case TypeTCP:
+		return probeTCP(ctx, ifaceName, target)
+	case TypeDNS:
+		return probeDNS(ctx, ifaceName, target)
+	default:
+		return fmt.Errorf("%w: %q", ErrUnknownType, checkType)
+	}
+}
+
+func probeTCP(ctx context.Context, ifaceName, target string) error {
+	dialer := &net.Dialer{Control: bindToDevice(ifaceName)}
+	conn, err := dialer.DialContext(ctx, "tcp", target)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// probeDNS asks the server for root name servers. Any reply to the query is
+// a success, even with error code, since the server is reachable.
+func probeDNS(ctx context.Context, ifaceName, target string) error {
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		target = net.JoinHostPort(target, "53")
+	}
+
+	dialer := &net.Dialer{Control: bindToDevice(ifaceName)}
+	conn, err := dialer.DialContext(ctx, "udp", target)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	id := uint16(rand.Uint32())
+	request := dnsProxy.Message{
+		ID:    id,
+		Flags: dnsProxy.Flags{RD: 1},
+		QD: []dnsProxy.Question{{
+			QName:  dnsProxy.Name{},
+			QType:  2,
+			QClass: 1,
+		}},
+	}
+	_, err = conn.Write(request.Encode())
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		msg, err := dnsProxy.ParseResponse(buf[:n])
+		if err != nil || msg.ID != id || msg.Flags.QR != 1 {
+			// Stale replies of the previous probes are skipped
+			continue
+		}
+		return nil
+	}
+}
+
+// probeICMP sends echo request from raw socket bound to the interface and
+// waits for the reply with the same identifier
+func probeICMP(ctx context.Context, ifaceName, target string) error {
+	ip := net.ParseIP(target)
+	if ip == nil {
+		return fmt.Errorf("%w: %q", ErrInvalidTarget, target)
+	}
+
+	network, requestType, replyType := "ip4:icmp", byte(8), byte(0)
+	if ip.To4() == nil {
+		network, requestType, replyType = "ip6:ipv6-icmp", 128, 129
+	}
+
+	listenConfig := &net.ListenConfig{Control: bindToDevice(ifaceName)}
+	conn, err := listenConfig.ListenPacket(ctx, network, "")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(time.Second)
+	}
+	_ = conn.SetDeadline(deadline)
+
+	id, seq := uint16(rand.Uint32()), uint16(1)
+	request := make([]byte, 16)
+	request[0] = requestType
+	binary.BigEndian.PutUint16(request[4:6], id)
+	binary.BigEndian.PutUint16(request[6:8], seq)
+	copy(request[8:], "kvas2-go")
+	// Kernel computes ICMPv6 checksum itself
+	if requestType == 8 {
+		binary.BigEndian.PutUint16(request[2:4], icmpChecksum(request))
+	}
+	_, err = conn.WriteTo(request, &net.IPAddr{IP: ip})
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		// Raw socket receives all ICMP messages of the interface
+		if n < 8 || buf[0] != replyType || !addr.(*net.IPAddr).IP.Equal(ip) {
+			continue
+		}
+		if binary.BigEndian.Uint16(buf[4:6]) != id || binary.BigEndian.Uint16(buf[6:8]) != seq {
+			continue
+		}
+		return nil
+	}
+}
+
+func icmpChecksum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xFFFF + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,186 @@
+package healthCheck
+
+import (
+	"context"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"kvas2-go/dns-proxy"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// setupVeth creates veth pair with "hc0" end (10.213.0.1) in the current
+// namespace and "hc1" end (10.213.0.2) in a new namespace. TCP listener and
+// DNS server are opened in the new namespace. Test is skipped without
+// privileges.
+func setupVeth(t *testing.T) (peer netlink.Link, peerHandle *netlink.Handle, tcpAddr, dnsAddr string) {
+	if os.Geteuid() != 0 {
+		t.Skip("root privileges are required")
+	}
+
+	err := netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "hc0"}, PeerName: "hc1"})
+	if err != nil {
+		t.Skipf("failed to create veth pair: %v", err)
+	}
+	link, err := netlink.LinkByName("hc0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = netlink.LinkDel(link) })
+
+	// Sockets belong to the namespace of the thread which opens them
+	runtime.LockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		t.Fatal(err)
+	}
+	ns, err := netns.New()
+	if err != nil {
+		runtime.UnlockOSThread()
+		t.Skipf("failed to create namespace: %v", err)
+	}
+	err = netns.Set(origin)
+	runtime.UnlockOSThread()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ns.Close() })
+
+	peer, err = netlink.LinkByName("hc1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = netlink.LinkSetNsFd(peer, int(ns))
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerHandle, err = netlink.NewHandleAt(ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(peerHandle.Close)
+
+	addr, _ := netlink.ParseAddr("10.213.0.1/30")
+	err = netlink.AddrAdd(link, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = netlink.LinkSetUp(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err = peerHandle.LinkByName("hc1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, _ = netlink.ParseAddr("10.213.0.2/30")
+	err = peerHandle.AddrAdd(peer, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = peerHandle.LinkSetUp(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runtime.LockOSThread()
+	err = netns.Set(ns)
+	if err != nil {
+		runtime.UnlockOSThread()
+		t.Fatal(err)
+	}
+	tcpListener, tcpErr := net.Listen("tcp", "10.213.0.2:0")
+	dnsConn, dnsErr := net.ListenPacket("udp", "10.213.0.2:0")
+	err = netns.Set(origin)
+	runtime.UnlockOSThread()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tcpErr != nil || dnsErr != nil {
+		t.Fatalf("failed to listen in namespace: %v, %v", tcpErr, dnsErr)
+	}
+	t.Cleanup(func() {
+		_ = tcpListener.Close()
+		_ = dnsConn.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := tcpListener.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := dnsConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			request, err := dnsProxy.ParseResponse(buf[:n])
+			if err != nil {
+				continue
+			}
+			response := dnsProxy.Message{
+				ID:    request.ID,
+				Flags: dnsProxy.Flags{QR: 1, RD: 1, RA: 1},
+				QD:    request.QD,
+			}
+			_, _ = dnsConn.WriteTo(response.Encode(), addr)
+		}
+	}()
+
+	return peer, peerHandle, tcpListener.Addr().String(), dnsConn.LocalAddr().String()
+}
+
+func TestProbeVeth(t *testing.T) {
+	peer, peerHandle, tcpAddr, dnsAddr := setupVeth(t)
+
+	probes := []struct {
+		checkType string
+		target    string
+	}{
+		{TypeICMP, "10.213.0.2"},
+		{TypeTCP, tcpAddr},
+		{TypeDNS, dnsAddr},
+	}
+
+	for _, probe := range probes {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		err := Probe(ctx, probe.checkType, "hc0", probe.target)
+		cancel()
+		if err != nil {
+			t.Fatalf("Probe(%s) through veth returns error: %v", probe.checkType, err)
+		}
+	}
+
+	// Peer is unreachable through loopback
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	err := Probe(ctx, TypeICMP, "lo", "10.213.0.2")
+	cancel()
+	if err == nil {
+		t.Fatal("Probe(icmp) through lo returns nil error")
+	}
+
+	err = peerHandle.LinkSetDown(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, probe := range probes {
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		err := Probe(ctx, probe.checkType, "hc0", probe.target)
+		cancel()
+		if err == nil {
+			t.Fatalf("Probe(%s) returns nil error while peer is down", probe.checkType)
+		}
+	}
+}
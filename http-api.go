@@ -0,0 +1,400 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"kvas2-go/models"
+
+	"github.com/rs/zerolog/log"
+)
+
+type httpError struct {
+	Error string `json:"error"`
+}
+
+type interfaceInfo struct {
+	Index int    `json:"index"`
+	Name  string `json:"name"`
+	MTU   int    `json:"mtu"`
+	Up    bool   `json:"up"`
+}
+
+type ipsetEntry struct {
+	Address string  `json:"address"`
+	Timeout *uint32 `json:"timeout,omitempty"`
+}
+
+type ipsetContent struct {
+	IPv4 []ipsetEntry `json:"ipv4"`
+	IPv6 []ipsetEntry `json:"ipv6"`
+}
+
+func (a *App) interfaceInfos() ([]interfaceInfo, error) {
+	interfaces, err := a.ListInterfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]interfaceInfo, len(interfaces))
+	for i, iface := range interfaces {
+		result[i] = interfaceInfo{
+			Index: iface.Index,
+			Name:  iface.Name,
+			MTU:   iface.MTU,
+			Up:    iface.Flags&net.FlagUp != 0,
+		}
+	}
+	return result, nil
+}
+
+func (a *App) groupIPSetContent(groupID int) (*ipsetContent, error) {
+	group, err := a.GetGroup(groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	addresses, err := group.ListIPv4()
+	if err != nil {
+		return nil, err
+	}
+	addresses6, err := group.ListIPv6()
+	if err != nil {
+		return nil, err
+	}
+	networks, err := group.ListNetIPv4()
+	if err != nil {
+		return nil, err
+	}
+	networks6, err := group.ListNetIPv6()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ipsetContent{
+		IPv4: append(ipsetEntries(addresses), ipsetNetworkEntries(networks)...),
+		IPv6: append(ipsetEntries(addresses6), ipsetNetworkEntries(networks6)...),
+	}, nil
+}
+
+// sortedGroups returns groups ordered by ID. Caller must hold App mutex.
+func (a *App) sortedGroups() []*models.Group {
+	groups := make([]*models.Group, 0, len(a.Groups))
+	for _, group := range a.Groups {
+		groups = append(groups, group.Group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].ID < groups[j].ID
+	})
+	return groups
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to write HTTP response")
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrGroupNotFound), errors.Is(err, ErrDomainNotFound), errors.Is(err, ErrClientNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrGroupIDConflict), errors.Is(err, ErrDomainIDConflict), errors.Is(err, ErrClientConflict):
+		status = http.StatusConflict
+	case isValidationError(err):
+		status = http.StatusBadRequest
+	}
+	writeJSON(w, status, httpError{Error: err.Error()})
+}
+
+func readJSON(r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+func (a *App) httpHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/interfaces", a.httpInterfaces)
+	mux.HandleFunc("/api/groups", a.httpGroups)
+	mux.HandleFunc("/api/groups/", a.httpGroup)
+	return mux
+}
+
+func (a *App) httpInterfaces(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	interfaces, err := a.interfaceInfos()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, interfaces)
+}
+
+// httpGroups handles /api/groups
+func (a *App) httpGroups(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		a.mutex.RLock()
+		defer a.mutex.RUnlock()
+
+		writeJSON(w, http.StatusOK, a.sortedGroups())
+	case http.MethodPost:
+		group := &models.Group{}
+		err := readJSON(r, group)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, httpError{Error: err.Error()})
+			return
+		}
+
+		err = group.Validate()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		err = a.AddGroup(group)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		a.mutex.RLock()
+		defer a.mutex.RUnlock()
+		writeJSON(w, http.StatusCreated, group)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// httpGroup handles /api/groups/{id}, /api/groups/{id}/ipset,
+// /api/groups/{id}/domains and /api/groups/{id}/domains/{domainID}
+func (a *App) httpGroup(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/groups/"), "/"), "/")
+
+	groupID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, httpError{Error: fmt.Sprintf("invalid group id: %s", parts[0])})
+		return
+	}
+
+	switch {
+	case len(parts) == 1:
+		a.httpGroupItem(w, r, groupID)
+	case len(parts) == 2 && parts[1] == "ipset":
+		a.httpGroupIPSet(w, r, groupID)
+	case len(parts) == 2 && parts[1] == "domains":
+		a.httpDomains(w, r, groupID)
+	case len(parts) == 3 && parts[1] == "domains":
+		domainID, err := strconv.Atoi(parts[2])
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, httpError{Error: fmt.Sprintf("invalid domain id: %s", parts[2])})
+			return
+		}
+		a.httpDomain(w, r, groupID, domainID)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (a *App) httpGroupItem(w http.ResponseWriter, r *http.Request, groupID int) {
+	switch r.Method {
+	case http.MethodGet:
+		group, err := a.GetGroup(groupID)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		a.mutex.RLock()
+		defer a.mutex.RUnlock()
+		writeJSON(w, http.StatusOK, group.Group)
+	case http.MethodPut:
+		group := &models.Group{}
+		err := readJSON(r, group)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, httpError{Error: err.Error()})
+			return
+		}
+		group.ID = groupID
+
+		err = group.Validate()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		err = a.UpdateGroup(group)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		a.mutex.RLock()
+		defer a.mutex.RUnlock()
+		writeJSON(w, http.StatusOK, group)
+	case http.MethodDelete:
+		err := a.RemoveGroup(groupID)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *App) httpGroupIPSet(w http.ResponseWriter, r *http.Request, groupID int) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	content, err := a.groupIPSetContent(groupID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, content)
+}
+
+func ipsetEntries(addresses map[string]*uint32) []ipsetEntry {
+	entries := make([]ipsetEntry, 0, len(addresses))
+	for addr, timeout := range addresses {
+		entries = append(entries, ipsetEntry{
+			Address: net.IP(addr).String(),
+			Timeout: timeout,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Address < entries[j].Address
+	})
+	return entries
+}
+
+func ipsetNetworkEntries(networks map[string]*uint32) []ipsetEntry {
+	entries := make([]ipsetEntry, 0, len(networks))
+	for network, timeout := range networks {
+		entries = append(entries, ipsetEntry{
+			Address: network,
+			Timeout: timeout,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Address < entries[j].Address
+	})
+	return entries
+}
+
+func (a *App) httpDomains(w http.ResponseWriter, r *http.Request, groupID int) {
+	switch r.Method {
+	case http.MethodGet:
+		group, err := a.GetGroup(groupID)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		a.mutex.RLock()
+		defer a.mutex.RUnlock()
+		domains := group.Domains
+		if domains == nil {
+			domains = []*models.Domain{}
+		}
+		writeJSON(w, http.StatusOK, domains)
+	case http.MethodPost:
+		domain := &models.Domain{}
+		err := readJSON(r, domain)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, httpError{Error: err.Error()})
+			return
+		}
+
+		err = domain.Validate()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		err = a.AddDomain(groupID, domain)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		a.mutex.RLock()
+		defer a.mutex.RUnlock()
+		writeJSON(w, http.StatusCreated, domain)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *App) httpDomain(w http.ResponseWriter, r *http.Request, groupID, domainID int) {
+	switch r.Method {
+	case http.MethodGet:
+		group, err := a.GetGroup(groupID)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		a.mutex.RLock()
+		defer a.mutex.RUnlock()
+		for _, domain := range group.Domains {
+			if domain.ID == domainID {
+				writeJSON(w, http.StatusOK, domain)
+				return
+			}
+		}
+		writeError(w, ErrDomainNotFound)
+	case http.MethodPut:
+		domain := &models.Domain{}
+		err := readJSON(r, domain)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, httpError{Error: err.Error()})
+			return
+		}
+		domain.ID = domainID
+
+		err = domain.Validate()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		err = a.UpdateDomain(groupID, domain)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		a.mutex.RLock()
+		defer a.mutex.RUnlock()
+		writeJSON(w, http.StatusOK, domain)
+	case http.MethodDelete:
+		err := a.RemoveDomain(groupID, domainID)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPGroupsEmpty(t *testing.T) {
+	app := &App{Groups: make(map[int]*Group)}
+	server := httptest.NewServer(app.httpHandler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/api/groups")
+	if err != nil {
+		t.Fatalf("GET /api/groups returns error: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /api/groups status = %d, want \"%d\"", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestHTTPGroupErrors(t *testing.T) {
+	app := &App{Groups: make(map[int]*Group)}
+	server := httptest.NewServer(app.httpHandler())
+	defer server.Close()
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{http.MethodGet, "/api/groups/1", "", http.StatusNotFound},
+		{http.MethodGet, "/api/groups/abc", "", http.StatusBadRequest},
+		{http.MethodDelete, "/api/groups/1", "", http.StatusNotFound},
+		{http.MethodGet, "/api/groups/1/unknown", "", http.StatusNotFound},
+		{http.MethodPost, "/api/groups", `{"id": 1}`, http.StatusBadRequest},
+		{http.MethodPost, "/api/groups", `{"id": 1, "mode": "tunnel"}`, http.StatusBadRequest},
+		{http.MethodPost, "/api/groups", `{"id": 1, "mode": "block", "blockResponse": "refused"}`, http.StatusBadRequest},
+		{http.MethodPost, "/api/groups", `{"id": 1, "mode": "block", "lists": [{"format": "plain"}]}`, http.StatusBadRequest},
+		{http.MethodPost, "/api/groups", `{"id": 1, "mode": "block", "lists": [{"url": "http://example.com", "format": "yaml"}]}`, http.StatusBadRequest},
+		{http.MethodPost, "/api/groups/1/domains", `{"type": "glob", "domain": "example.com"}`, http.StatusBadRequest},
+		{http.MethodPost, "/api/groups/1/domains", `{"type": "regex", "domain": "^(example.com$"}`, http.StatusBadRequest},
+		{http.MethodPost, "/api/groups/1/domains", `{"type": "plaintext", "domain": "example.com"}`, http.StatusNotFound},
+	} {
+		req, err := http.NewRequest(tc.method, server.URL+tc.path, strings.NewReader(tc.body))
+		if err != nil {
+			t.Fatalf("http.NewRequest() returns error: %v", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s returns error: %v", tc.method, tc.path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Fatalf("%s %s status = %d, want \"%d\"", tc.method, tc.path, resp.StatusCode, tc.status)
+		}
+	}
+}
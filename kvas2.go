@@ -5,13 +5,17 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
+	"net/netip"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"kvas2-go/dns-proxy"
 	"kvas2-go/models"
 	"kvas2-go/netfilter-helper"
+	"kvas2-go/prefix-database"
 
 	"github.com/rs/zerolog/log"
 	"github.com/vishvananda/netlink"
@@ -19,18 +23,70 @@ import (
 )
 
 var (
-	ErrAlreadyRunning  = errors.New("already running")
-	ErrGroupIDConflict = errors.New("group id conflict")
+	ErrAlreadyRunning   = errors.New("already running")
+	ErrGroupIDConflict  = errors.New("group id conflict")
+	ErrGroupNotFound    = errors.New("group not found")
+	ErrDomainIDConflict = errors.New("domain id conflict")
+	ErrDomainNotFound   = errors.New("domain not found")
 )
 
+// isValidationError reports whether err is caused by invalid group, domain or
+// client settings
+func isValidationError(err error) bool {
+	for _, target := range []error{
+		models.ErrGroupInterfaceMissing,
+		models.ErrUnknownGroupMode,
+		models.ErrUnknownBlockResponse,
+		models.ErrListURLMissing,
+		models.ErrUnknownListFormat,
+		models.ErrInvalidClient,
+		models.ErrGroupClientsMissing,
+		models.ErrInvalidGateway,
+		models.ErrUnknownHealthCheck,
+		models.ErrInvalidHealthCheck,
+		models.ErrUnknownDomainType,
+		models.ErrEmptyDomain,
+		models.ErrInvalidNetwork,
+		models.ErrInvalidASN,
+		models.ErrInvalidCountry,
+		models.ErrInvalidRegex,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
 type Config struct {
-	MinimalTTL             time.Duration
-	ChainPrefix            string
-	IpSetPrefix            string
-	LinkName               string
-	TargetDNSServerAddress string
-	ListenPort             uint16
-	UseSoftwareRouting     bool
+	MinimalTTL             time.Duration `json:"minimalTTL"`
+	ChainPrefix            string        `json:"chainPrefix"`
+	IpSetPrefix            string        `json:"ipsetPrefix"`
+	LinkName               string        `json:"linkName"`
+	TargetDNSServerAddress string        `json:"targetDNSServerAddress"`
+	UpstreamDNSServers     []string      `json:"upstreamDNSServers"`
+	UpstreamStrategy       string        `json:"upstreamStrategy"`
+	CacheSize              int           `json:"cacheSize"`
+	DNSWorkers             int           `json:"dnsWorkers"`
+	DNSQueueSize           int           `json:"dnsQueueSize"`
+	ClientRateLimit        float64       `json:"clientRateLimit"`
+	ClientRateBurst        int           `json:"clientRateBurst"`
+	// StaticRecords maps names to addresses answered by the proxy itself
+	StaticRecords       map[string][]string `json:"staticRecords,omitempty"`
+	ListenPort          uint16              `json:"listenPort"`
+	UseSoftwareRouting  bool                `json:"useSoftwareRouting"`
+	HTTPAddress         string              `json:"httpAddress"`
+	RecordsPath         string              `json:"recordsPath"`
+	RecordsSaveInterval time.Duration       `json:"recordsSaveInterval"`
+	// ListsRefreshInterval is a period of group lists refresh
+	ListsRefreshInterval time.Duration `json:"listsRefreshInterval"`
+	// ASNDatabase is a path of CAIDA pfx2as dump used by "asn" rules
+	ASNDatabase string `json:"asnDatabase,omitempty"`
+	// CountryDatabase is a path of RIR delegated statistics used by "geoip"
+	// rules
+	CountryDatabase string `json:"countryDatabase,omitempty"`
+	// DatabaseCheckInterval is a period of database files modification check
+	DatabaseCheckInterval time.Duration `json:"databaseCheckInterval"`
 }
 
 type App struct {
@@ -44,9 +100,16 @@ type App struct {
 
 	Link netlink.Link
 
-	isRunning     bool
-	dnsOverrider4 *netfilterHelper.PortRemap
-	dnsOverrider6 *netfilterHelper.PortRemap
+	// mutex guards Groups and the domain lists of every group
+	mutex sync.RWMutex
+
+	isRunning      bool
+	dnsOverrider4  *netfilterHelper.PortRemap
+	dnsOverrider6  *netfilterHelper.PortRemap
+	listsRefresh   chan struct{}
+	prefixesReload chan struct{}
+	prefixes       *prefixDatabase.Database
+	neighbors      neighborCache
 }
 
 func (a *App) handleLink(event netlink.LinkUpdate) {
@@ -57,16 +120,6 @@ func (a *App) handleLink(event netlink.LinkUpdate) {
 			Str("operstatestr", event.Attrs().OperState.String()).
 			Int("operstate", int(event.Attrs().OperState)).
 			Msg("interface change")
-		if event.Attrs().OperState != netlink.OperDown {
-			for _, group := range a.Groups {
-				if group.Interface == event.Link.Attrs().Name {
-					err := group.ifaceToIPSet.IfaceHandle()
-					if err != nil {
-						log.Error().Int("group", group.ID).Err(err).Msg("error while handling interface up")
-					}
-				}
-			}
-		}
 	case 0xFFFFFFFF:
 		switch event.Header.Type {
 		case 16:
@@ -81,6 +134,37 @@ func (a *App) handleLink(event netlink.LinkUpdate) {
 				Msg("interface del")
 		}
 	}
+
+	ifaceName := event.Link.Attrs().Name
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for _, group := range a.Groups {
+		if !group.usesInterface(ifaceName) {
+			continue
+		}
+
+		// Group fails over to the next interface or comes back to the
+		// preferred one
+		changed, err := group.updateInterfaces()
+		if err != nil {
+			log.Error().Int("group", group.ID).Err(err).Msg("error while switching interfaces")
+		}
+
+		// Routes of the interface are lost while it is down
+		if changed || event.Change != 0x00000001 || event.Attrs().OperState == netlink.OperDown || !group.Enabled {
+			continue
+		}
+		err = group.ifaceToIPSet.IfaceHandle()
+		if err != nil {
+			log.Error().Int("group", group.ID).Err(err).Msg("error while handling interface up")
+		}
+		if group.ifaceToIPSet6.Enabled {
+			err = group.ifaceToIPSet6.IfaceHandle()
+			if err != nil {
+				log.Error().Int("group", group.ID).Err(err).Msg("error while handling interface up (IPv6)")
+			}
+		}
+	}
 }
 
 func (a *App) listen(ctx context.Context) (err error) {
@@ -89,6 +173,30 @@ func (a *App) listen(ctx context.Context) (err error) {
 	newCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	// Restore routing of already known addresses before new DNS responses come
+	a.syncGroups()
+
+	if a.Config.RecordsPath != "" {
+		defer a.saveRecords()
+		if a.Config.RecordsSaveInterval > 0 {
+			go func() {
+				ticker := time.NewTicker(a.Config.RecordsSaveInterval)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-ticker.C:
+						a.saveRecords()
+					case <-newCtx.Done():
+						return
+					}
+				}
+			}()
+		}
+	}
+
+	go a.runListsRefresh(newCtx)
+	go a.runPrefixDatabaseReload(newCtx)
+
 	go func() {
 		err := a.DNSProxy.Listen(newCtx)
 		if err != nil {
@@ -121,20 +229,37 @@ func (a *App) listen(ctx context.Context) (err error) {
 		_ = a.dnsOverrider6.Disable()
 	}()
 
-	for _, group := range a.Groups {
-		err = group.Enable()
-		if err != nil {
-			return fmt.Errorf("failed to enable group: %w", err)
-		}
+	err = a.enableGroups()
+	if err != nil {
+		return err
 	}
 	defer func() {
+		a.mutex.Lock()
+		defer a.mutex.Unlock()
 		for _, group := range a.Groups {
 			// TODO: Handle error
 			_ = group.Disable()
 		}
 	}()
 
-	socketPath := "/opt/var/run/kvas2-go.sock"
+	if a.Config.HTTPAddress != "" {
+		httpServer := &http.Server{
+			Addr:    a.Config.HTTPAddress,
+			Handler: a.httpHandler(),
+		}
+		go func() {
+			err := httpServer.ListenAndServe()
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				errChan <- fmt.Errorf("failed to serve HTTP API: %w", err)
+			}
+		}()
+		defer func() {
+			// TODO: Handle error
+			_ = httpServer.Close()
+		}()
+	}
+
+	socketPath := ControlSocketPath
 	err = os.Remove(socketPath)
 	if err != nil && !errors.Is(err, os.ErrNotExist) {
 		return fmt.Errorf("failed to remove existed UNIX socket: %w", err)
@@ -159,37 +284,7 @@ func (a *App) listen(ctx context.Context) (err error) {
 				break
 			}
 
-			go func(conn net.Conn) {
-				defer func() {
-					// TODO: Handle error
-					_ = conn.Close()
-				}()
-
-				buf := make([]byte, 1024)
-				n, err := conn.Read(buf)
-				if err != nil {
-					return
-				}
-
-				args := strings.Split(string(buf[:n]), ":")
-				if len(args) == 3 && args[0] == "netfilter.d" {
-					log.Debug().Str("table", args[2]).Msg("netfilter.d event")
-					if a.dnsOverrider4.Enabled {
-						err := a.dnsOverrider4.PutIPTable(args[2])
-						if err != nil {
-							log.Error().Err(err).Msg("error while fixing iptables after netfilter.d")
-						}
-					}
-					for _, group := range a.Groups {
-						if group.ifaceToIPSet.Enabled {
-							err := group.ifaceToIPSet.PutIPTable(args[2])
-							if err != nil {
-								log.Error().Err(err).Msg("error while fixing iptables after netfilter.d")
-							}
-						}
-					}
-				}
-			}(conn)
+			go a.handleControlConnection(conn)
 		}
 	}()
 
@@ -216,12 +311,18 @@ func (a *App) listen(ctx context.Context) (err error) {
 }
 
 func (a *App) Listen(ctx context.Context) (err error) {
+	// isRunning is read by group changes holding the lock
+	a.mutex.Lock()
 	if a.isRunning {
+		a.mutex.Unlock()
 		return ErrAlreadyRunning
 	}
 	a.isRunning = true
+	a.mutex.Unlock()
 	defer func() {
+		a.mutex.Lock()
 		a.isRunning = false
+		a.mutex.Unlock()
 	}()
 
 	defer func() {
@@ -244,30 +345,394 @@ func (a *App) Listen(ctx context.Context) (err error) {
 	return err
 }
 
+// Close releases DNS upstreams of the application and its groups. App
+// can't be used after that.
+func (a *App) Close() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	var errs []error
+	for _, group := range a.Groups {
+		err := group.closeUpstreams()
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	err := a.DNSProxy.Close()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("failed to close upstreams: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+func (a *App) saveRecords() {
+	err := a.Records.Save(a.Config.RecordsPath)
+	if err != nil {
+		log.Error().Str("path", a.Config.RecordsPath).Err(err).Msg("failed to save records")
+	}
+}
+
+func (a *App) syncGroups() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for _, group := range a.Groups {
+		err := a.SyncGroup(group)
+		if err != nil {
+			log.Error().Int("group", group.ID).Err(err).Msg("failed to sync group")
+		}
+	}
+}
+
+func (a *App) enableGroups() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for _, group := range a.Groups {
+		err := group.Enable()
+		if err != nil {
+			return fmt.Errorf("failed to enable group: %w", err)
+		}
+	}
+
+	return nil
+}
+
 func (a *App) AddGroup(group *models.Group) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.addGroup(group)
+}
+
+func (a *App) groupUpstreams(group *models.Group) (*dnsProxy.UpstreamPool, error) {
+	if len(group.DNSServers) == 0 {
+		return nil, nil
+	}
+	upstreams, err := dnsProxy.NewUpstreamPool(a.Config.UpstreamStrategy, group.DNSServers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize group upstreams: %w", err)
+	}
+	return upstreams, nil
+}
+
+func (a *App) addGroup(group *models.Group) error {
 	if _, exists := a.Groups[group.ID]; exists {
 		return ErrGroupIDConflict
 	}
 
+	upstreams, err := a.groupUpstreams(group)
+	if err != nil {
+		return err
+	}
+
+	for _, domain := range group.Domains {
+		domain.Group = group
+	}
+
 	ipsetName := fmt.Sprintf("%s%d", a.Config.IpSetPrefix, group.ID)
 	ipset, err := a.NetfilterHelper4.IPSet(ipsetName)
 	if err != nil {
+		if upstreams != nil {
+			_ = upstreams.Close()
+		}
 		return fmt.Errorf("failed to initialize ipset: %w", err)
 	}
 
+	ipset6Name := fmt.Sprintf("%s%d_6", a.Config.IpSetPrefix, group.ID)
+	ipset6, err := a.NetfilterHelper6.IPSet(ipset6Name)
+	if err != nil {
+		// TODO: Handle error
+		_ = ipset.Destroy()
+		if upstreams != nil {
+			_ = upstreams.Close()
+		}
+		return fmt.Errorf("failed to initialize ipset (IPv6): %w", err)
+	}
+
+	chainName := fmt.Sprintf("%sR_%d", a.Config.ChainPrefix, group.ID)
 	grp := &Group{
-		Group:        group,
-		iptables:     a.NetfilterHelper4.IPTables,
-		ipset:        ipset,
-		ifaceToIPSet: a.NetfilterHelper4.IfaceToIPSet(fmt.Sprintf("%sR_%d", a.Config.ChainPrefix, group.ID), group.Interface, ipsetName, false),
+		Group:         group,
+		upstreams:     upstreams,
+		iptables:      a.NetfilterHelper4.IPTables,
+		ipset:         ipset,
+		ipset6:        ipset6,
+		ifaceToIPSet:  a.NetfilterHelper4.IfaceToIPSet(chainName, nil, ipsetName, false),
+		ifaceToIPSet6: a.NetfilterHelper6.IfaceToIPSet(chainName, nil, ipset6Name, false),
+		prefixes:      a.prefixes,
+		listCacheDir:  a.listCacheDir(),
+	}
+	grp.onHealthChange = a.handleHealthChange
+	grp.applyRouting()
+	grp.setLists(group.Lists)
+
+	err = a.initClientSets(grp)
+	if err == nil {
+		grp.parseClients()
+		grp.applyClientFilter()
+		err = grp.syncClients()
+	}
+	if err == nil {
+		err = a.SyncGroup(grp)
+	}
+	if err == nil && a.isRunning {
+		err = grp.Enable()
+		if err != nil {
+			err = fmt.Errorf("failed to enable group: %w", err)
+		}
+	}
+	if err != nil {
+		// TODO: Handle error
+		_ = grp.Destroy()
+		return err
 	}
+
 	a.Groups[group.ID] = grp
+	if len(grp.lists) != 0 {
+		a.requestListsRefresh()
+	}
+	return nil
+}
+
+// initClientSets creates client sets of the group. MAC set is shared by IPv4
+// and IPv6 routing.
+func (a *App) initClientSets(group *Group) error {
+	var err error
+
+	clientSetName := fmt.Sprintf("%s%d_c", a.Config.IpSetPrefix, group.ID)
+	group.clientSet, err = a.NetfilterHelper4.ClientIPSet(clientSetName)
+	if err != nil {
+		return fmt.Errorf("failed to initialize client ipset: %w", err)
+	}
+
+	clientSet6Name := fmt.Sprintf("%s%d_c6", a.Config.IpSetPrefix, group.ID)
+	group.clientSet6, err = a.NetfilterHelper6.ClientIPSet(clientSet6Name)
+	if err != nil {
+		return fmt.Errorf("failed to initialize client ipset (IPv6): %w", err)
+	}
+
+	macSetName := fmt.Sprintf("%s%d_m", a.Config.IpSetPrefix, group.ID)
+	group.macSet, err = a.NetfilterHelper4.MACSet(macSetName)
+	if err != nil {
+		return fmt.Errorf("failed to initialize MAC ipset: %w", err)
+	}
+
+	group.ifaceToIPSet.ClientIPSetName = clientSetName
+	group.ifaceToIPSet.ClientMACSetName = macSetName
+	group.ifaceToIPSet6.ClientIPSetName = clientSet6Name
+	group.ifaceToIPSet6.ClientMACSetName = macSetName
+	return nil
+}
+
+func (a *App) RemoveGroup(id int) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.removeGroup(id)
+}
+
+func (a *App) removeGroup(id int) error {
+	group, exists := a.Groups[id]
+	if !exists {
+		return ErrGroupNotFound
+	}
+
+	delete(a.Groups, id)
+
+	errs := group.Destroy()
+	if errs != nil {
+		return fmt.Errorf("failed to destroy group: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+func (a *App) UpdateGroup(group *models.Group) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	grp, exists := a.Groups[group.ID]
+	if !exists {
+		return ErrGroupNotFound
+	}
+
+	for _, domain := range group.Domains {
+		domain.Group = group
+	}
+
+	upstreams, err := a.groupUpstreams(group)
+	if err != nil {
+		return err
+	}
+
+	errs := grp.Update(group, upstreams)
+	if errs != nil {
+		return fmt.Errorf("failed to update group: %w", errors.Join(errs...))
+	}
+
+	if len(grp.lists) != 0 {
+		a.requestListsRefresh()
+	}
+
+	// Group may be switched from block to route mode
+	if a.isRunning && !grp.Enabled {
+		err = grp.Enable()
+		if err != nil {
+			return fmt.Errorf("failed to enable group: %w", err)
+		}
+	}
+
 	return a.SyncGroup(grp)
 }
 
+// GetGroup returns group by ID. Returned group must not be modified directly,
+// use App methods instead.
+func (a *App) GetGroup(id int) (*Group, error) {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	group, exists := a.Groups[id]
+	if !exists {
+		return nil, ErrGroupNotFound
+	}
+	return group, nil
+}
+
+func (a *App) AddDomain(groupID int, domain *models.Domain) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	group, exists := a.Groups[groupID]
+	if !exists {
+		return ErrGroupNotFound
+	}
+
+	maxID := 0
+	for _, d := range group.Domains {
+		if domain.ID != 0 && d.ID == domain.ID {
+			return ErrDomainIDConflict
+		}
+		if d.ID > maxID {
+			maxID = d.ID
+		}
+	}
+	if domain.ID == 0 {
+		domain.ID = maxID + 1
+	}
+
+	domain.Group = group.Group
+	group.Domains = append(group.Domains, domain)
+	return a.SyncGroup(group)
+}
+
+// ImportDomains appends domains to the group with new IDs. Domains already
+// present in the group are skipped. Returns number of added domains.
+func (a *App) ImportDomains(groupID int, domains []*models.Domain) (int, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	group, exists := a.Groups[groupID]
+	if !exists {
+		return 0, ErrGroupNotFound
+	}
+
+	maxID := 0
+	known := make(map[string]struct{}, len(group.Domains))
+	for _, d := range group.Domains {
+		if d.ID > maxID {
+			maxID = d.ID
+		}
+		known[d.Type+":"+d.Domain] = struct{}{}
+	}
+
+	added := 0
+	for _, domain := range domains {
+		if _, exists := known[domain.Type+":"+domain.Domain]; exists {
+			continue
+		}
+		known[domain.Type+":"+domain.Domain] = struct{}{}
+
+		maxID++
+		domain.ID = maxID
+		domain.Group = group.Group
+		group.Domains = append(group.Domains, domain)
+		added++
+	}
+
+	return added, a.SyncGroup(group)
+}
+
+func (a *App) UpdateDomain(groupID int, domain *models.Domain) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	group, exists := a.Groups[groupID]
+	if !exists {
+		return ErrGroupNotFound
+	}
+
+	for i, d := range group.Domains {
+		if d.ID == domain.ID {
+			domain.Group = group.Group
+			group.Domains[i] = domain
+			return a.SyncGroup(group)
+		}
+	}
+
+	return ErrDomainNotFound
+}
+
+func (a *App) SetDomainEnabled(groupID int, domainID int, enable bool) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	group, exists := a.Groups[groupID]
+	if !exists {
+		return ErrGroupNotFound
+	}
+
+	for _, d := range group.Domains {
+		if d.ID == domainID {
+			d.Enable = enable
+			return a.SyncGroup(group)
+		}
+	}
+
+	return ErrDomainNotFound
+}
+
+func (a *App) RemoveDomain(groupID int, domainID int) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	group, exists := a.Groups[groupID]
+	if !exists {
+		return ErrGroupNotFound
+	}
+
+	for i, d := range group.Domains {
+		if d.ID == domainID {
+			group.Domains = append(group.Domains[:i], group.Domains[i+1:]...)
+			return a.SyncGroup(group)
+		}
+	}
+
+	return ErrDomainNotFound
+}
+
+// SyncGroup recalculates group ipset content from known records, static
+// networks and prefixes of "asn" and "geoip" rules. Prefixes which are not
+// loaded yet are loaded in background and the group is synced again after
+// that. Caller must hold App mutex if the App is shared between goroutines.
 func (a *App) SyncGroup(group *Group) error {
-	processedDomains := make(map[string]struct{})
+	a.scheduleMissingPrefixes(group)
+	return a.syncGroup(group)
+}
+
+func (a *App) syncGroup(group *Group) error {
 	newIpsetAddressesMap := make(map[string]time.Duration)
+	newIpset6AddressesMap := make(map[string]time.Duration)
+	newIpsetNetworksMap := make(map[string]*net.IPNet)
+	newIpset6NetworksMap := make(map[string]*net.IPNet)
 	now := time.Now()
 
 	oldIpsetAddresses, err := group.ListIPv4()
@@ -275,55 +740,115 @@ func (a *App) SyncGroup(group *Group) error {
 		return fmt.Errorf("failed to get old ipset list: %w", err)
 	}
 
+	oldIpset6Addresses, err := group.ListIPv6()
+	if err != nil {
+		return fmt.Errorf("failed to get old ipset list (IPv6): %w", err)
+	}
+
+	oldIpsetNetworks, err := group.ListNetIPv4()
+	if err != nil {
+		return fmt.Errorf("failed to get old ipset networks: %w", err)
+	}
+
+	oldIpset6Networks, err := group.ListNetIPv6()
+	if err != nil {
+		return fmt.Errorf("failed to get old ipset networks (IPv6): %w", err)
+	}
+
+	group.pruneLearnedDomains(now)
 	knownDomains := a.Records.ListKnownDomains()
-	for _, domain := range group.Domains {
-		if !domain.IsEnabled() {
+	for _, domainName := range knownDomains {
+		// Block groups only keep their ipsets empty
+		if group.IsBlock() || !group.IsMatch(domainName) {
+			continue
+		}
+		// Scoped group takes only domains queried by its clients
+		if group.isScoped() && !group.isLearnedDomain(domainName) {
 			continue
 		}
 
-		for _, domainName := range knownDomains {
-			if !domain.IsMatch(domainName) {
-				continue
+		for _, address := range a.Records.GetARecords(domainName) {
+			// Zero TTL would make the entry permanent
+			ttl := max(address.Deadline.Sub(now), time.Second)
+			if oldTTL, ok := newIpsetAddressesMap[string(address.Address)]; !ok || ttl > oldTTL {
+				newIpsetAddressesMap[string(address.Address)] = ttl
 			}
+		}
 
-			cnames := a.Records.GetCNameRecords(domainName, true)
-			if len(cnames) == 0 {
-				continue
-			}
-			for _, cname := range cnames {
-				processedDomains[cname] = struct{}{}
+		for _, address := range a.Records.GetAAAARecords(domainName) {
+			ttl := max(address.Deadline.Sub(now), time.Second)
+			if oldTTL, ok := newIpset6AddressesMap[string(address.Address)]; !ok || ttl > oldTTL {
+				newIpset6AddressesMap[string(address.Address)] = ttl
 			}
+		}
+	}
 
-			addresses := a.Records.GetARecords(domainName)
-			for _, address := range addresses {
-				ttl := now.Sub(address.Deadline)
-				if oldTTL, ok := newIpsetAddressesMap[string(address.Address)]; !ok || ttl > oldTTL {
-					newIpsetAddressesMap[string(address.Address)] = ttl
-				}
+	staticAddresses := make(map[string]struct{})
+	if !group.IsBlock() {
+		for _, network := range group.Networks() {
+			ones, bits := network.Mask.Size()
+			switch {
+			// Host prefixes are stored as permanent addresses
+			case ones == bits && bits == 32:
+				newIpsetAddressesMap[string(network.IP)] = 0
+				staticAddresses[string(network.IP)] = struct{}{}
+			case ones == bits:
+				newIpset6AddressesMap[string(network.IP)] = 0
+				staticAddresses[string(network.IP)] = struct{}{}
+			case bits == 32:
+				newIpsetNetworksMap[network.String()] = network
+			default:
+				newIpset6NetworksMap[network.String()] = network
 			}
 		}
 	}
 
-	for addr, ttl := range newIpsetAddressesMap {
-		if _, exists := oldIpsetAddresses[addr]; exists {
+	group.staticAddresses = staticAddresses
+
+	// Default capacity is exceeded easily by "asn" and "geoip" rules
+	err = group.reserveIPSets(len(newIpsetAddressesMap)+len(newIpsetNetworksMap), len(newIpset6AddressesMap)+len(newIpset6NetworksMap))
+	if err != nil {
+		return err
+	}
+
+	syncIPSet(oldIpsetAddresses, newIpsetAddressesMap, group.AddIPv4, group.DelIPv4)
+	syncIPSet(oldIpset6Addresses, newIpset6AddressesMap, group.AddIPv6, group.DelIPv6)
+	syncIPSetNetworks(oldIpsetNetworks, newIpsetNetworksMap, group.AddNetIPv4, group.DelNetIPv4)
+	syncIPSetNetworks(oldIpset6Networks, newIpset6NetworksMap, group.AddNetIPv6, group.DelNetIPv6)
+
+	return nil
+}
+
+func isPermanent(timeout *uint32) bool {
+	return timeout != nil && *timeout == 0
+}
+
+func syncIPSet(oldAddresses map[string]*uint32, newAddresses map[string]time.Duration, add func(net.IP, time.Duration) error, del func(net.IP) error) {
+	for addr, ttl := range newAddresses {
+		// Entry is replaced when it turns from learned to static or back
+		if timeout, exists := oldAddresses[addr]; exists && isPermanent(timeout) == (ttl == 0) {
 			continue
 		}
 		ip := net.IP(addr)
-		err = group.AddIPv4(ip, ttl)
+		err := add(ip, ttl)
 		if err != nil {
 			log.Error().
 				Str("address", ip.String()).
 				Err(err).
 				Msg("failed to add address")
+		} else {
+			log.Trace().
+				Str("address", ip.String()).
+				Msg("add address")
 		}
 	}
 
-	for addr := range oldIpsetAddresses {
-		if _, exists := newIpsetAddressesMap[addr]; exists {
+	for addr := range oldAddresses {
+		if _, exists := newAddresses[addr]; exists {
 			continue
 		}
 		ip := net.IP(addr)
-		err = group.DelIPv4(ip)
+		err := del(ip)
 		if err != nil {
 			log.Error().
 				Str("address", ip.String()).
@@ -332,12 +857,48 @@ func (a *App) SyncGroup(group *Group) error {
 		} else {
 			log.Trace().
 				Str("address", ip.String()).
+				Msg("delete address")
+		}
+	}
+}
+
+func syncIPSetNetworks(oldNetworks map[string]*uint32, newNetworks map[string]*net.IPNet, add func(*net.IPNet) error, del func(*net.IPNet) error) {
+	for key, network := range newNetworks {
+		if timeout, exists := oldNetworks[key]; exists && isPermanent(timeout) {
+			continue
+		}
+		err := add(network)
+		if err != nil {
+			log.Error().
+				Str("network", key).
 				Err(err).
-				Msg("add address")
+				Msg("failed to add network")
+		} else {
+			log.Trace().
+				Str("network", key).
+				Msg("add network")
 		}
 	}
 
-	return nil
+	for key := range oldNetworks {
+		if _, exists := newNetworks[key]; exists {
+			continue
+		}
+		_, network, err := net.ParseCIDR(key)
+		if err == nil {
+			err = del(network)
+		}
+		if err != nil {
+			log.Error().
+				Str("network", key).
+				Err(err).
+				Msg("failed to delete network")
+		} else {
+			log.Trace().
+				Str("network", key).
+				Msg("delete network")
+		}
+	}
 }
 
 func (a *App) ListInterfaces() ([]net.Interface, error) {
@@ -359,7 +920,7 @@ func (a *App) ListInterfaces() ([]net.Interface, error) {
 	return interfaceNames, nil
 }
 
-func (a *App) processARecord(aRecord dnsProxy.Address) {
+func (a *App) processARecord(client netip.Addr, aRecord dnsProxy.Address) {
 	log.Trace().
 		Str("name", aRecord.Name.String()).
 		Str("address", aRecord.Address.String()).
@@ -372,39 +933,60 @@ func (a *App) processARecord(aRecord dnsProxy.Address) {
 	}
 
 	a.Records.AddARecord(aRecord.Name.String(), aRecord.Address, ttlDuration)
+	a.addAddressToGroups(client, aRecord.Name.String(), aRecord.Address, ttlDuration)
+}
+
+func (a *App) processAAAARecord(client netip.Addr, aaaaRecord dnsProxy.IPv6Address) {
+	log.Trace().
+		Str("name", aaaaRecord.Name.String()).
+		Str("address", aaaaRecord.Address.String()).
+		Int("ttl", int(aaaaRecord.TTL)).
+		Msg("processing aaaa record")
+
+	ttlDuration := time.Duration(aaaaRecord.TTL) * time.Second
+	if ttlDuration < a.Config.MinimalTTL {
+		ttlDuration = a.Config.MinimalTTL
+	}
+
+	a.Records.AddAAAARecord(aaaaRecord.Name.String(), aaaaRecord.Address, ttlDuration)
+	a.addAddressToGroups(client, aaaaRecord.Name.String(), aaaaRecord.Address, ttlDuration)
+}
 
-	names := a.Records.GetCNameRecords(aRecord.Name.String(), true)
+// addAddressToGroups adds address resolved by the client to matching groups
+func (a *App) addAddressToGroups(client netip.Addr, domainName string, address net.IP, ttlDuration time.Duration) {
+	names := a.Records.GetCNameRecords(domainName, true)
+	deadline := time.Now().Add(ttlDuration)
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
 	for _, group := range a.Groups {
-	Domain:
-		for _, domain := range group.Domains {
-			if !domain.IsEnabled() {
+		if group.IsBlock() || !a.acceptsClient(group, client) {
+			continue
+		}
+		for _, name := range names {
+			if !group.IsMatch(name) {
 				continue
 			}
-			for _, name := range names {
-				if !domain.IsMatch(name) {
-					continue
-				}
-				err := group.AddIPv4(aRecord.Address, ttlDuration)
-				if err != nil {
-					log.Error().
-						Str("address", aRecord.Address.String()).
-						Err(err).
-						Msg("failed to add address")
-				} else {
-					log.Trace().
-						Str("address", aRecord.Address.String()).
-						Str("aRecordDomain", aRecord.Name.String()).
-						Str("cNameDomain", name).
-						Err(err).
-						Msg("add address")
-				}
-				break Domain
+			group.learnDomain(name, deadline)
+			err := group.AddIP(address, ttlDuration)
+			if err != nil {
+				log.Error().
+					Str("address", address.String()).
+					Err(err).
+					Msg("failed to add address")
+			} else {
+				log.Trace().
+					Str("address", address.String()).
+					Str("aRecordDomain", domainName).
+					Str("cNameDomain", name).
+					Err(err).
+					Msg("add address")
 			}
+			break
 		}
 	}
 }
 
-func (a *App) processCNameRecord(cNameRecord dnsProxy.CName) {
+func (a *App) processCNameRecord(client netip.Addr, cNameRecord dnsProxy.CName) {
 	log.Trace().
 		Str("name", cNameRecord.Name.String()).
 		Str("cname", cNameRecord.CName.String()).
@@ -421,58 +1003,108 @@ func (a *App) processCNameRecord(cNameRecord dnsProxy.CName) {
 	// TODO: Optimization
 	now := time.Now()
 	aRecords := a.Records.GetARecords(cNameRecord.Name.String())
+	aRecords = append(aRecords, a.Records.GetAAAARecords(cNameRecord.Name.String())...)
 	names := a.Records.GetCNameRecords(cNameRecord.Name.String(), true)
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
 	for _, group := range a.Groups {
-	Domain:
-		for _, domain := range group.Domains {
-			if !domain.IsEnabled() {
+		if group.IsBlock() || !a.acceptsClient(group, client) {
+			continue
+		}
+		for _, name := range names {
+			if !group.IsMatch(name) {
 				continue
 			}
-			for _, name := range names {
-				if !domain.IsMatch(name) {
-					continue
-				}
-				for _, aRecord := range aRecords {
-					err := group.AddIPv4(aRecord.Address, now.Sub(aRecord.Deadline))
-					if err != nil {
-						log.Error().
-							Str("address", aRecord.Address.String()).
-							Err(err).
-							Msg("failed to add address")
-					} else {
-						log.Trace().
-							Str("address", aRecord.Address.String()).
-							Str("cNameDomain", name).
-							Err(err).
-							Msg("add address")
-					}
+			group.learnDomain(name, now.Add(ttlDuration))
+			for _, aRecord := range aRecords {
+				err := group.AddIP(aRecord.Address, aRecord.Deadline.Sub(now))
+				if err != nil {
+					log.Error().
+						Str("address", aRecord.Address.String()).
+						Err(err).
+						Msg("failed to add address")
+				} else {
+					log.Trace().
+						Str("address", aRecord.Address.String()).
+						Str("cNameDomain", name).
+						Err(err).
+						Msg("add address")
 				}
-				continue Domain
 			}
+			break
 		}
 	}
 }
 
-func (a *App) handleRecord(rr dnsProxy.ResourceRecord) {
+// selectUpstreams returns upstreams of the group with the lowest ID which
+// domains match the name, nil if there are no such groups
+func (a *App) selectUpstreams(domainName string) *dnsProxy.UpstreamPool {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	var selected *Group
+	for _, group := range a.Groups {
+		if group.upstreams == nil || group.IsBlock() || (selected != nil && selected.ID < group.ID) {
+			continue
+		}
+		if group.IsMatch(domainName) {
+			selected = group
+		}
+	}
+
+	if selected == nil {
+		return nil
+	}
+	return selected.upstreams
+}
+
+// blockMode returns how the query of the client for the domain name must be
+// blocked. Block group with the lowest ID wins.
+func (a *App) blockMode(client netip.Addr, domainName string) dnsProxy.BlockMode {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	var selected *Group
+	for _, group := range a.Groups {
+		if !group.IsBlock() || (selected != nil && selected.ID < group.ID) {
+			continue
+		}
+		if group.IsMatch(domainName) && a.acceptsClient(group, client) {
+			selected = group
+		}
+	}
+
+	switch {
+	case selected == nil:
+		return dnsProxy.BlockNone
+	case selected.BlockResponse == models.BlockResponseNull:
+		return dnsProxy.BlockNullAddress
+	}
+	return dnsProxy.BlockNXDomain
+}
+
+func (a *App) handleRecord(client netip.Addr, rr dnsProxy.ResourceRecord) {
 	switch v := rr.(type) {
 	case dnsProxy.Address:
 		// TODO: Optimize equals domain A records
-		a.processARecord(v)
+		a.processARecord(client, v)
+	case dnsProxy.IPv6Address:
+		a.processAAAARecord(client, v)
 	case dnsProxy.CName:
-		a.processCNameRecord(v)
+		a.processCNameRecord(client, v)
 	default:
 	}
 }
 
-func (a *App) handleMessage(msg *dnsProxy.Message) {
+func (a *App) handleMessage(client netip.Addr, msg *dnsProxy.Message) {
 	for _, rr := range msg.AN {
-		a.handleRecord(rr)
+		a.handleRecord(client, rr)
 	}
 	for _, rr := range msg.NS {
-		a.handleRecord(rr)
+		a.handleRecord(client, rr)
 	}
 	for _, rr := range msg.AR {
-		a.handleRecord(rr)
+		a.handleRecord(client, rr)
 	}
 }
 
@@ -489,10 +1121,37 @@ func New(config Config) (*App, error) {
 	}
 	app.Link = link
 
-	app.DNSProxy = dnsProxy.New(app.Config.ListenPort, app.Config.TargetDNSServerAddress)
+	upstreams, err := dnsProxy.NewUpstreamPool(app.Config.UpstreamStrategy, app.Config.upstreamAddresses())
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize upstreams: %w", err)
+	}
+
+	app.DNSProxy = dnsProxy.New(app.Config.ListenPort, upstreams)
+	app.DNSProxy.UpstreamSelector = app.selectUpstreams
+	app.DNSProxy.BlockSelector = app.blockMode
+	if app.Config.CacheSize > 0 {
+		app.DNSProxy.Cache = dnsProxy.NewCache(app.Config.CacheSize)
+	}
+	if len(app.Config.StaticRecords) != 0 {
+		app.DNSProxy.StaticRecords, err = app.Config.staticRecords()
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize static records: %w", err)
+		}
+	}
+	app.DNSProxy.Workers = app.Config.DNSWorkers
+	app.DNSProxy.QueueSize = app.Config.DNSQueueSize
+	if app.Config.ClientRateLimit > 0 {
+		app.DNSProxy.RateLimiter = dnsProxy.NewRateLimiter(app.Config.ClientRateLimit, app.Config.ClientRateBurst)
+	}
 	app.DNSProxy.MsgHandler = app.handleMessage
 
 	app.Records = NewRecords()
+	if app.Config.RecordsPath != "" {
+		err = app.Records.Load(app.Config.RecordsPath)
+		if err != nil {
+			log.Warn().Str("path", app.Config.RecordsPath).Err(err).Msg("failed to load records")
+		}
+	}
 
 	nh4, err := netfilterHelper.New(false)
 	if err != nil {
@@ -515,6 +1174,10 @@ func New(config Config) (*App, error) {
 	}
 
 	app.Groups = make(map[int]*Group)
+	app.listsRefresh = make(chan struct{}, 1)
+	app.prefixesReload = make(chan struct{}, 1)
+	// Prefix database is loaded by groups referencing it
+	app.prefixes = prefixDatabase.New(app.Config.ASNDatabase, app.Config.CountryDatabase)
 
 	return app, nil
 }
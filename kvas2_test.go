@@ -0,0 +1,253 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"kvas2-go/dns-proxy"
+	"kvas2-go/models"
+
+	"github.com/vishvananda/netlink"
+)
+
+var testClient = netip.MustParseAddr("192.168.1.10")
+
+func TestAppSelectUpstreams(t *testing.T) {
+	upstreams1, _ := dnsProxy.NewUpstreamPool(dnsProxy.StrategyFailover, []string{"10.0.0.1:53"})
+	upstreams2, _ := dnsProxy.NewUpstreamPool(dnsProxy.StrategyFailover, []string{"10.0.0.2:53"})
+
+	app := &App{Groups: map[int]*Group{
+		1: {
+			Group: &models.Group{ID: 1, Domains: []*models.Domain{
+				{Type: "wildcard", Domain: "*.example.com", Enable: true},
+			}},
+			upstreams: upstreams1,
+		},
+		2: {
+			Group: &models.Group{ID: 2, Domains: []*models.Domain{
+				{Type: "wildcard", Domain: "*example.com", Enable: true},
+				{Type: "plaintext", Domain: "disabled.org", Enable: false},
+			}},
+			upstreams: upstreams2,
+		},
+		3: {
+			Group: &models.Group{ID: 3, Domains: []*models.Domain{
+				{Type: "plaintext", Domain: "example.net", Enable: true},
+			}},
+		},
+	}}
+
+	if upstreams := app.selectUpstreams("www.example.com"); upstreams != upstreams1 {
+		t.Fatalf("App.selectUpstreams(\"www.example.com\") = %v, want upstreams of group 1", upstreams)
+	}
+	if upstreams := app.selectUpstreams("example.com"); upstreams != upstreams2 {
+		t.Fatalf("App.selectUpstreams(\"example.com\") = %v, want upstreams of group 2", upstreams)
+	}
+	if upstreams := app.selectUpstreams("disabled.org"); upstreams != nil {
+		t.Fatalf("App.selectUpstreams(\"disabled.org\") = %v, want nil", upstreams)
+	}
+	if upstreams := app.selectUpstreams("example.net"); upstreams != nil {
+		t.Fatalf("App.selectUpstreams(\"example.net\") = %v, want nil", upstreams)
+	}
+}
+
+func TestAppBlockMode(t *testing.T) {
+	app := &App{Groups: map[int]*Group{
+		1: {Group: &models.Group{ID: 1, Mode: models.GroupModeBlock, BlockResponse: models.BlockResponseNull, Domains: []*models.Domain{
+			{Type: "suffix", Domain: "ads.example.com", Enable: true},
+		}}},
+		2: {Group: &models.Group{ID: 2, Mode: models.GroupModeBlock, Domains: []*models.Domain{
+			{Type: "suffix", Domain: "example.com", Enable: true},
+		}}},
+		3: {Group: &models.Group{ID: 3, Interface: "nwg0", Domains: []*models.Domain{
+			{Type: "plaintext", Domain: "example.net", Enable: true},
+		}}},
+	}}
+
+	if mode := app.blockMode(testClient, "cdn.ads.example.com"); mode != dnsProxy.BlockNullAddress {
+		t.Fatalf("App.blockMode(\"cdn.ads.example.com\") = %v, want BlockNullAddress", mode)
+	}
+	if mode := app.blockMode(testClient, "www.example.com"); mode != dnsProxy.BlockNXDomain {
+		t.Fatalf("App.blockMode(\"www.example.com\") = %v, want BlockNXDomain", mode)
+	}
+	if mode := app.blockMode(testClient, "example.net"); mode != dnsProxy.BlockNone {
+		t.Fatalf("App.blockMode(\"example.net\") = %v, want BlockNone", mode)
+	}
+}
+
+func TestAppBlockModePerClient(t *testing.T) {
+	app := &App{Groups: map[int]*Group{
+		1: {Group: &models.Group{ID: 1, Mode: models.GroupModeBlock, Clients: []string{"192.168.1.20", "192.168.2.0/24"}, Domains: []*models.Domain{
+			{Type: "suffix", Domain: "games.example.com", Enable: true},
+		}}},
+	}}
+	app.Groups[1].parseClients()
+
+	for client, want := range map[string]dnsProxy.BlockMode{
+		"192.168.1.20": dnsProxy.BlockNXDomain,
+		"192.168.2.5":  dnsProxy.BlockNXDomain,
+		"192.168.1.10": dnsProxy.BlockNone,
+	} {
+		if mode := app.blockMode(netip.MustParseAddr(client), "games.example.com"); mode != want {
+			t.Fatalf("App.blockMode(%s, \"games.example.com\") = %v, want %v", client, mode, want)
+		}
+	}
+}
+
+func TestGroupLearnedDomains(t *testing.T) {
+	app := &App{}
+	group := &Group{Group: &models.Group{ID: 1, Interface: "nwg0", ScopeDNS: true, Clients: []string{"192.168.1.20"}}}
+	group.parseClients()
+	if app.acceptsClient(group, testClient) {
+		t.Fatalf("App.acceptsClient(%s) = true for client outside of the group", testClient)
+	}
+	if !app.acceptsClient(group, netip.MustParseAddr("192.168.1.20")) {
+		t.Fatal("App.acceptsClient(192.168.1.20) = false for client of the group")
+	}
+
+	now := time.Now()
+	group.learnDomain("example.com", now.Add(time.Minute))
+	group.learnDomain("expired.com", now.Add(-time.Minute))
+	group.pruneLearnedDomains(now)
+	if !group.isLearnedDomain("example.com") || group.isLearnedDomain("expired.com") {
+		t.Fatal("Group.pruneLearnedDomains() does not keep only actual domains")
+	}
+}
+
+func TestAppAcceptsClientMAC(t *testing.T) {
+	dumps := 0
+	app := &App{}
+	app.neighbors.list = func(linkIndex, family int) ([]netlink.Neigh, error) {
+		dumps++
+		mac, _ := net.ParseMAC("aa:bb:cc:dd:ee:ff")
+		return []netlink.Neigh{{IP: net.ParseIP("192.168.1.30"), HardwareAddr: mac}}, nil
+	}
+	group := &Group{Group: &models.Group{ID: 1, Interface: "nwg0", ScopeDNS: true, Clients: []string{"AA:BB:CC:DD:EE:FF"}}}
+	group.parseClients()
+
+	for i := 0; i < 10; i++ {
+		if !app.acceptsClient(group, netip.MustParseAddr("192.168.1.30")) {
+			t.Fatal("App.acceptsClient(192.168.1.30) = false for client with the group MAC")
+		}
+		if app.acceptsClient(group, testClient) {
+			t.Fatalf("App.acceptsClient(%s) = true for unknown client", testClient)
+		}
+	}
+	if dumps != 2 {
+		t.Fatalf("neighbor table dumps = %d, want 2", dumps)
+	}
+}
+
+func TestIsPermanent(t *testing.T) {
+	zero, ttl := uint32(0), uint32(300)
+	for _, test := range []struct {
+		timeout *uint32
+		want    bool
+	}{
+		{nil, false},
+		{&zero, true},
+		{&ttl, false},
+	} {
+		if got := isPermanent(test.timeout); got != test.want {
+			t.Fatalf("isPermanent(%v) = %t, want %t", test.timeout, got, test.want)
+		}
+	}
+}
+
+func TestSyncIPSet(t *testing.T) {
+	permanent, learned := uint32(0), uint32(300)
+	address := string(net.ParseIP("10.0.0.1").To4())
+
+	for _, test := range []struct {
+		name    string
+		old     map[string]*uint32
+		new     map[string]time.Duration
+		wantAdd []time.Duration
+		wantDel int
+	}{
+		{"new learned", map[string]*uint32{}, map[string]time.Duration{address: time.Minute}, []time.Duration{time.Minute}, 0},
+		{"new static", map[string]*uint32{}, map[string]time.Duration{address: 0}, []time.Duration{0}, 0},
+		{"learned kept", map[string]*uint32{address: &learned}, map[string]time.Duration{address: time.Minute}, nil, 0},
+		{"static kept", map[string]*uint32{address: &permanent}, map[string]time.Duration{address: 0}, nil, 0},
+		{"learned to static", map[string]*uint32{address: &learned}, map[string]time.Duration{address: 0}, []time.Duration{0}, 0},
+		{"static to learned", map[string]*uint32{address: &permanent}, map[string]time.Duration{address: time.Minute}, []time.Duration{time.Minute}, 0},
+		{"removed", map[string]*uint32{address: &learned}, map[string]time.Duration{}, nil, 1},
+	} {
+		var added []time.Duration
+		deleted := 0
+		add := func(ip net.IP, ttl time.Duration) error {
+			if !ip.Equal(net.ParseIP("10.0.0.1")) {
+				t.Fatalf("%s: add(%v), want 10.0.0.1", test.name, ip)
+			}
+			added = append(added, ttl)
+			return nil
+		}
+		del := func(ip net.IP) error {
+			if !ip.Equal(net.ParseIP("10.0.0.1")) {
+				t.Fatalf("%s: del(%v), want 10.0.0.1", test.name, ip)
+			}
+			deleted++
+			return nil
+		}
+
+		syncIPSet(test.old, test.new, add, del)
+		if !slices.Equal(added, test.wantAdd) || deleted != test.wantDel {
+			t.Fatalf("%s: syncIPSet() adds %v and deletes %d, want %v and %d", test.name, added, deleted, test.wantAdd, test.wantDel)
+		}
+	}
+}
+
+func TestSyncIPSetNetworks(t *testing.T) {
+	permanent, learned := uint32(0), uint32(300)
+	_, network, _ := net.ParseCIDR("10.0.0.0/24")
+
+	for _, test := range []struct {
+		name    string
+		old     map[string]*uint32
+		new     map[string]*net.IPNet
+		wantAdd int
+		wantDel []string
+	}{
+		{"new", map[string]*uint32{}, map[string]*net.IPNet{"10.0.0.0/24": network}, 1, nil},
+		{"static kept", map[string]*uint32{"10.0.0.0/24": &permanent}, map[string]*net.IPNet{"10.0.0.0/24": network}, 0, nil},
+		// Networks are always static, entry with timeout is replaced
+		{"expiring replaced", map[string]*uint32{"10.0.0.0/24": &learned}, map[string]*net.IPNet{"10.0.0.0/24": network}, 1, nil},
+		{"removed", map[string]*uint32{"10.0.0.0/24": &permanent, "10.0.1.0/24": &permanent}, map[string]*net.IPNet{"10.0.0.0/24": network}, 0, []string{"10.0.1.0/24"}},
+	} {
+		added := 0
+		var deleted []string
+		add := func(network *net.IPNet) error {
+			added++
+			return nil
+		}
+		del := func(network *net.IPNet) error {
+			deleted = append(deleted, network.String())
+			return nil
+		}
+
+		syncIPSetNetworks(test.old, test.new, add, del)
+		if added != test.wantAdd || !slices.Equal(deleted, test.wantDel) {
+			t.Fatalf("%s: syncIPSetNetworks() adds %d and deletes %v, want %d and %v", test.name, added, deleted, test.wantAdd, test.wantDel)
+		}
+	}
+}
+
+func TestClientIndex(t *testing.T) {
+	clients := []string{"10.0.0.1/32", "AA:BB:CC:DD:EE:FF", "192.168.1.0/24"}
+	for _, test := range []struct {
+		client string
+		want   int
+	}{
+		{"10.0.0.1", 0},
+		{"aa:bb:cc:dd:ee:ff", 1},
+		{"192.168.1.0/24", 2},
+		{"10.0.0.2", -1},
+	} {
+		if got := clientIndex(clients, test.client); got != test.want {
+			t.Fatalf("clientIndex(%q) = %d, want %d", test.client, got, test.want)
+		}
+	}
+}
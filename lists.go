@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"kvas2-go/domain-list"
+	"kvas2-go/models"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	listsFetchTimeout = time.Minute
+	// listsRetryMinDelay is the first delay of failed lists refresh retry,
+	// delay doubles up to refresh interval or listsRetryMaxDelay without it
+	listsRetryMinDelay = 30 * time.Second
+	listsRetryMaxDelay = time.Hour
+)
+
+// listCacheDir returns directory of the list cache located next to the
+// records file. Cache is disabled without records file.
+func (a *App) listCacheDir() string {
+	if a.Config.RecordsPath == "" {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(a.Config.RecordsPath), "lists")
+}
+
+// listCachePath returns cache file of the list URL
+func listCachePath(dir, url string) string {
+	if dir == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(dir, hex.EncodeToString(sum[:16])+".txt")
+}
+
+// setLists replaces list sources of the group. Already fetched sources are
+// kept, so their content and cache validators survive group updates.
+func (g *Group) setLists(lists []*models.List) {
+	sources := make([]*domainList.Source, 0, len(lists))
+	for _, list := range lists {
+		var source *domainList.Source
+		for _, oldSource := range g.lists {
+			if oldSource.URL == list.URL && oldSource.Format == list.Format {
+				source = oldSource
+				break
+			}
+		}
+		if source == nil {
+			source = domainList.NewSource(list.URL, list.Format)
+			source.CachePath = listCachePath(g.listCacheDir, list.URL)
+		}
+		sources = append(sources, source)
+	}
+	g.lists = sources
+	g.collectListDomains()
+}
+
+// domainIndex matches domain names against "plaintext" and "suffix" domains
+// by map lookups, since lists may have hundreds of thousands of them. Domains
+// of other types are matched one by one.
+type domainIndex struct {
+	plaintext map[string]struct{}
+	suffixes  map[string]struct{}
+	other     []*models.Domain
+}
+
+func newDomainIndex() *domainIndex {
+	return &domainIndex{
+		plaintext: make(map[string]struct{}),
+		suffixes:  make(map[string]struct{}),
+	}
+}
+
+func (i *domainIndex) add(domain *models.Domain) {
+	if !domain.IsEnabled() {
+		return
+	}
+	switch domain.Type {
+	case "plaintext":
+		i.plaintext[domain.Domain] = struct{}{}
+	case "suffix":
+		i.suffixes[domain.Domain] = struct{}{}
+	default:
+		i.other = append(i.other, domain)
+	}
+}
+
+// size returns count of the indexed domains
+func (i *domainIndex) size() int {
+	if i == nil {
+		return 0
+	}
+	return len(i.plaintext) + len(i.suffixes) + len(i.other)
+}
+
+// isMatch reports whether domain name matches any indexed domain. Suffixes
+// are looked up for the name and every its parent domain.
+func (i *domainIndex) isMatch(domainName string) bool {
+	if i == nil {
+		return false
+	}
+	if _, exists := i.plaintext[domainName]; exists {
+		return true
+	}
+	for name := domainName; name != ""; {
+		if _, exists := i.suffixes[name]; exists {
+			return true
+		}
+		dot := strings.IndexByte(name, '.')
+		if dot < 0 {
+			break
+		}
+		name = name[dot+1:]
+	}
+	for _, domain := range i.other {
+		if domain.IsMatch(domainName) {
+			return true
+		}
+	}
+	return false
+}
+
+// collectListDomains rebuilds index of domains of the group loaded from lists
+func (g *Group) collectListDomains() {
+	index := newDomainIndex()
+	for _, source := range g.lists {
+		for _, domain := range source.Domains() {
+			domain.Group = g.Group
+			index.add(domain)
+		}
+	}
+	g.listIndex = index
+}
+
+// requestListsRefresh schedules refresh of all lists
+func (a *App) requestListsRefresh() {
+	select {
+	case a.listsRefresh <- struct{}{}:
+	default:
+	}
+}
+
+// nextListsRetryDelay returns delay of the next retry after failed refresh
+func nextListsRetryDelay(delay, interval time.Duration) time.Duration {
+	maxDelay := listsRetryMaxDelay
+	if interval > 0 {
+		maxDelay = interval
+	}
+	if delay == 0 {
+		return min(listsRetryMinDelay, maxDelay)
+	}
+	return min(delay*2, maxDelay)
+}
+
+func (a *App) runListsRefresh(ctx context.Context) {
+	var tick <-chan time.Time
+	if a.Config.ListsRefreshInterval > 0 {
+		ticker := time.NewTicker(a.Config.ListsRefreshInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	// Failed sources are retried with backoff until refresh succeeds
+	var retryTimer *time.Timer
+	var retry <-chan time.Time
+	retryDelay := time.Duration(0)
+	defer func() {
+		if retryTimer != nil {
+			retryTimer.Stop()
+		}
+	}()
+	refresh := func() {
+		if retryTimer != nil {
+			retryTimer.Stop()
+		}
+		retry = nil
+		if a.refreshLists(ctx) {
+			retryDelay = 0
+			return
+		}
+		retryDelay = nextListsRetryDelay(retryDelay, a.Config.ListsRefreshInterval)
+		retryTimer = time.NewTimer(retryDelay)
+		retry = retryTimer.C
+		log.Info().Dur("delay", retryDelay).Msg("failed lists are retried later")
+	}
+
+	refresh()
+	for {
+		select {
+		case <-tick:
+			refresh()
+		case <-retry:
+			refresh()
+		case <-a.listsRefresh:
+			refresh()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// refreshLists fetches lists of all groups and syncs groups whose lists
+// changed. Lists are fetched without holding the App mutex. Returns false
+// when any list fails to fetch.
+func (a *App) refreshLists(ctx context.Context) bool {
+	type groupLists struct {
+		groupID int
+		sources []*domainList.Source
+	}
+
+	a.mutex.RLock()
+	jobs := make([]groupLists, 0, len(a.Groups))
+	cachePaths := make(map[string]struct{})
+	for _, group := range a.Groups {
+		if len(group.lists) != 0 {
+			jobs = append(jobs, groupLists{groupID: group.ID, sources: group.lists})
+		}
+		for _, source := range group.lists {
+			cachePaths[source.CachePath] = struct{}{}
+		}
+	}
+	a.mutex.RUnlock()
+	a.pruneListCache(cachePaths)
+
+	client := &http.Client{Timeout: listsFetchTimeout}
+	ok := true
+	for _, job := range jobs {
+		changed := false
+		for _, source := range job.sources {
+			sourceChanged, err := source.Fetch(ctx, client)
+			if err != nil {
+				log.Error().Int("group", job.groupID).Str("url", source.URL).Err(err).Msg("failed to fetch list")
+				ok = false
+			}
+			if sourceChanged {
+				log.Info().Int("group", job.groupID).Str("url", source.URL).Int("domains", len(source.Domains())).Msg("list updated")
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+
+		a.mutex.Lock()
+		group, exists := a.Groups[job.groupID]
+		if exists {
+			group.collectListDomains()
+			err := a.SyncGroup(group)
+			if err != nil {
+				log.Error().Int("group", group.ID).Err(err).Msg("failed to sync group")
+			}
+		}
+		a.mutex.Unlock()
+	}
+	return ok
+}
+
+// pruneListCache removes cache files of lists which are not used anymore
+func (a *App) pruneListCache(cachePaths map[string]struct{}) {
+	dir := a.listCacheDir()
+	if dir == "" {
+		return
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if _, used := cachePaths[path]; used || filepath.Ext(path) != ".txt" {
+			continue
+		}
+		err = os.Remove(path)
+		if err != nil {
+			log.Warn().Str("path", path).Err(err).Msg("failed to remove list cache")
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"kvas2-go/models"
+)
+
+func TestGroupSetLists(t *testing.T) {
+	group := &Group{Group: &models.Group{ID: 1}}
+	group.setLists([]*models.List{{URL: "http://example.com/list.txt", Format: "plain"}})
+	source := group.lists[0]
+
+	group.setLists([]*models.List{
+		{URL: "http://example.com/list.txt", Format: "plain"},
+		{URL: "/opt/etc/kvas2-go/hosts", Format: "hosts"},
+	})
+	if len(group.lists) != 2 || group.lists[0] != source {
+		t.Fatal("Group.setLists() does not keep already known source")
+	}
+
+	group.setLists(nil)
+	if len(group.lists) != 0 || group.listIndex.size() != 0 {
+		t.Fatalf("Group.setLists(nil) keeps %d sources and %d domains", len(group.lists), group.listIndex.size())
+	}
+}
+
+func TestGroupIsMatchListDomains(t *testing.T) {
+	index := newDomainIndex()
+	for _, domain := range []*models.Domain{
+		{Type: "suffix", Domain: "example.com", Enable: true},
+		{Type: "plaintext", Domain: "ads.example.org", Enable: true},
+		{Type: "wildcard", Domain: "*.example.net", Enable: true},
+		{Type: "suffix", Domain: "disabled.org", Enable: false},
+	} {
+		index.add(domain)
+	}
+	group := &Group{Group: &models.Group{ID: 1}, listIndex: index}
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"example.com", true},
+		{"www.example.com", true},
+		{"a.b.example.com", true},
+		{"badexample.com", false},
+		{"ads.example.org", true},
+		{"www.ads.example.org", false},
+		{"example.org", false},
+		{"cdn.example.net", true},
+		{"disabled.org", false},
+		{"com", false},
+	}
+	for _, test := range tests {
+		if got := group.IsMatch(test.name); got != test.want {
+			t.Fatalf("Group.IsMatch(%q) = %t, want %t", test.name, got, test.want)
+		}
+	}
+}
+
+func TestNextListsRetryDelay(t *testing.T) {
+	delay := nextListsRetryDelay(0, 6*time.Hour)
+	if delay != listsRetryMinDelay {
+		t.Fatalf(`nextListsRetryDelay(0) = %v, want "%v"`, delay, listsRetryMinDelay)
+	}
+	delay = nextListsRetryDelay(delay, 6*time.Hour)
+	if delay != 2*listsRetryMinDelay {
+		t.Fatalf(`nextListsRetryDelay(%v) = %v, want "%v"`, listsRetryMinDelay, delay, 2*listsRetryMinDelay)
+	}
+	delay = nextListsRetryDelay(time.Hour, 90*time.Minute)
+	if delay != 90*time.Minute {
+		t.Fatalf(`nextListsRetryDelay(1h) with 90m interval = %v, want "1h30m0s"`, delay)
+	}
+	delay = nextListsRetryDelay(time.Hour, 0)
+	if delay != listsRetryMaxDelay {
+		t.Fatalf(`nextListsRetryDelay(1h) without interval = %v, want "%v"`, delay, listsRetryMaxDelay)
+	}
+}
+
+func TestGroupSetListsCachePath(t *testing.T) {
+	group := &Group{Group: &models.Group{ID: 1}, listCacheDir: "/opt/var/lib/kvas2-go/lists"}
+	group.setLists([]*models.List{
+		{URL: "http://example.com/a.txt", Format: "plain"},
+		{URL: "http://example.com/b.txt", Format: "plain"},
+	})
+	a, b := group.lists[0].CachePath, group.lists[1].CachePath
+	if filepath.Dir(a) != group.listCacheDir || a == b {
+		t.Fatalf(`Source.CachePath = %q, %q, want distinct files in "%s"`, a, b, group.listCacheDir)
+	}
+}
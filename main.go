@@ -2,11 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"github.com/rs/zerolog"
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 
 	"github.com/rs/zerolog/log"
 )
@@ -14,18 +16,37 @@ import (
 func main() {
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 
-	app, err := New(Config{
-		MinimalTTL:             time.Hour,
-		ChainPrefix:            "KVAS2_",
-		IpSetPrefix:            "kvas2_",
-		LinkName:               "br0",
-		TargetDNSServerAddress: "127.0.0.1:53",
-		ListenPort:             7548,
-	})
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		err := runCtl(os.Args[2:], os.Stdout)
+		if err != nil {
+			if !errors.Is(err, ErrCtlUsage) && !errors.Is(err, flag.ErrHelp) {
+				fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			}
+			os.Exit(1)
+		}
+		return
+	}
+
+	configPath := flag.String("config", "/opt/etc/kvas2-go/config.json", "path to configuration file")
+	flag.Parse()
+
+	configFile, err := LoadConfig(*configPath)
+	if err != nil {
+		log.Fatal().Str("path", *configPath).Err(err).Msg("failed to load configuration")
+	}
+
+	app, err := New(configFile.Config)
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to initialize application")
 	}
 
+	for _, group := range configFile.Groups {
+		err = app.AddGroup(group)
+		if err != nil {
+			log.Fatal().Int("group", group.ID).Err(err).Msg("failed to add group")
+		}
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
 	appResult := make(chan error)
@@ -44,6 +65,10 @@ func main() {
 			if err != nil {
 				log.Error().Err(err).Msg("failed to start application")
 			}
+			err = app.Close()
+			if err != nil {
+				log.Error().Err(err).Msg("failed to close application")
+			}
 			log.Info().Msg("exiting application")
 			return
 		case <-c:
@@ -1,24 +1,85 @@
 package models
 
 import (
+	"errors"
+	"fmt"
+	"net"
 	"regexp"
+	"strconv"
+	"strings"
 
 	"github.com/IGLOU-EU/go-wildcard/v2"
 )
 
+var (
+	ErrUnknownDomainType = errors.New("unknown domain type")
+	ErrEmptyDomain       = errors.New("domain is empty")
+	ErrInvalidNetwork    = errors.New("invalid network")
+	ErrInvalidASN        = errors.New("invalid autonomous system number")
+	ErrInvalidCountry    = errors.New("invalid country code")
+	ErrInvalidRegex      = errors.New("invalid regular expression")
+)
+
 type Domain struct {
-	ID      int
-	Group   *Group
-	Type    string
-	Domain  string
-	Enable  bool
-	Comment string
+	ID      int    `json:"id"`
+	Group   *Group `json:"-"`
+	Type    string `json:"type"`
+	Domain  string `json:"domain"`
+	Enable  bool   `json:"enable"`
+	Comment string `json:"comment,omitempty"`
 }
 
 func (d *Domain) IsEnabled() bool {
 	return d.Enable
 }
 
+// IsNetwork reports whether the rule carries IP prefixes instead of domain
+// name: "cidr" prefix, "asn" autonomous system or "geoip" country
+func (d *Domain) IsNetwork() bool {
+	return d.Type == "cidr" || d.Type == "asn" || d.Type == "geoip"
+}
+
+// ASN returns autonomous system number of the "asn" rule, "AS" prefix is
+// optional
+func (d *Domain) ASN() (uint32, error) {
+	value := strings.TrimPrefix(strings.ToUpper(d.Domain), "AS")
+	asn, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidASN, d.Domain)
+	}
+	return uint32(asn), nil
+}
+
+// Country returns upper case country code of the "geoip" rule
+func (d *Domain) Country() (string, error) {
+	code := strings.ToUpper(d.Domain)
+	if len(code) != 2 || code[0] < 'A' || code[0] > 'Z' || code[1] < 'A' || code[1] > 'Z' {
+		return "", fmt.Errorf("%w: %q", ErrInvalidCountry, d.Domain)
+	}
+	return code, nil
+}
+
+// Network returns IP prefix of the "cidr" rule. Single address is treated as
+// a host prefix.
+func (d *Domain) Network() (*net.IPNet, error) {
+	if !strings.Contains(d.Domain, "/") {
+		ip := net.ParseIP(d.Domain)
+		if ip == nil {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidNetwork, d.Domain)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+
+	_, network, err := net.ParseCIDR(d.Domain)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidNetwork, d.Domain)
+	}
+	return network, nil
+}
+
 func (d *Domain) IsMatch(domainName string) bool {
 	switch d.Type {
 	case "wildcard":
@@ -28,6 +89,42 @@ func (d *Domain) IsMatch(domainName string) bool {
 		return ok
 	case "plaintext":
 		return domainName == d.Domain
+	case "suffix":
+		return domainName == d.Domain || strings.HasSuffix(domainName, "."+d.Domain)
 	}
 	return false
 }
+
+func (d *Domain) Validate() error {
+	if d.Domain == "" {
+		return ErrEmptyDomain
+	}
+
+	switch d.Type {
+	case "wildcard", "plaintext", "suffix":
+	case "cidr":
+		_, err := d.Network()
+		if err != nil {
+			return err
+		}
+	case "asn":
+		_, err := d.ASN()
+		if err != nil {
+			return err
+		}
+	case "geoip":
+		_, err := d.Country()
+		if err != nil {
+			return err
+		}
+	case "regex":
+		_, err := regexp.Compile(d.Domain)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidRegex, err)
+		}
+	default:
+		return fmt.Errorf("%w: %q", ErrUnknownDomainType, d.Type)
+	}
+
+	return nil
+}
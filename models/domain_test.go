@@ -1,6 +1,9 @@
 package models
 
-import "testing"
+import (
+	"errors"
+	"testing"
+)
 
 func TestDomain_IsMatch_Plaintext(t *testing.T) {
 	domain := &Domain{
@@ -40,3 +43,94 @@ func TestDomain_IsMatch_RegEx(t *testing.T) {
 		t.Fatal("&Domain{Type: \"regex\", Domain: \"^ex[apm]{3}le.com$\"}.IsMatch(\"noexample.com\") returns true")
 	}
 }
+
+func TestDomain_IsMatch_Suffix(t *testing.T) {
+	domain := &Domain{
+		Type:   "suffix",
+		Domain: "example.com",
+	}
+	if !domain.IsMatch("example.com") || !domain.IsMatch("www.example.com") {
+		t.Fatal("&Domain{Type: \"suffix\", Domain: \"example.com\"}.IsMatch() returns false for the domain or its subdomain")
+	}
+	if domain.IsMatch("noexample.com") {
+		t.Fatal("&Domain{Type: \"suffix\", Domain: \"example.com\"}.IsMatch(\"noexample.com\") returns true")
+	}
+}
+
+func TestDomain_Validate(t *testing.T) {
+	for _, domainType := range []string{"plaintext", "wildcard", "regex", "suffix"} {
+		domain := &Domain{Type: domainType, Domain: "example.com"}
+		if err := domain.Validate(); err != nil {
+			t.Fatalf("&Domain{Type: %q, Domain: \"example.com\"}.Validate() returns %v", domainType, err)
+		}
+	}
+
+	domain := &Domain{Type: "glob", Domain: "example.com"}
+	if err := domain.Validate(); !errors.Is(err, ErrUnknownDomainType) {
+		t.Fatalf("&Domain{Type: \"glob\", Domain: \"example.com\"}.Validate() returns %v, want ErrUnknownDomainType", err)
+	}
+
+	domain = &Domain{Type: "regex", Domain: "^(example.com$"}
+	if err := domain.Validate(); !errors.Is(err, ErrInvalidRegex) {
+		t.Fatalf("&Domain{Type: \"regex\", Domain: \"^(example.com$\"}.Validate() returns %v, want ErrInvalidRegex", err)
+	}
+
+	domain = &Domain{Type: "plaintext"}
+	if err := domain.Validate(); !errors.Is(err, ErrEmptyDomain) {
+		t.Fatalf("&Domain{Type: \"plaintext\"}.Validate() returns %v, want ErrEmptyDomain", err)
+	}
+}
+
+func TestDomain_Network(t *testing.T) {
+	for value, want := range map[string]string{
+		"149.154.160.0/20":  "149.154.160.0/20",
+		"149.154.167.51":    "149.154.167.51/32",
+		"2001:67c:4e8::/48": "2001:67c:4e8::/48",
+		"2001:67c:4e8::1":   "2001:67c:4e8::1/128",
+	} {
+		domain := &Domain{Type: "cidr", Domain: value}
+		network, err := domain.Network()
+		if err != nil {
+			t.Fatalf("&Domain{Type: \"cidr\", Domain: %q}.Network() returns error: %v", value, err)
+		}
+		if network.String() != want {
+			t.Fatalf("&Domain{Type: \"cidr\", Domain: %q}.Network() = %s, want %q", value, network, want)
+		}
+		if domain.IsMatch(value) {
+			t.Fatalf("&Domain{Type: \"cidr\", Domain: %q}.IsMatch() returns true", value)
+		}
+	}
+
+	domain := &Domain{Type: "cidr", Domain: "example.com"}
+	if err := domain.Validate(); !errors.Is(err, ErrInvalidNetwork) {
+		t.Fatalf("&Domain{Type: \"cidr\", Domain: \"example.com\"}.Validate() returns %v, want ErrInvalidNetwork", err)
+	}
+}
+
+func TestDomain_ASN(t *testing.T) {
+	for _, value := range []string{"AS32934", "as32934", "32934"} {
+		domain := &Domain{Type: "asn", Domain: value}
+		asn, err := domain.ASN()
+		if err != nil || asn != 32934 {
+			t.Fatalf("&Domain{Type: \"asn\", Domain: %q}.ASN() = %d, %v, want \"32934\"", value, asn, err)
+		}
+	}
+
+	domain := &Domain{Type: "asn", Domain: "AS"}
+	if err := domain.Validate(); !errors.Is(err, ErrInvalidASN) {
+		t.Fatalf("&Domain{Type: \"asn\", Domain: \"AS\"}.Validate() returns %v, want ErrInvalidASN", err)
+	}
+}
+
+func TestDomain_Country(t *testing.T) {
+	domain := &Domain{Type: "geoip", Domain: "nl"}
+	code, err := domain.Country()
+	if err != nil || code != "NL" {
+		t.Fatalf("&Domain{Type: \"geoip\", Domain: \"nl\"}.Country() = %q, %v, want \"NL\"", code, err)
+	}
+
+	domain = &Domain{Type: "geoip", Domain: "NLD"}
+	if err := domain.Validate(); !errors.Is(err, ErrInvalidCountry) {
+		t.Fatalf("&Domain{Type: \"geoip\", Domain: \"NLD\"}.Validate() returns %v, want ErrInvalidCountry", err)
+	}
+}
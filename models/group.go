@@ -1,9 +1,306 @@
 package models
 
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// GroupModeRoute routes addresses of matching domains through the group
+	// interface
+	GroupModeRoute = "route"
+	// GroupModeBlock answers queries for matching domains locally
+	GroupModeBlock = "block"
+	// GroupModeBypass routes addresses of matching domains out of the WAN
+	// interface through the gateway, when the default route is a VPN. Gateway
+	// is taken from the main table default route of the WAN interface when
+	// it is not specified.
+	GroupModeBypass = "bypass"
+
+	BlockResponseNXDomain = "nxdomain"
+	// BlockResponseNull answers with 0.0.0.0 and ::
+	BlockResponseNull = "null"
+)
+
+var (
+	ErrGroupInterfaceMissing = errors.New("group interface is not specified")
+	ErrUnknownGroupMode      = errors.New("unknown group mode")
+	ErrUnknownBlockResponse  = errors.New("unknown block response")
+	ErrListURLMissing        = errors.New("list url is not specified")
+	ErrUnknownListFormat     = errors.New("unknown list format")
+	ErrInvalidClient         = errors.New("invalid client")
+	ErrGroupClientsMissing   = errors.New("group clients are not specified")
+	ErrInvalidGateway        = errors.New("invalid gateway")
+	ErrUnknownHealthCheck    = errors.New("unknown health check type")
+	ErrInvalidHealthCheck    = errors.New("invalid health check target")
+)
+
+// List is a source of domains loaded from a local file or HTTP URL
+type List struct {
+	URL    string `json:"url"`
+	Format string `json:"format"`
+}
+
+func (l *List) Validate() error {
+	if l.URL == "" {
+		return ErrListURLMissing
+	}
+	switch l.Format {
+	case "plain", "hosts", "adblock", "dnsmasq":
+	default:
+		return fmt.Errorf("%w: %q", ErrUnknownListFormat, l.Format)
+	}
+	return nil
+}
+
+// HealthCheck probes the target through every interface of the group.
+// Interfaces failing the probes are not used for routing.
+type HealthCheck struct {
+	// Type is "icmp", "tcp" or "dns"
+	Type string `json:"type"`
+	// Target is an address for "icmp", host and port for "tcp" and DNS
+	// server address with optional port for "dns"
+	Target   string        `json:"target"`
+	Interval time.Duration `json:"interval,omitempty"`
+	Timeout  time.Duration `json:"timeout,omitempty"`
+	// Rise and Fall are numbers of probes in a row making interface healthy
+	// and unhealthy
+	Rise int `json:"rise,omitempty"`
+	Fall int `json:"fall,omitempty"`
+	// DisableRule deletes ip rule of the group while no interface is
+	// healthy, so matched traffic goes through the main table
+	DisableRule bool `json:"disableRule,omitempty"`
+}
+
+// UnmarshalJSON accepts durations in Go notation (e.g. "10s") instead of
+// nanoseconds.
+func (h *HealthCheck) UnmarshalJSON(data []byte) error {
+	type healthCheck HealthCheck
+	aux := struct {
+		*healthCheck
+		Interval *string `json:"interval,omitempty"`
+		Timeout  *string `json:"timeout,omitempty"`
+	}{
+		healthCheck: (*healthCheck)(h),
+	}
+
+	err := json.Unmarshal(data, &aux)
+	if err != nil {
+		return err
+	}
+
+	for _, duration := range []struct {
+		name  string
+		value *string
+		dst   *time.Duration
+	}{
+		{"interval", aux.Interval, &h.Interval},
+		{"timeout", aux.Timeout, &h.Timeout},
+	} {
+		if duration.value == nil {
+			continue
+		}
+		*duration.dst, err = time.ParseDuration(*duration.value)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", duration.name, err)
+		}
+	}
+
+	return nil
+}
+
+func (h *HealthCheck) MarshalJSON() ([]byte, error) {
+	type healthCheck HealthCheck
+	aux := struct {
+		*healthCheck
+		Interval string `json:"interval,omitempty"`
+		Timeout  string `json:"timeout,omitempty"`
+	}{
+		healthCheck: (*healthCheck)(h),
+	}
+	if h.Interval != 0 {
+		aux.Interval = h.Interval.String()
+	}
+	if h.Timeout != 0 {
+		aux.Timeout = h.Timeout.String()
+	}
+	return json.Marshal(aux)
+}
+
+func (h *HealthCheck) Validate() error {
+	switch h.Type {
+	case "icmp":
+		if net.ParseIP(h.Target) == nil {
+			return fmt.Errorf("%w: %q", ErrInvalidHealthCheck, h.Target)
+		}
+	case "tcp":
+		_, _, err := net.SplitHostPort(h.Target)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidHealthCheck, err)
+		}
+	case "dns":
+		if h.Target == "" {
+			return fmt.Errorf("%w: %q", ErrInvalidHealthCheck, h.Target)
+		}
+	default:
+		return fmt.Errorf("%w: %q", ErrUnknownHealthCheck, h.Type)
+	}
+	if h.Interval < 0 || h.Timeout < 0 || h.Rise < 0 || h.Fall < 0 {
+		return fmt.Errorf("%w: negative interval, timeout or threshold", ErrInvalidHealthCheck)
+	}
+	return nil
+}
+
 type Group struct {
-	ID         int
-	Name       string
-	Interface  string
-	FixProtect bool
-	Domains    []*Domain
+	ID        int    `json:"id"`
+	Name      string `json:"name"`
+	Mode      string `json:"mode,omitempty"`
+	Interface string `json:"interface"`
+	// Interfaces are ordered interfaces of the group, the first one which is
+	// up is used. Interface is used when they are empty.
+	Interfaces []string `json:"interfaces,omitempty"`
+	// Multipath shares the load between all interfaces which are up
+	Multipath bool `json:"multipath,omitempty"`
+	// HealthCheck is used for failover along with interface state when set
+	HealthCheck *HealthCheck `json:"healthCheck,omitempty"`
+	FixProtect  bool         `json:"fixProtect"`
+	// Gateway and Gateway6 are next hops of the group routes, routes point to
+	// the interface only when they are empty
+	Gateway  string `json:"gateway,omitempty"`
+	Gateway6 string `json:"gateway6,omitempty"`
+	// RulePriority is a priority of the group ip rule, zero lets the kernel
+	// choose it
+	RulePriority  int      `json:"rulePriority,omitempty"`
+	BlockResponse string   `json:"blockResponse,omitempty"`
+	DNSServers    []string `json:"dnsServers,omitempty"`
+	Lists         []*List  `json:"lists,omitempty"`
+	// Clients limit routing to traffic of the listed source addresses,
+	// subnets or MAC addresses. Traffic of all clients is routed when empty.
+	// Block group with clients blocks queries of the clients only.
+	Clients []string `json:"clients,omitempty"`
+	// ScopeDNS makes the group learn addresses only from DNS queries of
+	// Clients
+	ScopeDNS bool      `json:"scopeDNS,omitempty"`
+	Domains  []*Domain `json:"domains"`
+}
+
+// ParseClient parses client selector: IP address, subnet or MAC address.
+// Exactly one of returned values is not nil.
+func ParseClient(client string) (*net.IPNet, net.HardwareAddr, error) {
+	if strings.Contains(client, "/") {
+		_, network, err := net.ParseCIDR(client)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %q", ErrInvalidClient, client)
+		}
+		return network, nil, nil
+	}
+	if ip := net.ParseIP(client); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil, nil
+	}
+	mac, err := net.ParseMAC(client)
+	if err != nil || len(mac) != 6 {
+		return nil, nil, fmt.Errorf("%w: %q", ErrInvalidClient, client)
+	}
+	return nil, mac, nil
+}
+
+// NormalizeClient returns canonical form of the client selector, so equal
+// selectors written differently compare equal: host prefix is written as
+// address, MAC address is written in lower case with colons.
+func NormalizeClient(client string) (string, error) {
+	network, mac, err := ParseClient(client)
+	if err != nil {
+		return "", err
+	}
+	if mac != nil {
+		return mac.String(), nil
+	}
+	if ones, bits := network.Mask.Size(); ones == bits {
+		return network.IP.String(), nil
+	}
+	return network.String(), nil
+}
+
+// InterfaceNames returns ordered interfaces of the group
+func (g *Group) InterfaceNames() []string {
+	if len(g.Interfaces) != 0 {
+		return g.Interfaces
+	}
+	if g.Interface == "" {
+		return nil
+	}
+	return []string{g.Interface}
+}
+
+// IsBlock reports whether the group blocks domains instead of routing them
+func (g *Group) IsBlock() bool {
+	return g.Mode == GroupModeBlock
+}
+
+func (g *Group) Validate() error {
+	switch g.Mode {
+	case "", GroupModeRoute, GroupModeBypass:
+		if len(g.InterfaceNames()) == 0 {
+			return ErrGroupInterfaceMissing
+		}
+		if g.Gateway != "" {
+			ip := net.ParseIP(g.Gateway)
+			if ip == nil || ip.To4() == nil {
+				return fmt.Errorf("%w: %q", ErrInvalidGateway, g.Gateway)
+			}
+		}
+		if g.Gateway6 != "" {
+			ip := net.ParseIP(g.Gateway6)
+			if ip == nil || ip.To4() != nil {
+				return fmt.Errorf("%w: %q", ErrInvalidGateway, g.Gateway6)
+			}
+		}
+		if g.HealthCheck != nil {
+			err := g.HealthCheck.Validate()
+			if err != nil {
+				return err
+			}
+		}
+	case GroupModeBlock:
+		switch g.BlockResponse {
+		case "", BlockResponseNXDomain, BlockResponseNull:
+		default:
+			return fmt.Errorf("%w: %q", ErrUnknownBlockResponse, g.BlockResponse)
+		}
+	default:
+		return fmt.Errorf("%w: %q", ErrUnknownGroupMode, g.Mode)
+	}
+
+	for i, list := range g.Lists {
+		err := list.Validate()
+		if err != nil {
+			return fmt.Errorf("list #%d (%s): %w", i, list.URL, err)
+		}
+	}
+
+	if g.ScopeDNS && len(g.Clients) == 0 {
+		return ErrGroupClientsMissing
+	}
+	for _, client := range g.Clients {
+		_, _, err := ParseClient(client)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, domain := range g.Domains {
+		err := domain.Validate()
+		if err != nil {
+			return fmt.Errorf("domain #%d (%s): %w", i, domain.Domain, err)
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,129 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGroup_Validate_Mode(t *testing.T) {
+	group := &Group{Mode: GroupModeBlock, BlockResponse: BlockResponseNull}
+	if err := group.Validate(); err != nil {
+		t.Fatalf("Group{Mode: \"block\"}.Validate() returns error without interface: %v", err)
+	}
+
+	group = &Group{Mode: GroupModeRoute}
+	if err := group.Validate(); !errors.Is(err, ErrGroupInterfaceMissing) {
+		t.Fatalf("Group{Mode: \"route\"}.Validate() returns %v, want ErrGroupInterfaceMissing", err)
+	}
+
+	group = &Group{Mode: GroupModeBlock, BlockResponse: "refused"}
+	if err := group.Validate(); !errors.Is(err, ErrUnknownBlockResponse) {
+		t.Fatalf("Group{BlockResponse: \"refused\"}.Validate() returns %v, want ErrUnknownBlockResponse", err)
+	}
+
+	group = &Group{Mode: "mirror", Interface: "nwg0"}
+	if err := group.Validate(); !errors.Is(err, ErrUnknownGroupMode) {
+		t.Fatalf("Group{Mode: \"mirror\"}.Validate() returns %v, want ErrUnknownGroupMode", err)
+	}
+}
+
+func TestParseClient(t *testing.T) {
+	network, mac, err := ParseClient("192.168.1.10")
+	if err != nil || mac != nil || network.String() != "192.168.1.10/32" {
+		t.Fatalf(`ParseClient("192.168.1.10") = %v, %v, %v, want "192.168.1.10/32"`, network, mac, err)
+	}
+
+	network, mac, err = ParseClient("192.168.1.0/28")
+	if err != nil || mac != nil || network.String() != "192.168.1.0/28" {
+		t.Fatalf(`ParseClient("192.168.1.0/28") = %v, %v, %v, want "192.168.1.0/28"`, network, mac, err)
+	}
+
+	network, mac, err = ParseClient("AA:BB:CC:DD:EE:FF")
+	if err != nil || network != nil || mac.String() != "aa:bb:cc:dd:ee:ff" {
+		t.Fatalf(`ParseClient("AA:BB:CC:DD:EE:FF") = %v, %v, %v, want "aa:bb:cc:dd:ee:ff"`, network, mac, err)
+	}
+
+	group := &Group{Interface: "nwg0", Clients: []string{"tv.lan"}}
+	if err := group.Validate(); !errors.Is(err, ErrInvalidClient) {
+		t.Fatalf("Group{Clients: [\"tv.lan\"]}.Validate() returns %v, want ErrInvalidClient", err)
+	}
+
+	group = &Group{Interface: "nwg0", ScopeDNS: true}
+	if err := group.Validate(); !errors.Is(err, ErrGroupClientsMissing) {
+		t.Fatalf("Group{ScopeDNS: true}.Validate() returns %v, want ErrGroupClientsMissing", err)
+	}
+}
+
+func TestNormalizeClient(t *testing.T) {
+	for _, test := range []struct {
+		client string
+		want   string
+	}{
+		{"192.168.1.10", "192.168.1.10"},
+		{"192.168.1.10/32", "192.168.1.10"},
+		{"192.168.1.5/28", "192.168.1.0/28"},
+		{"2001:DB8::1", "2001:db8::1"},
+		{"2001:db8::1/128", "2001:db8::1"},
+		{"AA:BB:CC:DD:EE:FF", "aa:bb:cc:dd:ee:ff"},
+		{"aa-bb-cc-dd-ee-ff", "aa:bb:cc:dd:ee:ff"},
+	} {
+		got, err := NormalizeClient(test.client)
+		if err != nil || got != test.want {
+			t.Fatalf("NormalizeClient(%q) = %q, %v, want %q", test.client, got, err, test.want)
+		}
+	}
+
+	_, err := NormalizeClient("tv.lan")
+	if !errors.Is(err, ErrInvalidClient) {
+		t.Fatalf(`NormalizeClient("tv.lan") returns %v, want ErrInvalidClient`, err)
+	}
+}
+
+func TestGroup_Validate_Gateway(t *testing.T) {
+	group := &Group{Mode: GroupModeBypass, Interface: "eth3", Gateway: "192.168.0.1", Gateway6: "fe80::1"}
+	if err := group.Validate(); err != nil {
+		t.Fatalf("Group{Mode: \"bypass\"}.Validate() returns error: %v", err)
+	}
+
+	group = &Group{Mode: GroupModeBypass}
+	if err := group.Validate(); !errors.Is(err, ErrGroupInterfaceMissing) {
+		t.Fatalf("Group{Mode: \"bypass\"}.Validate() returns %v without interface, want ErrGroupInterfaceMissing", err)
+	}
+
+	group = &Group{Mode: GroupModeBypass, Interface: "eth3", Gateway: "fe80::1"}
+	if err := group.Validate(); !errors.Is(err, ErrInvalidGateway) {
+		t.Fatalf("Group{Gateway: \"fe80::1\"}.Validate() returns %v, want ErrInvalidGateway", err)
+	}
+}
+
+func TestHealthCheck_JSON(t *testing.T) {
+	healthCheck := &HealthCheck{}
+	err := json.Unmarshal([]byte(`{"type":"icmp","target":"1.1.1.1","interval":"5s","timeout":"500ms","fall":2}`), healthCheck)
+	if err != nil {
+		t.Fatalf("json.Unmarshal() returns error: %v", err)
+	}
+	if healthCheck.Interval != 5*time.Second || healthCheck.Timeout != 500*time.Millisecond || healthCheck.Fall != 2 {
+		t.Fatalf(`HealthCheck = %+v, want "5s" interval, "500ms" timeout and fall 2`, healthCheck)
+	}
+	if err := healthCheck.Validate(); err != nil {
+		t.Fatalf("HealthCheck.Validate() returns error: %v", err)
+	}
+
+	data, err := json.Marshal(healthCheck)
+	if err != nil || !strings.Contains(string(data), `"interval":"5s"`) {
+		t.Fatalf(`json.Marshal() = %s, %v, want "interval":"5s"`, data, err)
+	}
+
+	group := &Group{Interface: "nwg0", HealthCheck: &HealthCheck{Type: "tcp", Target: "1.1.1.1"}}
+	if err := group.Validate(); !errors.Is(err, ErrInvalidHealthCheck) {
+		t.Fatalf("Group{HealthCheck: tcp without port}.Validate() returns %v, want ErrInvalidHealthCheck", err)
+	}
+
+	group.HealthCheck = &HealthCheck{Type: "http", Target: "1.1.1.1"}
+	if err := group.Validate(); !errors.Is(err, ErrUnknownHealthCheck) {
+		t.Fatalf("Group{HealthCheck: http}.Validate() returns %v, want ErrUnknownHealthCheck", err)
+	}
+}
@@ -6,16 +6,39 @@ import (
 	"github.com/rs/zerolog/log"
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
 	"net"
 	"strconv"
 )
 
 type IfaceToIPSet struct {
-	IPTables     *iptables.IPTables
-	ChainName    string
-	IfaceName    string
+	IPTables  *iptables.IPTables
+	ChainName string
+	// IfaceNames are interfaces of the table default route. Several
+	// interfaces make multipath route sharing the load between them.
+	IfaceNames   []string
 	IPSetName    string
 	SoftwareMode bool
+	// Gateway is a next hop of the table default route, the route points to
+	// the interface only when it is nil. Gateway is not used by multipath
+	// route.
+	Gateway net.IP
+	// ResolveGateway takes next hops of the interfaces from the main table
+	// default routes when Gateway is nil. Bypass groups route traffic out of
+	// the WAN interface this way while the main default route is a VPN.
+	ResolveGateway bool
+	// RulePriority is a priority of the ip rule, zero lets the kernel choose
+	// it
+	RulePriority int
+	// RuleDisabled keeps the ip rule deleted, so marked traffic goes through
+	// the main table
+	RuleDisabled bool
+
+	// FilterClients limits routing to sources from ClientIPSetName or
+	// ClientMACSetName sets
+	FilterClients    bool
+	ClientIPSetName  string
+	ClientMACSetName string
 
 	Enabled bool
 
@@ -25,6 +48,48 @@ type IfaceToIPSet struct {
 	ipRoute *netlink.Route
 }
 
+func (r *IfaceToIPSet) family() int {
+	if r.IPTables.Proto() == iptables.ProtocolIPv6 {
+		return nl.FAMILY_V6
+	}
+	return nl.FAMILY_V4
+}
+
+func (r *IfaceToIPSet) defaultDst() *net.IPNet {
+	if r.family() == nl.FAMILY_V6 {
+		return &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+	}
+	return &net.IPNet{IP: []byte{0, 0, 0, 0}, Mask: []byte{0, 0, 0, 0}}
+}
+
+// clientMatches returns source matches of the client sets
+func (r *IfaceToIPSet) clientMatches() [][]string {
+	matches := make([][]string, 0, 2)
+	for _, setName := range []string{r.ClientIPSetName, r.ClientMACSetName} {
+		if setName != "" {
+			matches = append(matches, []string{"-m", "set", "--match-set", setName, "src"})
+		}
+	}
+	return matches
+}
+
+// preroutingRules returns rules jumping to the chain from PREROUTING. Rules
+// of both filtered and unfiltered modes are returned when all is true.
+func (r *IfaceToIPSet) preroutingRules(all bool) [][]string {
+	dstMatch := []string{"-m", "set", "--match-set", r.IPSetName, "dst"}
+	rules := make([][]string, 0, 3)
+	if !r.FilterClients || all {
+		rules = append(rules, append(dstMatch, "-j", r.ChainName))
+	}
+	if r.FilterClients || all {
+		for _, clientMatch := range r.clientMatches() {
+			rule := append(append(append([]string{}, dstMatch...), clientMatch...), "-j", r.ChainName)
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
 func (r *IfaceToIPSet) PutIPTable(table string) error {
 	var err error
 
@@ -51,14 +116,19 @@ func (r *IfaceToIPSet) PutIPTable(table string) error {
 				}
 			}
 
-			err = r.IPTables.AppendUnique("mangle", "PREROUTING", "-m", "set", "--match-set", r.IPSetName, "dst", "-j", r.ChainName)
-			if err != nil {
-				return fmt.Errorf("failed to append rule to PREROUTING: %w", err)
+			for _, rule := range r.preroutingRules(false) {
+				err = r.IPTables.AppendUnique("mangle", "PREROUTING", rule...)
+				if err != nil {
+					return fmt.Errorf("failed to append rule to PREROUTING: %w", err)
+				}
 			}
 
-			err = r.IPTables.AppendUnique("mangle", "OUTPUT", "-m", "set", "--match-set", r.IPSetName, "dst", "-j", r.ChainName)
-			if err != nil {
-				return fmt.Errorf("failed to append rule to OUTPUT: %w", err)
+			// Traffic of the router itself is not a client traffic
+			if !r.FilterClients {
+				err = r.IPTables.AppendUnique("mangle", "OUTPUT", "-m", "set", "--match-set", r.IPSetName, "dst", "-j", r.ChainName)
+				if err != nil {
+					return fmt.Errorf("failed to append rule to OUTPUT: %w", err)
+				}
 			}
 		}
 	} else {
@@ -70,9 +140,19 @@ func (r *IfaceToIPSet) PutIPTable(table string) error {
 				return fmt.Errorf("failed to clear chain: %w", err)
 			}
 
-			err = r.IPTables.AppendUnique("mangle", preroutingChainName, "-m", "set", "--match-set", r.IPSetName, "dst", "-j", "MARK", "--set-mark", strconv.Itoa(int(r.mark)))
-			if err != nil {
-				return fmt.Errorf("failed to create rule: %w", err)
+			markRule := []string{"-m", "set", "--match-set", r.IPSetName, "dst", "-j", "MARK", "--set-mark", strconv.Itoa(int(r.mark))}
+			markRules := [][]string{markRule}
+			if r.FilterClients {
+				markRules = make([][]string, 0, 2)
+				for _, clientMatch := range r.clientMatches() {
+					markRules = append(markRules, append(clientMatch, markRule...))
+				}
+			}
+			for _, rule := range markRules {
+				err = r.IPTables.AppendUnique("mangle", preroutingChainName, rule...)
+				if err != nil {
+					return fmt.Errorf("failed to create rule: %w", err)
+				}
 			}
 
 			err = r.IPTables.AppendUnique("mangle", "PREROUTING", "-j", preroutingChainName)
@@ -90,9 +170,11 @@ func (r *IfaceToIPSet) PutIPTable(table string) error {
 			return fmt.Errorf("failed to clear chain: %w", err)
 		}
 
-		err = r.IPTables.AppendUnique("nat", postroutingChainName, "-o", r.IfaceName, "-j", "MASQUERADE")
-		if err != nil {
-			return fmt.Errorf("failed to create rule: %w", err)
+		for _, ifaceName := range r.IfaceNames {
+			err = r.IPTables.AppendUnique("nat", postroutingChainName, "-o", ifaceName, "-j", "MASQUERADE")
+			if err != nil {
+				return fmt.Errorf("failed to create rule: %w", err)
+			}
 		}
 
 		err = r.IPTables.AppendUnique("nat", "POSTROUTING", "-j", postroutingChainName)
@@ -104,35 +186,162 @@ func (r *IfaceToIPSet) PutIPTable(table string) error {
 	return nil
 }
 
-func (r *IfaceToIPSet) IfaceHandle() error {
-	// Find interface
-	iface, err := netlink.LinkByName(r.IfaceName)
-	if err != nil {
-		log.Warn().Str("interface", r.IfaceName).Err(err).Msg("error while getting interface")
+// mainTableGateway returns next hop of the default route through the link
+// among the main table routes. Route with the lowest metric wins, nil is
+// returned when the link has no default route with gateway.
+func mainTableGateway(routes []netlink.Route, linkIndex int) net.IP {
+	var gateway net.IP
+	priority := -1
+	for _, route := range routes {
+		if route.Dst != nil {
+			if ones, _ := route.Dst.Mask.Size(); ones != 0 {
+				continue
+			}
+		}
+		if priority >= 0 && route.Priority >= priority {
+			continue
+		}
+		if route.LinkIndex == linkIndex && route.Gw != nil {
+			gateway, priority = route.Gw, route.Priority
+			continue
+		}
+		for _, nexthop := range route.MultiPath {
+			if nexthop.LinkIndex == linkIndex && nexthop.Gw != nil {
+				gateway, priority = nexthop.Gw, route.Priority
+				break
+			}
+		}
 	}
+	return gateway
+}
 
-	// Mapping iface with table
-	if iface != nil {
-		route := &netlink.Route{
-			LinkIndex: iface.Attrs().Index,
-			Table:     r.table,
-			Dst:       &net.IPNet{IP: []byte{0, 0, 0, 0}, Mask: []byte{0, 0, 0, 0}},
-		}
-		// Delete rule if exists
-		err = netlink.RouteDel(route)
-		if err != nil {
-			log.Warn().Str("interface", r.IfaceName).Err(err).Msg("error while deleting route")
+// tableRoute returns default route of the table through the links. Gateways
+// are next hops of the links, nil gateway routes to the link itself.
+func tableRoute(table int, dst *net.IPNet, links []netlink.Link, gateways []net.IP) *netlink.Route {
+	route := &netlink.Route{
+		Table: table,
+		Dst:   dst,
+	}
+	if len(links) == 1 {
+		route.LinkIndex = links[0].Attrs().Index
+		route.Gw = gateways[0]
+		return route
+	}
+	for i, link := range links {
+		route.MultiPath = append(route.MultiPath, &netlink.NexthopInfo{
+			LinkIndex: link.Attrs().Index,
+			Gw:        gateways[i],
+		})
+	}
+	return route
+}
+
+// gateways returns next hops of the links
+func (r *IfaceToIPSet) gateways(links []netlink.Link) ([]net.IP, error) {
+	gateways := make([]net.IP, len(links))
+	if len(links) == 1 {
+		gateways[0] = r.Gateway
+	}
+	if !r.ResolveGateway || r.Gateway != nil {
+		return gateways, nil
+	}
+
+	routes, err := netlink.RouteListFiltered(r.family(), &netlink.Route{Table: unix.RT_TABLE_MAIN}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, fmt.Errorf("error while getting main table routes: %w", err)
+	}
+	for i, link := range links {
+		gateways[i] = mainTableGateway(routes, link.Attrs().Index)
+		// Point-to-point links are routed without next hop
+		if gateways[i] == nil {
+			log.Debug().Str("interface", link.Attrs().Name).Msg("no gateway in the main table, routing to interface")
 		}
-		err = netlink.RouteAdd(route)
+	}
+	return gateways, nil
+}
+
+func (r *IfaceToIPSet) IfaceHandle() error {
+	// Find interfaces
+	links := make([]netlink.Link, 0, len(r.IfaceNames))
+	for _, ifaceName := range r.IfaceNames {
+		iface, err := netlink.LinkByName(ifaceName)
 		if err != nil {
-			return fmt.Errorf("error while mapping iface with table: %w", err)
+			log.Warn().Str("interface", ifaceName).Err(err).Msg("error while getting interface")
+			continue
 		}
-		r.ipRoute = route
+		links = append(links, iface)
+	}
+	if len(links) == 0 {
+		return nil
 	}
 
+	gateways, err := r.gateways(links)
+	if err != nil {
+		return err
+	}
+
+	// Mapping interfaces with table
+	route := tableRoute(r.table, r.defaultDst(), links, gateways)
+	// Replace keeps the table routed while switching interfaces
+	err = netlink.RouteReplace(route)
+	if err != nil {
+		return fmt.Errorf("error while mapping iface with table: %w", err)
+	}
+	r.ipRoute = route
+
 	return nil
 }
 
+// markRule returns ip rule looking up the table for marked packets
+func markRule(family int, mark uint32, table, priority int) *netlink.Rule {
+	rule := netlink.NewRule()
+	rule.Family = family
+	rule.Mark = mark
+	rule.Table = table
+	if priority > 0 {
+		rule.Priority = priority
+	}
+	return rule
+}
+
+// addIPRule maps mark with table
+func (r *IfaceToIPSet) addIPRule() error {
+	if r.ipRule != nil {
+		return nil
+	}
+	rule := markRule(r.family(), r.mark, r.table, r.RulePriority)
+	err := netlink.RuleAdd(rule)
+	if err != nil {
+		return fmt.Errorf("error while mapping mark with table: %w", err)
+	}
+	r.ipRule = rule
+	return nil
+}
+
+func (r *IfaceToIPSet) delIPRule() error {
+	if r.ipRule == nil {
+		return nil
+	}
+	err := netlink.RuleDel(r.ipRule)
+	r.ipRule = nil
+	if err != nil {
+		return fmt.Errorf("error while deleting rule: %w", err)
+	}
+	return nil
+}
+
+// SetRuleDisabled deletes or restores the ip rule of enabled routing
+func (r *IfaceToIPSet) SetRuleDisabled(disabled bool) error {
+	r.RuleDisabled = disabled
+	if !r.Enabled {
+		return nil
+	}
+	if disabled {
+		return r.delIPRule()
+	}
+	return r.addIPRule()
+}
+
 func (r *IfaceToIPSet) ForceEnable() error {
 	// Release used mark and table
 	r.Disable()
@@ -179,22 +388,19 @@ func (r *IfaceToIPSet) ForceEnable() error {
 	// IPTables rules
 	err = r.PutIPTable("all")
 	if err != nil {
-		return nil
+		return err
 	}
 
-	// Mapping mark with table
-	rule := netlink.NewRule()
-	rule.Mark = r.mark
-	rule.Table = r.table
-	err = netlink.RuleAdd(rule)
-	if err != nil {
-		return fmt.Errorf("error while mapping mark with table: %w", err)
+	if !r.RuleDisabled {
+		err = r.addIPRule()
+		if err != nil {
+			return err
+		}
 	}
-	r.ipRule = rule
 
 	err = r.IfaceHandle()
 	if err != nil {
-		return nil
+		return err
 	}
 
 	r.Enabled = true
@@ -206,9 +412,11 @@ func (r *IfaceToIPSet) Disable() []error {
 	var err error
 
 	if !r.SoftwareMode {
-		err = r.IPTables.DeleteIfExists("mangle", "PREROUTING", "-m", "set", "--match-set", r.IPSetName, "dst", "-j", r.ChainName)
-		if err != nil {
-			errs = append(errs, fmt.Errorf("failed to delete rule from PREROUTING: %w", err))
+		for _, rule := range r.preroutingRules(true) {
+			err = r.IPTables.DeleteIfExists("mangle", "PREROUTING", rule...)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to delete rule from PREROUTING: %w", err))
+			}
 		}
 
 		err = r.IPTables.DeleteIfExists("mangle", "OUTPUT", "-m", "set", "--match-set", r.IPSetName, "dst", "-j", r.ChainName)
@@ -246,12 +454,9 @@ func (r *IfaceToIPSet) Disable() []error {
 		errs = append(errs, fmt.Errorf("failed to delete chain: %w", err))
 	}
 
-	if r.ipRule != nil {
-		err = netlink.RuleDel(r.ipRule)
-		if err != nil {
-			errs = append(errs, fmt.Errorf("error while deleting rule: %w", err))
-		}
-		r.ipRule = nil
+	err = r.delIPRule()
+	if err != nil {
+		errs = append(errs, err)
 	}
 
 	if r.ipRoute != nil {
@@ -259,7 +464,7 @@ func (r *IfaceToIPSet) Disable() []error {
 		if err != nil {
 			errs = append(errs, fmt.Errorf("error while deleting route: %w", err))
 		}
-		r.ipRule = nil
+		r.ipRoute = nil
 	}
 
 	r.Enabled = false
@@ -280,11 +485,12 @@ func (r *IfaceToIPSet) Enable() error {
 	return nil
 }
 
-func (nh *NetfilterHelper) IfaceToIPSet(name string, ifaceName, ipsetName string, softwareMode bool) *IfaceToIPSet {
+func (nh *NetfilterHelper) IfaceToIPSet(name string, ifaceNames []string, ipsetName string, softwareMode bool) *IfaceToIPSet {
 	return &IfaceToIPSet{
-		IPTables:  nh.IPTables,
-		ChainName: name,
-		IfaceName: ifaceName,
-		IPSetName: ipsetName,
+		IPTables:     nh.IPTables,
+		ChainName:    name,
+		IfaceNames:   ifaceNames,
+		IPSetName:    ipsetName,
+		SoftwareMode: softwareMode,
 	}
 }
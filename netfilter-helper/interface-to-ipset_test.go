@@ -0,0 +1,67 @@
+package netfilterHelper
+
+import (
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+func TestMainTableGateway(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("192.168.1.0/24")
+	routes := []netlink.Route{
+		// VPN default route has the lowest metric
+		{LinkIndex: 7, Priority: 0},
+		{LinkIndex: 5, Dst: lan, Gw: net.ParseIP("192.168.1.254")},
+		{LinkIndex: 5, Gw: net.ParseIP("192.168.0.2"), Priority: 200},
+		{LinkIndex: 5, Gw: net.ParseIP("192.168.0.1"), Priority: 100},
+		{MultiPath: []*netlink.NexthopInfo{{LinkIndex: 6, Gw: net.ParseIP("10.0.0.1")}}, Priority: 50},
+	}
+
+	tests := []struct {
+		linkIndex int
+		want      net.IP
+	}{
+		{5, net.ParseIP("192.168.0.1")},
+		{6, net.ParseIP("10.0.0.1")},
+		{7, nil},
+		{8, nil},
+	}
+	for _, test := range tests {
+		gateway := mainTableGateway(routes, test.linkIndex)
+		if !gateway.Equal(test.want) {
+			t.Fatalf("mainTableGateway(%d) = %v, want %v", test.linkIndex, gateway, test.want)
+		}
+	}
+}
+
+func TestBypassRouteAndRule(t *testing.T) {
+	wan := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "eth3", Index: 5}}
+	mainRoutes := []netlink.Route{
+		{LinkIndex: 7},
+		{LinkIndex: 5, Gw: net.ParseIP("192.168.0.1"), Priority: 100},
+	}
+	dst := &net.IPNet{IP: []byte{0, 0, 0, 0}, Mask: []byte{0, 0, 0, 0}}
+
+	gateway := mainTableGateway(mainRoutes, wan.Index)
+	route := tableRoute(1, dst, []netlink.Link{wan}, []net.IP{gateway})
+	if route.Table != 1 || route.LinkIndex != 5 || !route.Gw.Equal(net.ParseIP("192.168.0.1")) || route.Dst.String() != "0.0.0.0/0" {
+		t.Fatalf(`tableRoute() = %v, want "0.0.0.0/0 via 192.168.0.1 dev eth3 table 1"`, route)
+	}
+
+	lte := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "usb0", Index: 6}}
+	route = tableRoute(1, dst, []netlink.Link{wan, lte}, []net.IP{gateway, nil})
+	if len(route.MultiPath) != 2 || !route.MultiPath[0].Gw.Equal(gateway) || route.MultiPath[1].Gw != nil || route.MultiPath[1].LinkIndex != 6 {
+		t.Fatalf(`tableRoute() multipath = %v, want "via 192.168.0.1 dev eth3" and "dev usb0"`, route.MultiPath)
+	}
+
+	rule := markRule(nl.FAMILY_V4, 3, 1, 90)
+	if rule.Family != nl.FAMILY_V4 || rule.Mark != 3 || rule.Table != 1 || rule.Priority != 90 {
+		t.Fatalf(`markRule() = %v, want "priority 90 fwmark 3 lookup 1"`, rule)
+	}
+	rule = markRule(nl.FAMILY_V4, 3, 1, 0)
+	if rule.Priority != -1 {
+		t.Fatalf(`markRule() without priority = %d, want "-1"`, rule.Priority)
+	}
+}
@@ -2,13 +2,24 @@ package netfilterHelper
 
 import (
 	"fmt"
-	"github.com/vishvananda/netlink"
+	"math"
 	"net"
 	"os"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
+// ipsetDefaultMaxElements is the kernel default capacity of hash sets
+const ipsetDefaultMaxElements = 65536
+
 type IPSet struct {
 	SetName string
+
+	typeName    string
+	options     netlink.IpsetCreateOptions
+	maxElements uint32
 }
 
 func (r *IPSet) AddIP(addr net.IP, timeout *uint32) error {
@@ -33,6 +44,39 @@ func (r *IPSet) Del(addr net.IP) error {
 	return nil
 }
 
+// AddNet adds network to the set. Zero timeout makes the entry permanent.
+func (r *IPSet) AddNet(network *net.IPNet, timeout *uint32) error {
+	ones, _ := network.Mask.Size()
+	err := netlink.IpsetAdd(r.SetName, &netlink.IPSetEntry{
+		IP:      network.IP,
+		CIDR:    uint8(ones),
+		Timeout: timeout,
+		Replace: true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add network: %w", err)
+	}
+	return nil
+}
+
+func (r *IPSet) DelNet(network *net.IPNet) error {
+	ones, _ := network.Mask.Size()
+	err := netlink.IpsetDel(r.SetName, &netlink.IPSetEntry{
+		IP:   network.IP,
+		CIDR: uint8(ones),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete network: %w", err)
+	}
+	return nil
+}
+
+// isHostEntry reports whether the entry is a single address
+func isHostEntry(entry netlink.IPSetEntry) bool {
+	return entry.CIDR == 0 || int(entry.CIDR) == len(entry.IP)*8
+}
+
+// List returns single addresses of the set
 func (r *IPSet) List() (map[string]*uint32, error) {
 	list, err := netlink.IpsetList(r.SetName)
 	if err != nil {
@@ -40,11 +84,32 @@ func (r *IPSet) List() (map[string]*uint32, error) {
 	}
 	addresses := make(map[string]*uint32)
 	for _, entry := range list.Entries {
+		if !isHostEntry(entry) {
+			continue
+		}
 		addresses[string(entry.IP)] = entry.Timeout
 	}
 	return addresses, nil
 }
 
+// ListNets returns networks of the set keyed by CIDR notation. Single
+// addresses are not included.
+func (r *IPSet) ListNets() (map[string]*uint32, error) {
+	list, err := netlink.IpsetList(r.SetName)
+	if err != nil {
+		return nil, err
+	}
+	networks := make(map[string]*uint32)
+	for _, entry := range list.Entries {
+		if isHostEntry(entry) {
+			continue
+		}
+		network := &net.IPNet{IP: entry.IP, Mask: net.CIDRMask(int(entry.CIDR), len(entry.IP)*8)}
+		networks[network.String()] = entry.Timeout
+	}
+	return networks, nil
+}
+
 func (r *IPSet) Destroy() error {
 	err := netlink.IpsetDestroy(r.SetName)
 	if err != nil && !os.IsNotExist(err) {
@@ -53,22 +118,135 @@ func (r *IPSet) Destroy() error {
 	return nil
 }
 
-func (nh *NetfilterHelper) IPSet(name string) (*IPSet, error) {
+// AddMAC adds MAC address to the hash:mac set
+func (r *IPSet) AddMAC(mac net.HardwareAddr) error {
+	err := netlink.IpsetAdd(r.SetName, &netlink.IPSetEntry{
+		MAC:     mac,
+		Replace: true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add MAC address: %w", err)
+	}
+	return nil
+}
+
+func (r *IPSet) DelMAC(mac net.HardwareAddr) error {
+	err := netlink.IpsetDel(r.SetName, &netlink.IPSetEntry{
+		MAC: mac,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete MAC address: %w", err)
+	}
+	return nil
+}
+
+// ListMACs returns MAC addresses of the hash:mac set
+func (r *IPSet) ListMACs() (map[string]struct{}, error) {
+	list, err := netlink.IpsetList(r.SetName)
+	if err != nil {
+		return nil, err
+	}
+	macs := make(map[string]struct{})
+	for _, entry := range list.Entries {
+		macs[entry.MAC.String()] = struct{}{}
+	}
+	return macs, nil
+}
+
+// Reserve grows the set when it can not fit count entries. New set with
+// doubled capacity is filled with the current entries and swapped with the
+// set, so iptables rules keep referencing it by name.
+func (r *IPSet) Reserve(count int) error {
+	if uint64(count) <= uint64(r.maxElements) {
+		return nil
+	}
+
+	size := uint64(r.maxElements)
+	for size < 2*uint64(count) && size < math.MaxUint32 {
+		size *= 2
+	}
+	size = min(size, math.MaxUint32)
+
+	tmp := &IPSet{SetName: r.SetName + "_t"}
+	err := tmp.Destroy()
+	if err != nil {
+		return err
+	}
+	options := r.options
+	options.MaxElements = uint32(size)
+	err = netlink.IpsetCreate(tmp.SetName, r.typeName, options)
+	if err != nil {
+		return fmt.Errorf("failed to create ipset: %w", err)
+	}
+	defer tmp.Destroy()
+
+	list, err := netlink.IpsetList(r.SetName)
+	if err != nil {
+		return fmt.Errorf("failed to list ipset: %w", err)
+	}
+	for _, entry := range list.Entries {
+		err = netlink.IpsetAdd(tmp.SetName, &netlink.IPSetEntry{
+			IP:      entry.IP,
+			CIDR:    entry.CIDR,
+			MAC:     entry.MAC,
+			Timeout: entry.Timeout,
+			Replace: true,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to copy ipset entry: %w", err)
+		}
+	}
+
+	err = netlink.IpsetSwap(r.SetName, tmp.SetName)
+	if err != nil {
+		return fmt.Errorf("failed to swap ipsets: %w", err)
+	}
+	r.maxElements = uint32(size)
+	return nil
+}
+
+func (nh *NetfilterHelper) createIPSet(name, typename string, timeout *uint32) (*IPSet, error) {
 	ipset := &IPSet{
-		SetName: name,
+		SetName:     name,
+		typeName:    typename,
+		maxElements: ipsetDefaultMaxElements,
 	}
 	err := ipset.Destroy()
 	if err != nil {
 		return nil, err
 	}
 
-	defaultTimeout := uint32(300)
-	err = netlink.IpsetCreate(ipset.SetName, "hash:net", netlink.IpsetCreateOptions{
-		Timeout: &defaultTimeout,
-	})
+	family := uint8(unix.AF_INET)
+	if nh.IPTables.Proto() == iptables.ProtocolIPv6 {
+		family = unix.AF_INET6
+	}
+
+	ipset.options = netlink.IpsetCreateOptions{
+		Timeout:     timeout,
+		Family:      family,
+		MaxElements: ipset.maxElements,
+	}
+	err = netlink.IpsetCreate(ipset.SetName, typename, ipset.options)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create ipset: %w", err)
 	}
 
 	return ipset, nil
 }
+
+// IPSet creates set of destination addresses and networks. Addresses are
+// added with timeout, networks may be permanent.
+func (nh *NetfilterHelper) IPSet(name string) (*IPSet, error) {
+	defaultTimeout := uint32(300)
+	return nh.createIPSet(name, "hash:net", &defaultTimeout)
+}
+
+// ClientIPSet creates set of source addresses and networks without timeout
+func (nh *NetfilterHelper) ClientIPSet(name string) (*IPSet, error) {
+	return nh.createIPSet(name, "hash:net", nil)
+}
+
+// MACSet creates set of source MAC addresses
+func (nh *NetfilterHelper) MACSet(name string) (*IPSet, error) {
+	return nh.createIPSet(name, "hash:mac", nil)
+}
@@ -36,9 +36,11 @@ func (r *PortRemap) PutIPTable(table string) error {
 				continue
 			}
 
-			err = r.IPTables.AppendUnique("nat", r.ChainName, "-p", "udp", "-d", addrIP.String(), "--dport", strconv.Itoa(int(r.From)), "-j", "DNAT", "--to-destination", fmt.Sprintf(":%d", r.To))
-			if err != nil {
-				return fmt.Errorf("failed to create rule: %w", err)
+			for _, proto := range []string{"udp", "tcp"} {
+				err = r.IPTables.AppendUnique("nat", r.ChainName, "-p", proto, "-d", addrIP.String(), "--dport", strconv.Itoa(int(r.From)), "-j", "DNAT", "--to-destination", fmt.Sprintf(":%d", r.To))
+				if err != nil {
+					return fmt.Errorf("failed to create rule: %w", err)
+				}
 			}
 		}
 
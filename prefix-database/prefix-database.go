@@ -0,0 +1,277 @@
+package prefixDatabase
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidLine = errors.New("invalid line")
+)
+
+// Database maps autonomous systems and countries to IP prefixes. ASN data is
+// read from CAIDA pfx2as dump ("1.0.0.0	24	13335"), country data is read
+// from RIR delegated statistics ("ripencc|NL|ipv4|193.0.0.0|2048|...").
+// Only prefixes of the selected ASNs and countries are kept in memory.
+type Database struct {
+	ASNPath     string
+	CountryPath string
+
+	// loadMutex serialises loads, mutex guards loaded data and selections
+	loadMutex  sync.Mutex
+	mutex      sync.RWMutex
+	asnModTime time.Time
+	ccModTime  time.Time
+	asns       map[uint32][]*net.IPNet
+	countries  map[string][]*net.IPNet
+	// loadedASNs and loadedCountries are selections the data is loaded for
+	loadedASNs      map[uint32]struct{}
+	loadedCountries map[string]struct{}
+}
+
+// ASN returns prefixes originated by the autonomous system
+func (d *Database) ASN(asn uint32) []*net.IPNet {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.asns[asn]
+}
+
+// Country returns prefixes delegated to the country. Code is ISO 3166
+// alpha-2 code in upper case.
+func (d *Database) Country(code string) []*net.IPNet {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.countries[code]
+}
+
+// isSubset reports whether every key of a is in b
+func isSubset[K comparable](a, b map[K]struct{}) bool {
+	for key := range a {
+		if _, exists := b[key]; !exists {
+			return false
+		}
+	}
+	return true
+}
+
+// Covers reports whether the selected ASNs and countries are already loaded.
+// It does not wait for the running load, so it is cheap to call under locks.
+func (d *Database) Covers(asns map[uint32]struct{}, countries map[string]struct{}) bool {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return (d.ASNPath == "" || isSubset(asns, d.loadedASNs)) &&
+		(d.CountryPath == "" || isSubset(countries, d.loadedCountries))
+}
+
+// Load reads prefixes of the selected ASNs and countries from database files.
+// File is read again when it is modified since the last load or when the
+// selection has entries which are not loaded yet. Changed is true when any
+// file is reloaded or data is dropped due to empty selection.
+func (d *Database) Load(asns map[uint32]struct{}, countries map[string]struct{}) (changed bool, err error) {
+	d.loadMutex.Lock()
+	defer d.loadMutex.Unlock()
+
+	var errs []error
+
+	if d.ASNPath != "" && len(asns) == 0 {
+		// Nothing is selected, file is not read at all
+		changed = changed || d.asns != nil
+		d.mutex.Lock()
+		d.asns, d.loadedASNs = nil, nil
+		d.mutex.Unlock()
+		d.asnModTime = time.Time{}
+	} else if d.ASNPath != "" {
+		modTime := d.asnModTime
+		if !isSubset(asns, d.loadedASNs) {
+			modTime = time.Time{}
+		}
+		asnChanged, err := d.loadFile(d.ASNPath, &modTime, func(r io.Reader) error {
+			loaded, err := ParsePfx2AS(r, asns)
+			if err == nil {
+				d.mutex.Lock()
+				d.asns, d.loadedASNs = loaded, asns
+				d.mutex.Unlock()
+			}
+			return err
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to load ASN database: %w", err))
+		} else {
+			d.asnModTime = modTime
+		}
+		changed = changed || asnChanged
+	}
+
+	if d.CountryPath != "" && len(countries) == 0 {
+		changed = changed || d.countries != nil
+		d.mutex.Lock()
+		d.countries, d.loadedCountries = nil, nil
+		d.mutex.Unlock()
+		d.ccModTime = time.Time{}
+	} else if d.CountryPath != "" {
+		modTime := d.ccModTime
+		if !isSubset(countries, d.loadedCountries) {
+			modTime = time.Time{}
+		}
+		ccChanged, err := d.loadFile(d.CountryPath, &modTime, func(r io.Reader) error {
+			loaded, err := ParseDelegated(r, countries)
+			if err == nil {
+				d.mutex.Lock()
+				d.countries, d.loadedCountries = loaded, countries
+				d.mutex.Unlock()
+			}
+			return err
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to load country database: %w", err))
+		} else {
+			d.ccModTime = modTime
+		}
+		changed = changed || ccChanged
+	}
+
+	return changed, errors.Join(errs...)
+}
+
+func (d *Database) loadFile(path string, modTime *time.Time, parse func(r io.Reader) error) (bool, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	if stat.ModTime().Equal(*modTime) {
+		return false, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	err = parse(file)
+	if err != nil {
+		return false, err
+	}
+	*modTime = stat.ModTime()
+	return true, nil
+}
+
+// ParsePfx2AS reads CAIDA prefix to AS dump. Multi-origin prefixes
+// ("13335_1234" or "13335,1234") are assigned to every listed AS. Only
+// prefixes of the selected ASNs are returned, nil selection takes all.
+func ParsePfx2AS(r io.Reader, selected map[uint32]struct{}) (map[uint32][]*net.IPNet, error) {
+	asns := make(map[uint32][]*net.IPNet)
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%w %d: %q", ErrInvalidLine, lineNumber, line)
+		}
+		_, network, err := net.ParseCIDR(fields[0] + "/" + fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%w %d: %w", ErrInvalidLine, lineNumber, err)
+		}
+		for _, asnValue := range strings.FieldsFunc(fields[2], func(r rune) bool { return r == '_' || r == ',' }) {
+			asn, err := strconv.ParseUint(asnValue, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("%w %d: %w", ErrInvalidLine, lineNumber, err)
+			}
+			if _, exists := selected[uint32(asn)]; selected != nil && !exists {
+				continue
+			}
+			asns[uint32(asn)] = append(asns[uint32(asn)], network)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read database: %w", err)
+	}
+	return asns, nil
+}
+
+// ParseDelegated reads RIR delegated statistics. Only allocated and assigned
+// records are taken, IPv4 ranges are split into prefixes. Only prefixes of
+// the selected countries are returned, nil selection takes all.
+func ParseDelegated(r io.Reader, selected map[string]struct{}) (map[string][]*net.IPNet, error) {
+	countries := make(map[string][]*net.IPNet)
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Split(line, "|")
+		// Version and summary lines are shorter than records
+		if len(fields) < 7 {
+			continue
+		}
+		country, recordType, start, value, status := fields[1], fields[2], fields[3], fields[4], fields[6]
+		if status != "allocated" && status != "assigned" || country == "" || country == "*" {
+			continue
+		}
+		country = strings.ToUpper(country)
+		if _, exists := selected[country]; selected != nil && !exists {
+			continue
+		}
+
+		switch recordType {
+		case "ipv4":
+			ip := net.ParseIP(start).To4()
+			count, err := strconv.ParseUint(value, 10, 32)
+			if ip == nil || err != nil {
+				return nil, fmt.Errorf("%w %d: %q", ErrInvalidLine, lineNumber, line)
+			}
+			countries[country] = append(countries[country], rangeToNetworks(ip, uint32(count))...)
+		case "ipv6":
+			_, network, err := net.ParseCIDR(start + "/" + value)
+			if err != nil {
+				return nil, fmt.Errorf("%w %d: %w", ErrInvalidLine, lineNumber, err)
+			}
+			countries[country] = append(countries[country], network)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read database: %w", err)
+	}
+	return countries, nil
+}
+
+// rangeToNetworks splits IPv4 range of count addresses into prefixes
+func rangeToNetworks(start net.IP, count uint32) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, 1)
+	address := uint64(start[0])<<24 | uint64(start[1])<<16 | uint64(start[2])<<8 | uint64(start[3])
+	left := uint64(count)
+	for left > 0 && address <= 0xFFFFFFFF {
+		// The largest block aligned to the address and not exceeding the range
+		size := 32
+		if address != 0 {
+			size = bits.TrailingZeros64(address)
+		}
+		size = min(size, 63-bits.LeadingZeros64(left))
+
+		ip := net.IPv4(byte(address>>24), byte(address>>16), byte(address>>8), byte(address)).To4()
+		networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(32-size, 32)})
+		address += 1 << size
+		left -= 1 << size
+	}
+	return networks
+}
+
+func New(asnPath, countryPath string) *Database {
+	return &Database{
+		ASNPath:     asnPath,
+		CountryPath: countryPath,
+	}
+}
@@ -0,0 +1,155 @@
+package prefixDatabase
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePfx2AS(t *testing.T) {
+	asns, err := ParsePfx2AS(strings.NewReader("1.0.0.0\t24\t13335\n31.13.24.0\t21\t32934\n2a03:2880::\t32\t32934\n8.8.8.0\t24\t15169_36040\n"), nil)
+	if err != nil {
+		t.Fatalf("ParsePfx2AS() returns error: %v", err)
+	}
+	if fmt.Sprint(asns[32934]) != "[31.13.24.0/21 2a03:2880::/32]" {
+		t.Fatalf(`ParsePfx2AS()[32934] = %v, want "[31.13.24.0/21 2a03:2880::/32]"`, asns[32934])
+	}
+	if len(asns[15169]) != 1 || len(asns[36040]) != 1 {
+		t.Fatal("ParsePfx2AS() does not assign multi-origin prefix to every AS")
+	}
+
+	asns, err = ParsePfx2AS(strings.NewReader("1.0.0.0\t24\t13335\n8.8.8.0\t24\t15169_36040\n"), map[uint32]struct{}{36040: {}})
+	if err != nil {
+		t.Fatalf("ParsePfx2AS() returns error: %v", err)
+	}
+	if len(asns) != 1 || fmt.Sprint(asns[36040]) != "[8.8.8.0/24]" {
+		t.Fatalf(`ParsePfx2AS() with selection = %v, want "map[36040:[8.8.8.0/24]]"`, asns)
+	}
+
+	_, err = ParsePfx2AS(strings.NewReader("1.0.0.0 24\n"), nil)
+	if err == nil {
+		t.Fatal("ParsePfx2AS() returns nil error on invalid line")
+	}
+}
+
+func TestParseDelegated(t *testing.T) {
+	data := `2|ripencc|1700000000|3|19830705|20231115|+0100
+ripencc|*|ipv4|*|2|summary
+ripencc|NL|ipv4|193.0.0.0|2048|19930901|allocated
+ripencc|NL|ipv4|10.0.0.0|768|20000101|assigned
+ripencc|NL|ipv6|2001:67c::|32|20000101|allocated
+ripencc|DE|ipv4|192.0.2.0|256|20000101|reserved
+`
+	countries, err := ParseDelegated(strings.NewReader(data), nil)
+	if err != nil {
+		t.Fatalf("ParseDelegated() returns error: %v", err)
+	}
+	want := "[193.0.0.0/21 10.0.0.0/23 10.0.2.0/24 2001:67c::/32]"
+	if fmt.Sprint(countries["NL"]) != want {
+		t.Fatalf("ParseDelegated()[\"NL\"] = %v, want %q", countries["NL"], want)
+	}
+	if len(countries["DE"]) != 0 {
+		t.Fatal("ParseDelegated() takes reserved records")
+	}
+
+	countries, err = ParseDelegated(strings.NewReader(data+"arin|US|ipv4|8.8.8.0|256|20000101|allocated\n"), map[string]struct{}{"US": {}})
+	if err != nil {
+		t.Fatalf("ParseDelegated() returns error: %v", err)
+	}
+	if len(countries) != 1 || fmt.Sprint(countries["US"]) != "[8.8.8.0/24]" {
+		t.Fatalf(`ParseDelegated() with selection = %v, want "map[US:[8.8.8.0/24]]"`, countries)
+	}
+}
+
+func TestRangeToNetworks(t *testing.T) {
+	networks := rangeToNetworks([]byte{10, 0, 1, 0}, 1024)
+	want := "[10.0.1.0/24 10.0.2.0/23 10.0.4.0/24]"
+	if fmt.Sprint(networks) != want {
+		t.Fatalf("rangeToNetworks(10.0.1.0, 1024) = %v, want %q", networks, want)
+	}
+
+	networks = rangeToNetworks([]byte{255, 255, 255, 255}, 10)
+	if fmt.Sprint(networks) != "[255.255.255.255/32]" {
+		t.Fatalf(`rangeToNetworks(255.255.255.255, 10) = %v, want "[255.255.255.255/32]"`, networks)
+	}
+}
+
+func TestDatabaseLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pfx2as")
+	err := os.WriteFile(path, []byte("31.13.24.0\t21\t32934\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	database := New(path, "")
+	changed, err := database.Load(map[uint32]struct{}{32934: {}}, nil)
+	if err != nil || !changed {
+		t.Fatalf("Database.Load() = %t, %v, want true", changed, err)
+	}
+	changed, err = database.Load(map[uint32]struct{}{32934: {}}, nil)
+	if err != nil || changed {
+		t.Fatalf("Database.Load() of unchanged file = %t, %v, want false", changed, err)
+	}
+
+	err = os.WriteFile(path, []byte("31.13.24.0\t21\t32934\n157.240.0.0\t16\t32934\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(path, time.Now(), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed, err = database.Load(map[uint32]struct{}{32934: {}}, nil)
+	if err != nil || !changed {
+		t.Fatalf("Database.Load() of modified file = %t, %v, want true", changed, err)
+	}
+	if len(database.ASN(32934)) != 2 {
+		t.Fatalf(`Database.ASN(32934) = %v, want 2 prefixes`, database.ASN(32934))
+	}
+}
+
+func TestDatabaseLoadSelection(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pfx2as")
+	err := os.WriteFile(path, []byte("1.0.0.0\t24\t13335\n31.13.24.0\t21\t32934\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	database := New(path, "")
+	changed, err := database.Load(map[uint32]struct{}{32934: {}}, nil)
+	if err != nil || !changed {
+		t.Fatalf("Database.Load() = %t, %v, want true", changed, err)
+	}
+	if len(database.ASN(13335)) != 0 {
+		t.Fatalf("Database.ASN(13335) = %v, want no prefixes of unselected ASN", database.ASN(13335))
+	}
+
+	// New ASN is not loaded yet
+	if !database.Covers(map[uint32]struct{}{32934: {}}, nil) || database.Covers(map[uint32]struct{}{32934: {}, 13335: {}}, nil) {
+		t.Fatal("Database.Covers() does not report loaded selection only")
+	}
+	changed, err = database.Load(map[uint32]struct{}{32934: {}, 13335: {}}, nil)
+	if err != nil || !changed {
+		t.Fatalf("Database.Load() with extended selection = %t, %v, want true", changed, err)
+	}
+	if len(database.ASN(13335)) != 1 {
+		t.Fatalf("Database.ASN(13335) = %v, want 1 prefix", database.ASN(13335))
+	}
+
+	// Narrowed selection is served by loaded data
+	changed, err = database.Load(map[uint32]struct{}{13335: {}}, nil)
+	if err != nil || changed {
+		t.Fatalf("Database.Load() with narrowed selection = %t, %v, want false", changed, err)
+	}
+
+	changed, err = database.Load(nil, nil)
+	if err != nil || !changed {
+		t.Fatalf("Database.Load() with empty selection = %t, %v, want true", changed, err)
+	}
+	if len(database.ASN(13335)) != 0 {
+		t.Fatalf("Database.ASN(13335) = %v, want no prefixes with empty selection", database.ASN(13335))
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// requestPrefixDatabaseReload schedules reload of the prefix database
+func (a *App) requestPrefixDatabaseReload() {
+	select {
+	case a.prefixesReload <- struct{}{}:
+	default:
+	}
+}
+
+func (a *App) runPrefixDatabaseReload(ctx context.Context) {
+	if a.Config.ASNDatabase == "" && a.Config.CountryDatabase == "" {
+		return
+	}
+
+	// Groups added before start are synced without prefixes
+	a.reloadPrefixDatabase()
+
+	var tick <-chan time.Time
+	if a.Config.DatabaseCheckInterval > 0 {
+		ticker := time.NewTicker(a.Config.DatabaseCheckInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-tick:
+			a.reloadPrefixDatabase()
+		case <-a.prefixesReload:
+			a.reloadPrefixDatabase()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// prefixSelection returns ASNs and countries referenced by enabled rules of
+// the groups and the extra group, which may be not added yet
+func (a *App) prefixSelection(extra *Group) (map[uint32]struct{}, map[string]struct{}) {
+	asns, countries := make(map[uint32]struct{}), make(map[string]struct{})
+	for _, group := range a.Groups {
+		group.addDatabaseSelection(asns, countries)
+	}
+	if extra != nil {
+		extra.addDatabaseSelection(asns, countries)
+	}
+	return asns, countries
+}
+
+// scheduleMissingPrefixes requests reload of the prefix database when the
+// group references ASNs or countries which are not loaded yet. Database is
+// parsed in background, so the lock held by the caller does not stall DNS
+// processing. Lock must be held.
+func (a *App) scheduleMissingPrefixes(group *Group) {
+	if !group.hasDatabaseRules() || a.prefixes == nil {
+		return
+	}
+	if !a.prefixes.Covers(a.prefixSelection(group)) {
+		a.requestPrefixDatabaseReload()
+	}
+}
+
+// reloadPrefixDatabase reloads modified database files and syncs groups with
+// "asn" or "geoip" rules
+func (a *App) reloadPrefixDatabase() {
+	a.mutex.RLock()
+	asns, countries := a.prefixSelection(nil)
+	a.mutex.RUnlock()
+
+	// Database is parsed without lock, DNS processing is not blocked
+	changed, err := a.prefixes.Load(asns, countries)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to reload prefix database")
+	}
+	if !changed {
+		return
+	}
+	log.Info().Msg("prefix database reloaded")
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for _, group := range a.Groups {
+		if !group.hasDatabaseRules() {
+			continue
+		}
+		err := a.syncGroup(group)
+		if err != nil {
+			log.Error().Int("group", group.ID).Err(err).Msg("failed to sync group")
+		}
+	}
+}
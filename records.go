@@ -2,14 +2,19 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 )
 
 type ARecord struct {
-	Address  net.IP
-	Deadline time.Time
+	Address  net.IP    `json:"address"`
+	Deadline time.Time `json:"deadline"`
 }
 
 func NewARecord(addr net.IP, deadline time.Time) *ARecord {
@@ -20,8 +25,8 @@ func NewARecord(addr net.IP, deadline time.Time) *ARecord {
 }
 
 type CNameRecord struct {
-	Alias    string
-	Deadline time.Time
+	Alias    string    `json:"alias"`
+	Deadline time.Time `json:"deadline"`
 }
 
 func NewCNameRecord(domainName string, deadline time.Time) *CNameRecord {
@@ -34,11 +39,12 @@ func NewCNameRecord(domainName string, deadline time.Time) *CNameRecord {
 type Records struct {
 	mutex        sync.RWMutex
 	ARecords     map[string][]*ARecord
+	AAAARecords  map[string][]*ARecord
 	CNameRecords map[string]*CNameRecord
 }
 
-func (r *Records) cleanupARecords(now time.Time) {
-	for name, aRecords := range r.ARecords {
+func cleanupAddressRecords(records map[string][]*ARecord, now time.Time) {
+	for name, aRecords := range records {
 		i := 0
 		for _, aRecord := range aRecords {
 			if now.After(aRecord.Deadline) {
@@ -47,13 +53,19 @@ func (r *Records) cleanupARecords(now time.Time) {
 			aRecords[i] = aRecord
 			i++
 		}
-		aRecords = aRecords[:i]
 		if i == 0 {
-			delete(r.ARecords, name)
+			delete(records, name)
+		} else {
+			records[name] = aRecords[:i]
 		}
 	}
 }
 
+func (r *Records) cleanupARecords(now time.Time) {
+	cleanupAddressRecords(r.ARecords, now)
+	cleanupAddressRecords(r.AAAARecords, now)
+}
+
 func (r *Records) cleanupCNameRecords(now time.Time) {
 	for name, record := range r.CNameRecords {
 		if now.After(record.Deadline) {
@@ -85,8 +97,8 @@ func (r *Records) getAliasedDomain(now time.Time, domainName string) string {
 	return domainName
 }
 
-func (r *Records) getActualARecords(now time.Time, domainName string) []*ARecord {
-	aRecords, ok := r.ARecords[domainName]
+func getActualAddressRecords(records map[string][]*ARecord, now time.Time, domainName string) []*ARecord {
+	aRecords, ok := records[domainName]
 	if !ok {
 		return nil
 	}
@@ -101,13 +113,22 @@ func (r *Records) getActualARecords(now time.Time, domainName string) []*ARecord
 	}
 	aRecords = aRecords[:i]
 	if i == 0 {
-		delete(r.ARecords, domainName)
+		delete(records, domainName)
 		return nil
 	}
+	records[domainName] = aRecords
 
 	return aRecords
 }
 
+func (r *Records) getActualARecords(now time.Time, domainName string) []*ARecord {
+	return getActualAddressRecords(r.ARecords, now, domainName)
+}
+
+func (r *Records) getActualAAAARecords(now time.Time, domainName string) []*ARecord {
+	return getActualAddressRecords(r.AAAARecords, now, domainName)
+}
+
 func (r *Records) getActualCNames(now time.Time, domainName string, fromEnd bool) []string {
 	processedDomains := make(map[string]struct{})
 	cNameList := make([]string, 0)
@@ -164,6 +185,14 @@ func (r *Records) GetARecords(domainName string) []*ARecord {
 	return r.getActualARecords(now, r.getAliasedDomain(now, domainName))
 }
 
+func (r *Records) GetAAAARecords(domainName string) []*ARecord {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := time.Now()
+
+	return r.getActualAAAARecords(now, r.getAliasedDomain(now, domainName))
+}
+
 func (r *Records) AddCNameRecord(domainName string, cName string, ttl time.Duration) {
 	if domainName == cName {
 		// Can't assing to yourself
@@ -175,25 +204,39 @@ func (r *Records) AddCNameRecord(domainName string, cName string, ttl time.Durat
 	now := time.Now()
 
 	delete(r.ARecords, domainName)
+	delete(r.AAAARecords, domainName)
 	r.CNameRecords[domainName] = NewCNameRecord(cName, now.Add(ttl))
 }
 
-func (r *Records) AddARecord(domainName string, addr net.IP, ttl time.Duration) {
-	r.mutex.Lock()
-	defer r.mutex.Unlock()
-	now := time.Now()
-
-	delete(r.CNameRecords, domainName)
-	if _, ok := r.ARecords[domainName]; !ok {
-		r.ARecords[domainName] = make([]*ARecord, 0)
+func addAddressRecord(records map[string][]*ARecord, now time.Time, domainName string, addr net.IP, ttl time.Duration) {
+	if _, ok := records[domainName]; !ok {
+		records[domainName] = make([]*ARecord, 0)
 	}
-	for _, aRecord := range r.ARecords[domainName] {
+	for _, aRecord := range records[domainName] {
 		if bytes.Compare(aRecord.Address, addr) == 0 {
 			aRecord.Deadline = now.Add(ttl)
 			return
 		}
 	}
-	r.ARecords[domainName] = append(r.ARecords[domainName], NewARecord(addr, now.Add(ttl)))
+	records[domainName] = append(records[domainName], NewARecord(addr, now.Add(ttl)))
+}
+
+func (r *Records) AddARecord(domainName string, addr net.IP, ttl time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := time.Now()
+
+	delete(r.CNameRecords, domainName)
+	addAddressRecord(r.ARecords, now, domainName, addr, ttl)
+}
+
+func (r *Records) AddAAAARecord(domainName string, addr net.IP, ttl time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := time.Now()
+
+	delete(r.CNameRecords, domainName)
+	addAddressRecord(r.AAAARecords, now, domainName, addr, ttl)
 }
 
 func (r *Records) ListKnownDomains() []string {
@@ -207,6 +250,9 @@ func (r *Records) ListKnownDomains() []string {
 	for name, _ := range r.ARecords {
 		domains[name] = struct{}{}
 	}
+	for name, _ := range r.AAAARecords {
+		domains[name] = struct{}{}
+	}
 	for name, _ := range r.CNameRecords {
 		domains[name] = struct{}{}
 	}
@@ -220,9 +266,123 @@ func (r *Records) ListKnownDomains() []string {
 	return domainsList
 }
 
+type recordsSnapshot struct {
+	ARecords     map[string][]*ARecord   `json:"a"`
+	AAAARecords  map[string][]*ARecord   `json:"aaaa"`
+	CNameRecords map[string]*CNameRecord `json:"cname"`
+}
+
+func copyAddressRecords(records map[string][]*ARecord) map[string][]*ARecord {
+	recordsCopy := make(map[string][]*ARecord, len(records))
+	for name, aRecords := range records {
+		aRecordsCopy := make([]*ARecord, len(aRecords))
+		for i, aRecord := range aRecords {
+			aRecordsCopy[i] = NewARecord(aRecord.Address, aRecord.Deadline)
+		}
+		recordsCopy[name] = aRecordsCopy
+	}
+	return recordsCopy
+}
+
+// snapshot returns a copy of actual records which is safe to use without lock
+func (r *Records) snapshot() recordsSnapshot {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := time.Now()
+	r.cleanupARecords(now)
+	r.cleanupCNameRecords(now)
+
+	cNameRecords := make(map[string]*CNameRecord, len(r.CNameRecords))
+	for name, cNameRecord := range r.CNameRecords {
+		cNameRecords[name] = NewCNameRecord(cNameRecord.Alias, cNameRecord.Deadline)
+	}
+
+	return recordsSnapshot{
+		ARecords:     copyAddressRecords(r.ARecords),
+		AAAARecords:  copyAddressRecords(r.AAAARecords),
+		CNameRecords: cNameRecords,
+	}
+}
+
+// Save writes actual records to the file. File is replaced atomically, so
+// a crash during saving doesn't corrupt the previous snapshot.
+func (r *Records) Save(path string) error {
+	data, err := json.Marshal(r.snapshot())
+	if err != nil {
+		return fmt.Errorf("failed to encode records: %w", err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create records directory: %w", err)
+	}
+
+	tmpPath := path + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write records: %w", err)
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return fmt.Errorf("failed to replace records file: %w", err)
+	}
+
+	return nil
+}
+
+// Load merges records from the file saved by Save. Expired records are
+// skipped, missing file is not an error.
+func (r *Records) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("failed to read records: %w", err)
+	}
+
+	snapshot := recordsSnapshot{}
+	err = json.Unmarshal(data, &snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to decode records: %w", err)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := time.Now()
+
+	for name, aRecords := range snapshot.ARecords {
+		for _, aRecord := range aRecords {
+			address := aRecord.Address.To4()
+			if address == nil || now.After(aRecord.Deadline) {
+				continue
+			}
+			addAddressRecord(r.ARecords, now, name, address, aRecord.Deadline.Sub(now))
+		}
+	}
+	for name, aRecords := range snapshot.AAAARecords {
+		for _, aRecord := range aRecords {
+			if len(aRecord.Address) != net.IPv6len || now.After(aRecord.Deadline) {
+				continue
+			}
+			addAddressRecord(r.AAAARecords, now, name, aRecord.Address, aRecord.Deadline.Sub(now))
+		}
+	}
+	for name, cNameRecord := range snapshot.CNameRecords {
+		if now.After(cNameRecord.Deadline) {
+			continue
+		}
+		r.CNameRecords[name] = cNameRecord
+	}
+
+	return nil
+}
+
 func NewRecords() *Records {
 	return &Records{
 		ARecords:     make(map[string][]*ARecord),
+		AAAARecords:  make(map[string][]*ARecord),
 		CNameRecords: make(map[string]*CNameRecord),
 	}
 }
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecordsSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records", "records.json")
+
+	records := NewRecords()
+	records.AddARecord("example.com", net.IP{192, 168, 1, 1}, time.Hour)
+	records.AddARecord("expired.com", net.IP{192, 168, 1, 2}, -time.Hour)
+	records.AddAAAARecord("example.com", net.ParseIP("2001:db8::1"), time.Hour)
+	records.AddCNameRecord("www.example.com", "example.com", time.Hour)
+
+	err := records.Save(path)
+	if err != nil {
+		t.Fatalf("Records.Save() returns error: %v", err)
+	}
+
+	loaded := NewRecords()
+	err = loaded.Load(path)
+	if err != nil {
+		t.Fatalf("Records.Load() returns error: %v", err)
+	}
+
+	aRecords := loaded.GetARecords("www.example.com")
+	if len(aRecords) != 1 || !aRecords[0].Address.Equal(net.IP{192, 168, 1, 1}) || len(aRecords[0].Address) != net.IPv4len {
+		t.Fatalf("Records.GetARecords(\"www.example.com\") = %v, want [192.168.1.1]", aRecords)
+	}
+	aaaaRecords := loaded.GetAAAARecords("example.com")
+	if len(aaaaRecords) != 1 || !aaaaRecords[0].Address.Equal(net.ParseIP("2001:db8::1")) {
+		t.Fatalf("Records.GetAAAARecords(\"example.com\") = %v, want [2001:db8::1]", aaaaRecords)
+	}
+	if aRecords := loaded.GetARecords("expired.com"); len(aRecords) != 0 {
+		t.Fatalf("Records.GetARecords(\"expired.com\") = %v, want []", aRecords)
+	}
+}
+
+func TestRecordsLoadMissingFile(t *testing.T) {
+	records := NewRecords()
+	err := records.Load(filepath.Join(t.TempDir(), "missing.json"))
+	if err != nil {
+		t.Fatalf("Records.Load() of missing file returns error: %v", err)
+	}
+}